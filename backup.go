@@ -0,0 +1,326 @@
+package tindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// An incremental backup holds the changes of an index after a generation. It
+// starts with a JSON object describing the backup, which is followed by the
+// documents added after the generation in the export format.
+//
+// Postings lists only grow and documents are never modified, so new
+// documents, terms documents of earlier generations were added to through
+// SecondaryIndex, soft deletions and undeletions make up all changes.
+
+// bktSecondaryLog records the postings added through SecondaryIndex by
+// generation if the index is opened with History. Its keys are the
+// generation, document ID and term ID. The generation it was created in is
+// stored in the meta bucket.
+var bktSecondaryLog = []byte("secondary_log")
+
+var keySecondaryLogStart = []byte("secondary_log_start")
+
+// secondaryPost is a posting added through SecondaryIndex.
+type secondaryPost struct {
+	id   DocID
+	term termid
+}
+
+func (ix *Index) initSecondaryLog(tx *bolt.Tx) error {
+	if tx.Bucket(bktSecondaryLog) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket(bktSecondaryLog); err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktSecondaryLog), err)
+	}
+	return tx.Bucket(bktMeta).Put(keySecondaryLogStart, encodeUint64(ix.meta.Generation))
+}
+
+// recordSecondary records the postings added through SecondaryIndex in the
+// generation of the batch's commit.
+func (b *Batch) recordSecondary(tx *bolt.Tx) error {
+	bkt := tx.Bucket(bktSecondaryLog)
+	if bkt == nil {
+		return nil
+	}
+	for _, p := range b.secondary {
+		if err := bkt.Put(encodeSecondaryPost(b.meta.Generation, p), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeSecondaryPost returns the key of a posting added through
+// SecondaryIndex in the given generation.
+func encodeSecondaryPost(gen uint64, p secondaryPost) []byte {
+	k := append(encodeUint64(gen), p.id.bytes()...)
+	return append(k, p.term.bytes()...)
+}
+
+// decodeSecondaryPost returns the generation and posting of a key of the
+// secondary index log.
+func decodeSecondaryPost(k []byte) (uint64, secondaryPost, error) {
+	if len(k) != 24 {
+		return 0, secondaryPost{}, fmt.Errorf("invalid secondary index log key of length %d", len(k))
+	}
+	return decodeUint64(k), secondaryPost{id: newDocID(k[8:16]), term: newTermID(k[16:])}, nil
+}
+
+// backupHeader describes an incremental backup.
+type backupHeader struct {
+	// Since and Gen are the generations the backup starts after and ends
+	// with.
+	Since uint64 `json:"since"`
+	Gen   uint64 `json:"gen"`
+	// After is the last document ID of generation Since. The backup holds
+	// all documents following it.
+	After DocID `json:"after"`
+	// Deleted lists the documents soft-deleted after generation Since.
+	Deleted []DocID `json:"deleted,omitempty"`
+	// Undeleted lists the documents restored after generation Since.
+	Undeleted []DocID `json:"undeleted,omitempty"`
+	// Secondary lists the terms documents up to After were added to
+	// through SecondaryIndex after generation Since.
+	Secondary []backupSecondary `json:"secondary,omitempty"`
+}
+
+// backupSecondary holds the terms a document was added to through
+// SecondaryIndex.
+type backupSecondary struct {
+	ID    DocID `json:"id"`
+	Terms Terms `json:"terms"`
+}
+
+// BackupSince writes the changes of the index after the generation gen to w
+// and returns the generation the backup ends with, which is passed to the
+// next call. The generation must have been recorded with History, except for
+// zero, which backs up the entire index. Changes are read from the history,
+// so its cost depends on the number of changes rather than the size of the
+// index.
+func (ix *Index) BackupSince(gen uint64, w io.Writer) (uint64, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	var m meta
+	if err := m.read(q.kvtx.Bucket(bktMeta).Get(keyMeta)); err != nil {
+		return 0, fmt.Errorf("reading meta failed: %w", err)
+	}
+	h := backupHeader{Since: gen, Gen: m.Generation}
+
+	var secondary secondaryTerms
+
+	if gen > 0 {
+		bkt := q.kvtx.Bucket(bktHistory)
+		if bkt == nil {
+			return 0, fmt.Errorf("history: %w", ErrNotFound)
+		}
+		v := bkt.Get(encodeUint64(gen))
+		if v == nil {
+			return 0, fmt.Errorf("generation %d: %w", gen, ErrNotFound)
+		}
+		g, err := decodeGeneration(encodeUint64(gen), v)
+		if err != nil {
+			return 0, err
+		}
+		h.After = g.LastDocID
+
+		log, err := q.secondarySince(gen)
+		if err != nil {
+			return 0, err
+		}
+		if h.Secondary, err = log.before(h.After); err != nil {
+			return 0, err
+		}
+		secondary = log
+	} else {
+		if secondary, err = q.secondaryPostings(); err != nil {
+			return 0, err
+		}
+	}
+	if bkt := q.kvtx.Bucket(bktUndeleted); bkt != nil && gen > 0 {
+		err := bkt.ForEach(func(k, v []byte) error {
+			if decodeUint64(v) > gen {
+				h.Undeleted = append(h.Undeleted, newDocID(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if bkt := q.kvtx.Bucket(bktDeleted); bkt != nil {
+		err := bkt.ForEach(func(k, v []byte) error {
+			// Records without a generation were written before generations
+			// were recorded.
+			if _, dgen := decodeDeletion(v); gen == 0 || dgen > gen {
+				h.Deleted = append(h.Deleted, newDocID(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var (
+		bw  = bufio.NewWriter(w)
+		enc = json.NewEncoder(bw)
+	)
+	if err := enc.Encode(h); err != nil {
+		return 0, err
+	}
+	if err := q.exportDocs(enc, h.After, false, secondary); err != nil {
+		return 0, err
+	}
+	return h.Gen, bw.Flush()
+}
+
+// secondaryLog holds the postings added through SecondaryIndex after a
+// generation by document.
+type secondaryLog struct {
+	q   *Querier
+	ids map[DocID][]termid
+}
+
+// secondarySince reads the postings added through SecondaryIndex after the
+// generation gen.
+func (q *Querier) secondarySince(gen uint64) (*secondaryLog, error) {
+	bkt := q.kvtx.Bucket(bktSecondaryLog)
+	if bkt == nil {
+		return nil, fmt.Errorf("secondary index log: %w", ErrNotFound)
+	}
+	if v := q.kvtx.Bucket(bktMeta).Get(keySecondaryLogStart); v != nil && decodeUint64(v) > gen {
+		return nil, fmt.Errorf("secondary index log starts after generation %d: %w", decodeUint64(v), ErrNotFound)
+	}
+	log := &secondaryLog{q: q, ids: map[DocID][]termid{}}
+
+	c := bkt.Cursor()
+	for k, _ := c.Seek(encodeUint64(gen + 1)); k != nil; k, _ = c.Next() {
+		_, p, err := decodeSecondaryPost(k)
+		if err != nil {
+			return nil, err
+		}
+		log.ids[p.id] = append(log.ids[p.id], p.term)
+	}
+	return log, nil
+}
+
+// before returns the logged terms of documents up to the given ID in order
+// of their IDs.
+func (l *secondaryLog) before(max DocID) ([]backupSecondary, error) {
+	var res []backupSecondary
+
+	for id, tids := range l.ids {
+		if id > max {
+			continue
+		}
+		terms, err := l.lookup(tids, nil)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, backupSecondary{ID: id, Terms: terms})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// terms implements secondaryTerms.
+func (l *secondaryLog) terms(id DocID, own termids) (Terms, error) {
+	return l.lookup(l.ids[id], own)
+}
+
+// lookup returns the terms of the term IDs that are not among own.
+func (l *secondaryLog) lookup(tids []termid, own termids) (Terms, error) {
+	var (
+		res  Terms
+		bkt  = l.q.kvtx.Bucket(bktTermIDs)
+		seen = map[termid]bool{}
+	)
+	for _, tid := range tids {
+		if seen[tid] || own.contains(tid) {
+			continue
+		}
+		seen[tid] = true
+
+		v := bkt.Get(tid.bytes())
+		if v == nil {
+			return nil, fmt.Errorf("term %d: %w", tid, ErrNotFound)
+		}
+		t, err := newTerm(v)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// ApplyBackup applies an incremental backup to the index, which must hold
+// exactly the documents up to the start of the backup, for example because
+// it was restored from a full backup and all previous incremental backups.
+// Documents keep their IDs. They are committed in batches, so documents
+// before a failing batch remain in the index.
+func (ix *Index) ApplyBackup(r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	var h backupHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("reading backup header failed: %w", err)
+	}
+	ix.snaplock.RLock()
+	last := ix.meta.LastDocID
+	ix.snaplock.RUnlock()
+
+	if last != h.After {
+		return fmt.Errorf("backup starts after document %d but index ends at %d", h.After, last)
+	}
+	// Documents up to After were added to postings lists before any of the
+	// backup's documents.
+	if len(h.Secondary) > 0 {
+		b, err := ix.Batch()
+		if err != nil {
+			return err
+		}
+		for _, s := range h.Secondary {
+			b.SecondaryIndex(s.ID, s.Terms...)
+		}
+		if err := b.Commit(); err != nil {
+			return err
+		}
+	}
+	_, err := ix.ingest(func(b *Batch) error {
+		var d exportDoc
+		if err := dec.Decode(&d); err != nil {
+			return err
+		}
+		if id := b.Add(d.Terms); id != d.ID {
+			return fmt.Errorf("document %d restored with ID %d", d.ID, id)
+		}
+		if len(d.Secondary) > 0 {
+			b.SecondaryIndex(d.ID, d.Secondary...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(h.Undeleted) > 0 {
+		if _, err := ix.Undelete(newPlainListIterator(h.Undeleted)); err != nil {
+			return err
+		}
+	}
+	if len(h.Deleted) == 0 {
+		return nil
+	}
+	_, err = ix.SoftDelete(newPlainListIterator(h.Deleted))
+	return err
+}
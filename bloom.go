@@ -0,0 +1,196 @@
+package tindex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktBlooms holds a bucket of Bloom filters over the document IDs of each
+// term's postings list.
+//
+// A postings list grows without bounds, so its IDs are added to a sequence of
+// filters. Once the last filter holds as many IDs as it was sized for, a new
+// one with twice the capacity is started. Only the last filter is rewritten
+// on commit. The false positive rate of the whole sequence is the sum of
+// those of its filters.
+var bktBlooms = []byte("postings_blooms")
+
+const (
+	bloomBaseCapacity = 1024 // IDs held by the first filter of a term
+	bloomBitsPerID    = 10
+	bloomHashes       = 7
+)
+
+// bloomCapacity returns the number of IDs the i-th filter of a term holds.
+func bloomCapacity(i uint64) uint64 {
+	if i > 32 {
+		i = 32
+	}
+	return bloomBaseCapacity << i
+}
+
+// bloom is a Bloom filter prefixed with the number of IDs added to it.
+type bloom []byte
+
+func newBloom(capacity uint64) bloom {
+	return make(bloom, 8+capacity*bloomBitsPerID/8)
+}
+
+func (b bloom) count() uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func (b bloom) add(id DocID) {
+	bits := b[8:]
+	n := uint64(len(bits)) * 8
+
+	h1, h2 := bloomHash(id)
+	for i := uint64(0); i < bloomHashes; i++ {
+		x := (h1 + i*h2) % n
+		bits[x/8] |= 1 << (x % 8)
+	}
+	binary.BigEndian.PutUint64(b, b.count()+1)
+}
+
+func (b bloom) has(id DocID) bool {
+	bits := b[8:]
+	n := uint64(len(bits)) * 8
+
+	h1, h2 := bloomHash(id)
+	for i := uint64(0); i < bloomHashes; i++ {
+		x := (h1 + i*h2) % n
+		if bits[x/8]&(1<<(x%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns two hashes of id for double hashing. The second one is
+// odd so that it never repeats positions.
+func bloomHash(id DocID) (uint64, uint64) {
+	h := mix64(uint64(id))
+	return h & 0xffffffff, h>>32 | 1
+}
+
+// initBlooms creates the Bloom filters if enabled and removes them otherwise.
+// For existing postings lists, they are built from all their IDs.
+func (ix *Index) initBlooms(tx *bolt.Tx) error {
+	if !ix.opts.BloomFilters {
+		if tx.Bucket(bktBlooms) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(bktBlooms)
+	}
+	if tx.Bucket(bktBlooms) != nil {
+		return nil
+	}
+	blooms, err := tx.CreateBucket(bktBlooms)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktBlooms), err)
+	}
+	pbtx, err := ix.beginPB(false)
+	if err != nil {
+		return err
+	}
+	defer pbtx.Rollback()
+
+	q := &Querier{
+		ix:        ix,
+		kvtx:      tx,
+		pbtx:      pbtx,
+		termBkt:   tx.Bucket(bktTerms),
+		skiplists: ix.skiplists(tx),
+	}
+	return q.forEachPostingsList(func(t termid) error {
+		it, err := q.postingsIter(t, nil)
+		if err != nil {
+			return err
+		}
+		ids, err := ExpandIterator(it)
+		if err != nil {
+			return fmt.Errorf("reading postings of term %d: %w", t, err)
+		}
+		return addBloom(blooms, t, ids)
+	})
+}
+
+// addBloom adds the IDs to the Bloom filters of term t.
+func addBloom(bkt *bolt.Bucket, t termid, ids []DocID) error {
+	tb, err := bkt.CreateBucketIfNotExists(t.bytes())
+	if err != nil {
+		return err
+	}
+	var (
+		i uint64
+		f bloom
+	)
+	if k, v := tb.Cursor().Last(); k != nil {
+		i = decodeUint64(k)
+		// The value is mmaped from bolt. Copy it to make modifications.
+		f = make(bloom, len(v))
+		copy(f, v)
+	} else {
+		f = newBloom(bloomCapacity(0))
+	}
+	for _, id := range ids {
+		if f.count() >= bloomCapacity(i) {
+			if err := tb.Put(encodeUint64(i), f); err != nil {
+				return err
+			}
+			i++
+			f = newBloom(bloomCapacity(i))
+		}
+		f.add(id)
+	}
+	return tb.Put(encodeUint64(i), f)
+}
+
+// mayContain returns false if the postings list of term t definitely does
+// not contain id.
+func mayContain(bkt *bolt.Bucket, t termid, id DocID) bool {
+	tb := bkt.Bucket(t.bytes())
+	if tb == nil {
+		return false
+	}
+	c := tb.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if bloom(v).has(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns whether the postings list of term t contains id. If the
+// index was opened with BloomFilters, most IDs that are not contained are
+// ruled out without reading postings pages.
+func (q *Querier) Contains(t Term, id DocID) (bool, error) {
+	v := q.termBkt.Get(t.bytes())
+	if v == nil {
+		return false, nil
+	}
+	tid := newTermID(v)
+
+	if !q.visible(id) {
+		return false, nil
+	}
+	if blooms := q.kvtx.Bucket(bktBlooms); blooms != nil && !mayContain(blooms, tid, id) {
+		return false, nil
+	}
+	it, err := q.postingsIter(tid, nil)
+	if err != nil {
+		return false, err
+	}
+	x, err := it.Seek(id)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return x == id, nil
+}
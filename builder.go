@@ -0,0 +1,58 @@
+package tindex
+
+import "sort"
+
+// TermsBuilder builds the terms of a document.
+type TermsBuilder struct {
+	base Terms
+	set  map[string]string
+	del  map[string]struct{}
+}
+
+// NewTermsBuilder returns a builder that starts from the given terms.
+func NewTermsBuilder(base Terms) *TermsBuilder {
+	return &TermsBuilder{
+		base: base,
+		set:  map[string]string{},
+		del:  map[string]struct{}{},
+	}
+}
+
+// Set sets the value of the field, replacing any previous one.
+func (b *TermsBuilder) Set(field, val string) *TermsBuilder {
+	delete(b.del, field)
+	b.set[field] = val
+	return b
+}
+
+// Del removes the field.
+func (b *TermsBuilder) Del(field string) *TermsBuilder {
+	delete(b.set, field)
+	b.del[field] = struct{}{}
+	return b
+}
+
+// Terms returns the resulting terms sorted by field. It fails if they
+// are not valid.
+func (b *TermsBuilder) Terms() (Terms, error) {
+	res := make(Terms, 0, len(b.base)+len(b.set))
+
+	for _, t := range b.base {
+		if _, ok := b.set[t.Field]; ok {
+			continue
+		}
+		if _, ok := b.del[t.Field]; ok {
+			continue
+		}
+		res = append(res, t)
+	}
+	for f, v := range b.set {
+		res = append(res, Term{Field: f, Val: v})
+	}
+	sort.Sort(res)
+
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
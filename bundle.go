@@ -0,0 +1,187 @@
+package tindex
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A bundle is a tar archive of both stores of an index and its meta file.
+// The key/value store holds the state of the index, so no other files are
+// needed to open it. The meta file is omitted if the index has none.
+var bundleFiles = []string{"kv", "pb", metaFile}
+
+// Bundle writes the index as a single archive to w. Writes to the index are
+// blocked until the archive is written.
+func (ix *Index) Bundle(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	add := func(name string, size int64, write func(io.Writer) error) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0666,
+			Size:    size,
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		return write(tw)
+	}
+	if err := ix.writeStores(add); err != nil {
+		return err
+	}
+	if ix.info != nil {
+		b, err := os.ReadFile(filepath.Join(ix.path, metaFile))
+		if err != nil {
+			return err
+		}
+		err = add(metaFile, int64(len(b)), func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("writing meta file: %w", err)
+		}
+	}
+	return tw.Close()
+}
+
+// writeStores calls add for the files of both stores with their name, size,
+// and a function writing their contents. Writes to the index are blocked
+// until it returns.
+func (ix *Index) writeStores(add func(name string, size int64, write func(io.Writer) error) error) error {
+	ix.rwlock.Lock()
+	defer ix.rwlock.Unlock()
+
+	kvtx, err := ix.beginKV(false)
+	if err != nil {
+		return err
+	}
+	defer kvtx.Rollback()
+
+	err = add("kv", kvtx.Size(), func(w io.Writer) error {
+		_, err := kvtx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writing key/value store: %w", err)
+	}
+
+	// All changes to the page store are made while holding rwlock. Its file
+	// is complete as of the last commit.
+	f, err := os.Open(ix.opts.pbPath(ix.path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = add("pb", fi.Size(), func(w io.Writer) error {
+		_, err := io.CopyN(w, f, fi.Size())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writing page store: %w", err)
+	}
+	return nil
+}
+
+// OpenBundle opens the index archived in the file at path for reading. The
+// archive is extracted into a temporary directory, which is removed when
+// the index is closed. The ReadOnly option is always set and both stores are
+// read from the temporary directory.
+func OpenBundle(path string, opts *Options) (_ *Index, err error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	o := *opts
+	o.ReadOnly = true
+	o.KVDir, o.PostingsDir = "", ""
+
+	dir, err := os.MkdirTemp("", "tindex-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := extractBundle(path, dir); err != nil {
+		return nil, fmt.Errorf("extract bundle: %w", err)
+	}
+	ix, err := Open(dir, &o)
+	if err != nil {
+		return nil, err
+	}
+	ix.tmpdir = dir
+	return ix, nil
+}
+
+func extractBundle(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		tr    = tar.NewReader(f)
+		found = map[string]bool{}
+	)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !isBundleFile(h.Name) {
+			return fmt.Errorf("unexpected file %q", h.Name)
+		}
+		if found[h.Name] {
+			return fmt.Errorf("duplicate file %q", h.Name)
+		}
+		found[h.Name] = true
+
+		if err := extractFile(filepath.Join(dir, h.Name), tr); err != nil {
+			return err
+		}
+	}
+	for _, name := range bundleFiles {
+		if !found[name] && name != metaFile {
+			return fmt.Errorf("missing file %q", name)
+		}
+	}
+	return nil
+}
+
+func isBundleFile(name string) bool {
+	for _, n := range bundleFiles {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func extractFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,103 @@
+package tindex
+
+import (
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// docCache is a bounded LRU cache of decoded documents. Documents cannot be
+// modified once committed, so cached entries never become stale. Once
+// deletions are implemented, they must remove documents from the cache.
+//
+// A nil cache caches nothing.
+type docCache struct {
+	mtx   sync.Mutex
+	size  int
+	items map[DocID]*docCacheEntry
+	// Sentinel of the circular list of entries. Its next entry is the most
+	// recently used one.
+	root docCacheEntry
+}
+
+type docCacheEntry struct {
+	id         DocID
+	terms      Terms
+	prev, next *docCacheEntry
+}
+
+func newDocCache(size int) *docCache {
+	if size <= 0 {
+		return nil
+	}
+	c := &docCache{
+		size:  size,
+		items: make(map[DocID]*docCacheEntry, size),
+	}
+	c.root.prev, c.root.next = &c.root, &c.root
+	return c
+}
+
+func (c *docCache) get(id DocID) (Terms, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.unlink(e)
+	c.pushFront(e)
+	return e.terms, true
+}
+
+func (c *docCache) add(id DocID, terms Terms) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.items[id]; ok {
+		c.unlink(e)
+		c.pushFront(e)
+		return
+	}
+	e := &docCacheEntry{id: id, terms: terms}
+	c.items[id] = e
+	c.pushFront(e)
+
+	if len(c.items) > c.size {
+		last := c.root.prev
+		c.unlink(last)
+		delete(c.items, last.id)
+	}
+}
+
+func (c *docCache) pushFront(e *docCacheEntry) {
+	e.prev, e.next = &c.root, c.root.next
+	e.next.prev = e
+	c.root.next = e
+}
+
+func (c *docCache) unlink(e *docCacheEntry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+}
+
+// doc returns the cached document or decodes and caches it. The returned
+// terms are shared and must not be modified.
+func (c *docCache) doc(docsBkt, termidBkt *bolt.Bucket, terms map[termid]Term, id DocID) (Terms, error) {
+	if t, ok := c.get(id); ok {
+		return t, nil
+	}
+	t, err := doc(docsBkt, termidBkt, terms, id)
+	if err != nil {
+		return nil, err
+	}
+	c.add(id, t)
+	return t, nil
+}
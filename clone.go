@@ -0,0 +1,79 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// CloneTo writes an independent copy of the index to dir, which must not
+// exist yet. Both stores are copied at the same commit and writes to the
+// index are blocked until they are written. The copy is assigned a new UUID
+// and can be opened and modified without affecting the index. Stores the
+// index keeps outside of its directory are placed in the directory of the
+// copy.
+func (ix *Index) CloneTo(dir string) (err error) {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("clone directory %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return err
+	}
+	m := &Meta{
+		UUID:    uuid,
+		Created: time.Now().UTC(),
+		Version: FormatVersion,
+		Options: *ix.opts,
+	}
+	if ix.info != nil {
+		m.Version, m.Options = ix.info.Version, ix.info.Options
+	}
+	m.Options.Logger, m.Options.TracerProvider = nil, nil
+	// The stores are written according to the current options.
+	opts := *ix.opts
+	opts.localLayout()
+	m.Options.KVDir, m.Options.PostingsDir = opts.KVDir, opts.PostingsDir
+
+	for _, d := range append([]string{dir}, opts.storeDirs(dir)...) {
+		if err := os.MkdirAll(d, opts.dirMode()); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	paths := map[string]string{"kv": opts.kvPath(dir), "pb": opts.pbPath(dir)}
+
+	err = ix.writeStores(func(name string, _ int64, write func(io.Writer) error) error {
+		return writeFile(paths[name], opts.fileMode(), write)
+	})
+	if err != nil {
+		return err
+	}
+	return writeMeta(dir, m, opts.fileMode())
+}
+
+// writeFile creates the file at path with the contents written by write
+// and syncs it to disk.
+func writeFile(path string, mode os.FileMode, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
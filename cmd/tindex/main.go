@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/fabxc/tindex"
@@ -24,6 +25,11 @@ func main() {
 
 	root.AddCommand(
 		NewBenchCommand(),
+		NewDiffCommand(),
+		NewDumpCommand(),
+		NewExportCommand(),
+		NewRestoreCommand(),
+		NewShellCommand(),
 	)
 
 	root.Execute()
@@ -39,6 +45,156 @@ func NewBenchCommand() *cobra.Command {
 	return c
 }
 
+func NewDiffCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff <dirA> <dirB>",
+		Short: "print the differences between two indexes",
+		Run:   runDiff,
+	}
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		exitWithError(fmt.Errorf("expected two directory arguments"))
+	}
+	var qs [2]*tindex.Querier
+
+	for i, dir := range args {
+		ix, err := tindex.Open(dir, &tindex.Options{ReadOnly: true})
+		if err != nil {
+			exitWithError(err)
+		}
+		defer ix.Close()
+
+		if qs[i], err = ix.Querier(); err != nil {
+			exitWithError(err)
+		}
+		defer qs[i].Close()
+	}
+	d, err := tindex.Diff(qs[0], qs[1])
+	if err != nil {
+		exitWithError(err)
+	}
+	for _, t := range d.OnlyA {
+		fmt.Printf("only in A: %s\n", formatTerms(t))
+	}
+	for _, t := range d.OnlyB {
+		fmt.Printf("only in B: %s\n", formatTerms(t))
+	}
+	for _, c := range d.Changed {
+		fmt.Printf("document %d: A=%s B=%s\n", c.ID, formatTerms(c.A), formatTerms(c.B))
+	}
+	for _, p := range d.Postings {
+		fmt.Printf("postings %s=%q: A=%d B=%d\n", p.Term.Field, p.Term.Val, p.A, p.B)
+	}
+	if !d.Empty() {
+		os.Exit(1)
+	}
+}
+
+// formatTerms formats terms as a label set.
+func formatTerms(terms tindex.Terms) string {
+	if terms == nil {
+		return "-"
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, t := range terms {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s=%q", t.Field, t.Val)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func NewDumpCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump <dir> <field> <value>",
+		Short: "print the skiplist and postings pages of a term",
+		Run:   runDump,
+	}
+}
+
+func runDump(cmd *cobra.Command, args []string) {
+	if len(args) != 3 {
+		exitWithError(fmt.Errorf("expected directory, field, and value arguments"))
+	}
+	ix, err := tindex.Open(args[0], &tindex.Options{ReadOnly: true})
+	if err != nil {
+		exitWithError(err)
+	}
+	defer ix.Close()
+
+	q, err := ix.Querier()
+	if err != nil {
+		exitWithError(err)
+	}
+	defer q.Close()
+
+	if err := q.Dump(os.Stdout, tindex.Term{Field: args[1], Val: args[2]}); err != nil {
+		exitWithError(err)
+	}
+}
+
+func NewExportCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <dir>",
+		Short: "write all documents of an index to stdout",
+		Run:   runExport,
+	}
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		exitWithError(fmt.Errorf("missing directory argument"))
+	}
+	ix, err := tindex.Open(args[0], &tindex.Options{ReadOnly: true})
+	if err != nil {
+		exitWithError(err)
+	}
+	defer ix.Close()
+
+	q, err := ix.Querier()
+	if err != nil {
+		exitWithError(err)
+	}
+	defer q.Close()
+
+	if err := q.Export(os.Stdout); err != nil {
+		exitWithError(err)
+	}
+}
+
+func NewRestoreCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <dir>",
+		Short: "create an index from an export read from stdin",
+		Run:   runRestore,
+	}
+}
+
+func runRestore(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		exitWithError(fmt.Errorf("missing directory argument"))
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		exitWithError(fmt.Errorf("directory %s already exists", args[0]))
+	}
+	ix, err := tindex.Open(args[0], nil)
+	if err != nil {
+		exitWithError(err)
+	}
+	if err := ix.Import(os.Stdin); err != nil {
+		ix.Close()
+		exitWithError(err)
+	}
+	if err := ix.Close(); err != nil {
+		exitWithError(err)
+	}
+}
+
 type writeBenchmark struct {
 	outPath string
 	cleanup bool
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fabxc/tindex"
+	"github.com/spf13/cobra"
+)
+
+const shellHelp = `commands:
+  search <selector>   list the IDs of matching documents
+  explain <selector>  list the terms merged for each matcher
+  values <field>      list all values of a field
+  doc <id>            print the terms of a document
+  help                print this help
+  quit                leave the shell
+
+Selectors are comma separated matchers, e.g. job="api",instance=~"a.*".
+Operators are =, !=, =~, and !~.
+`
+
+// shellResultLimit is the maximum number of IDs printed for a search.
+const shellResultLimit = 100
+
+func NewShellCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "shell <dir>",
+		Short: "query an index interactively",
+		Run:   runShell,
+	}
+}
+
+func runShell(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		exitWithError(fmt.Errorf("missing directory argument"))
+	}
+	ix, err := tindex.Open(args[0], &tindex.Options{ReadOnly: true})
+	if err != nil {
+		exitWithError(err)
+	}
+	defer ix.Close()
+
+	// All commands of the session see the same snapshot.
+	q, err := ix.Querier()
+	if err != nil {
+		exitWithError(err)
+	}
+	defer q.Close()
+
+	sh := &shell{ix: ix, q: q, out: os.Stdout}
+	sh.run(os.Stdin)
+}
+
+type shell struct {
+	ix  *tindex.Index
+	q   *tindex.Querier
+	out io.Writer
+}
+
+func (sh *shell) run(r io.Reader) {
+	sc := bufio.NewScanner(r)
+
+	for fmt.Fprint(sh.out, "> "); sc.Scan(); fmt.Fprint(sh.out, "> ") {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		var err error
+
+		switch cmd {
+		case "search":
+			err = sh.search(arg)
+		case "explain":
+			err = sh.explain(arg)
+		case "values":
+			for _, v := range sh.q.Values(arg) {
+				fmt.Fprintln(sh.out, v)
+			}
+		case "doc":
+			err = sh.doc(arg)
+		case "help":
+			fmt.Fprint(sh.out, shellHelp)
+		case "quit", "exit":
+			return
+		default:
+			err = fmt.Errorf("unknown command %q, type help for a list of commands", cmd)
+		}
+		if err != nil {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+	// Terminate the last prompt.
+	fmt.Fprintln(sh.out)
+}
+
+func (sh *shell) search(sel string) error {
+	ms, err := parseSelector(sel)
+	if err != nil {
+		return err
+	}
+	its := make([]tindex.Iterator, 0, len(ms))
+
+	for _, m := range ms {
+		it, err := sh.q.Search(m.field, m.m)
+		if err != nil {
+			return err
+		}
+		if it == nil {
+			fmt.Fprintln(sh.out, "0 documents")
+			return nil
+		}
+		its = append(its, it)
+	}
+	ids, err := tindex.ExpandIterator(tindex.Intersect(its...))
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if i == shellResultLimit {
+			fmt.Fprintf(sh.out, "...\n")
+			break
+		}
+		fmt.Fprintln(sh.out, id)
+	}
+	fmt.Fprintf(sh.out, "%d documents\n", len(ids))
+	return nil
+}
+
+func (sh *shell) explain(sel string) error {
+	ms, err := parseSelector(sel)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(sh.out, "intersection of")
+
+	for _, m := range ms {
+		tcs, err := sh.q.Explain(m.field, m.m)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "  %s%s: merge of %d terms\n", m.field, m.m, len(tcs))
+
+		for _, tc := range tcs {
+			fmt.Fprintf(sh.out, "    %s=%q postings=%d\n", tc.Term.Field, tc.Term.Val, tc.Docs)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) doc(arg string) error {
+	id, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid document ID %q", arg)
+	}
+	terms, err := sh.ix.Doc(tindex.DocID(id))
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		fmt.Fprintf(sh.out, "%s=%q\n", t.Field, t.Val)
+	}
+	return nil
+}
+
+type fieldMatcher struct {
+	field string
+	m     tindex.Matcher
+}
+
+// parseSelector parses comma separated matchers like job="api",env!~"dev.*".
+func parseSelector(s string) ([]fieldMatcher, error) {
+	var res []fieldMatcher
+
+	for s = strings.TrimSpace(s); s != ""; {
+		i := strings.IndexAny(s, "=!")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected matcher at %q", s)
+		}
+		field := strings.TrimSpace(s[:i])
+
+		var op string
+		for _, o := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid operator at %q", s[i:])
+		}
+		rest := strings.TrimSpace(s[i+len(op):])
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("expected quoted value at %q", rest)
+		}
+		val, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+		var m tindex.Matcher = tindex.NewEqualMatcher(val)
+		if op == "=~" || op == "!~" {
+			if m, err = tindex.NewRegexpMatcher(val); err != nil {
+				return nil, err
+			}
+		}
+		if op[0] == '!' {
+			m = tindex.Inverse(m)
+		}
+		res = append(res, fieldMatcher{field: field, m: m})
+
+		s = strings.TrimSpace(rest[len(quoted):])
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("expected comma at %q", s)
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return res, nil
+}
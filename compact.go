@@ -0,0 +1,432 @@
+package tindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The key/value store never shrinks on its own as freed pages are only reused
+// for new writes. A compaction rewrites all of its buckets into a new file and
+// replaces the old one with it.
+//
+// Batches are blocked while a compaction is running. Queriers can be used until
+// the new file is swapped in, which waits for all of them to be closed.
+
+var (
+	// ErrCompactionCanceled is returned by Compaction.Wait if the compaction
+	// was canceled before it completed.
+	ErrCompactionCanceled = errors.New("compaction canceled")
+
+	errCompactionRunning = errors.New("compaction already running")
+)
+
+// compactTxSize is the number of bytes written to the new key/value store
+// after which its transaction is committed.
+const compactTxSize = 64 << 20
+
+// Compaction is a compaction running in the background.
+type Compaction struct {
+	ix     *Index
+	cancel chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mtx      sync.Mutex
+	start    time.Time
+	progress CompactionProgress
+	err      error
+}
+
+// CompactionProgress describes the state of a compaction.
+type CompactionProgress struct {
+	// Keys is the number of keys copied so far and TotalKeys the number
+	// of keys to be copied.
+	Keys, TotalKeys int
+	// BytesReclaimed is the number by which the key/value store shrunk.
+	// It is only set once the compaction completed.
+	BytesReclaimed int64
+	// ETA is the estimated time until all keys are copied.
+	ETA time.Duration
+}
+
+// CompactionPolicy decides when the key/value store is compacted
+// automatically and how its buckets are laid out by compactions. All keys are
+// always copied as the store is rewritten into a new file.
+type CompactionPolicy interface {
+	// Compact is called after every commit and returns whether a
+	// compaction is started in the background.
+	Compact(CompactionStats) bool
+	// FillPercent returns how full the pages of the top-level bucket are
+	// filled by compactions, between 0.1 and 1. Dense pages are read
+	// faster, while sparse pages absorb writes without being split.
+	FillPercent(bucket string) float64
+}
+
+// CompactionStats describes the key/value store for a CompactionPolicy.
+type CompactionStats struct {
+	// Size is the size of the store in bytes.
+	Size int64
+	// FreeBytes is the size of the pages freed by previous writes.
+	FreeBytes int64
+	// Commits is the number of commits since the index was opened or last
+	// compacted.
+	Commits int
+}
+
+// FreeSpacePolicy compacts the store once its free pages make up a given
+// share of it.
+type FreeSpacePolicy struct {
+	// MinFreeRatio is the ratio of free bytes to the size of the store
+	// above which it is compacted. Zero disables automatic compactions.
+	MinFreeRatio float64
+	// MinSize is the size in bytes below which the store is not compacted
+	// automatically.
+	MinSize int64
+	// Fill is the fill percent of pages written by compactions. Zero means
+	// dense pages, which suit read-heavy workloads. Write-heavy workloads
+	// benefit from lower values.
+	Fill float64
+}
+
+// DefaultCompactionPolicy is used by indexes without a CompactionPolicy. It
+// never compacts automatically, as compactions block writes while the store
+// is copied, and writes dense pages.
+var DefaultCompactionPolicy CompactionPolicy = &FreeSpacePolicy{}
+
+// Compact implements the CompactionPolicy interface.
+func (p *FreeSpacePolicy) Compact(s CompactionStats) bool {
+	if p.MinFreeRatio <= 0 || s.Size == 0 || s.Size < p.MinSize {
+		return false
+	}
+	return float64(s.FreeBytes)/float64(s.Size) >= p.MinFreeRatio
+}
+
+// FillPercent implements the CompactionPolicy interface.
+func (p *FreeSpacePolicy) FillPercent(string) float64 {
+	if p.Fill <= 0 {
+		return 1.0
+	}
+	return p.Fill
+}
+
+// maybeCompact starts a compaction if the policy asks for it. It must be
+// called with the rwlock held.
+func (ix *Index) maybeCompact() {
+	ix.commitsSinceCompact++
+
+	// Skip collecting the stats if automatic compactions are disabled.
+	if p, ok := ix.compactionPolicy.(*FreeSpacePolicy); ok && p.MinFreeRatio <= 0 {
+		return
+	}
+
+	tx, err := ix.beginKV(false)
+	if err != nil {
+		return
+	}
+	size := tx.Size()
+	tx.Rollback()
+
+	s := CompactionStats{
+		Size:      size,
+		FreeBytes: int64(ix.bolt.Stats().FreeAlloc),
+		Commits:   ix.commitsSinceCompact,
+	}
+	if !ix.compactionPolicy.Compact(s) {
+		return
+	}
+	if _, err := ix.Compact(); err != nil && err != errCompactionRunning {
+		ix.logger.Log("msg", "starting compaction failed", "err", err)
+	}
+}
+
+// Compact starts compacting the index in the background. Only one compaction
+// may be running at a time.
+func (ix *Index) Compact() (*Compaction, error) {
+	if ix.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	ix.cmtx.Lock()
+	defer ix.cmtx.Unlock()
+
+	if ix.compaction != nil {
+		return nil, errCompactionRunning
+	}
+	c := &Compaction{
+		ix:     ix,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	ix.compaction = c
+
+	go c.run()
+
+	return c, nil
+}
+
+// Progress returns the current progress of the compaction.
+func (c *Compaction) Progress() CompactionProgress {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	p := c.progress
+	if p.Keys > 0 && p.Keys < p.TotalKeys {
+		elapsed := time.Since(c.start)
+		p.ETA = elapsed / time.Duration(p.Keys) * time.Duration(p.TotalKeys-p.Keys)
+	}
+	return p
+}
+
+// Cancel aborts the compaction. The index is left unchanged.
+func (c *Compaction) Cancel() {
+	c.once.Do(func() { close(c.cancel) })
+}
+
+// Wait blocks until the compaction completed and returns its error.
+func (c *Compaction) Wait() error {
+	<-c.done
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+func (c *Compaction) run() {
+	err := c.compact()
+
+	c.mtx.Lock()
+	c.err = err
+	c.mtx.Unlock()
+
+	c.ix.cmtx.Lock()
+	c.ix.compaction = nil
+	c.ix.compactErr = err
+	c.ix.cmtx.Unlock()
+
+	close(c.done)
+}
+
+func (c *Compaction) canceled() bool {
+	select {
+	case <-c.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Compaction) compact() (err error) {
+	ix := c.ix
+
+	_, span := ix.tracer.Start(context.Background(), "tindex.Index.Compact")
+	defer func() { endSpan(span, err) }()
+
+	// Block writes for the entire compaction so no changes are lost.
+	ix.rwlock.Lock()
+	defer ix.rwlock.Unlock()
+
+	if ix.kvErr != nil {
+		return ix.kvErr
+	}
+	if c.canceled() {
+		return ErrCompactionCanceled
+	}
+	// The store is copied entirely before the old one is removed.
+	if err := ix.checkSpace(); err != nil {
+		return err
+	}
+	var (
+		path    = ix.opts.kvPath(ix.path)
+		tmpPath = path + ".compact"
+		oldPath = path + ".old"
+	)
+	for _, p := range []string{tmpPath, oldPath} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	before, err := c.copy(tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	if c.canceled() {
+		os.RemoveAll(tmpPath)
+		return ErrCompactionCanceled
+	}
+
+	// The old store remains open for its readers after its file is replaced.
+	// Keep a link to it until the new one was opened so that the replacement
+	// can be undone.
+	if err := os.Link(path, oldPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	var db *bolt.DB
+
+	err = ix.replaceKV(tmpPath, path)
+	if err == nil {
+		db, err = reopenKV(path, ix.opts)
+	}
+	if err != nil {
+		os.RemoveAll(tmpPath)
+
+		if rerr := ix.replaceKV(oldPath, path); rerr != nil {
+			// Commits to the old store would be lost as its file is gone.
+			ix.kvErr = fmt.Errorf("key/value store replaced but not reopened: %w", err)
+			return fmt.Errorf("%w; restoring previous store failed: %w", ix.kvErr, rerr)
+		}
+		return fmt.Errorf("replacing key/value store failed: %w", err)
+	}
+	if err := os.Remove(oldPath); err != nil {
+		ix.logger.Log("msg", "removing replaced key/value store failed", "err", err)
+	}
+	ix.kvlock.Lock()
+	old := ix.bolt
+	ix.bolt = &kvStore{DB: db}
+	ix.kvlock.Unlock()
+
+	go func() {
+		old.readers.Wait()
+		if err := old.Close(); err != nil {
+			ix.logger.Log("msg", "closing replaced key/value store failed", "err", err)
+		}
+	}()
+	ix.commitsSinceCompact = 0
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	c.progress.BytesReclaimed = before - fi.Size()
+	p := c.progress
+	c.mtx.Unlock()
+
+	span.SetAttributes(
+		attribute.Int("keys", p.Keys),
+		attribute.Int64("bytes_reclaimed", p.BytesReclaimed),
+	)
+	ix.logger.Log("msg", "compaction completed", "keys", p.Keys, "bytes_reclaimed", p.BytesReclaimed)
+
+	return nil
+}
+
+// reopenKV opens the compacted key/value store. It is replaced in tests.
+var reopenKV = openKV
+
+// replaceKV renames the file at src to dst and syncs the directory so that
+// the rename persists.
+func (ix *Index) replaceKV(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// copy writes all buckets of the key/value store into a new store at path
+// and returns the size of the current store.
+func (c *Compaction) copy(path string) (int64, error) {
+	src, err := c.ix.beginKV(false)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Rollback()
+
+	total := 0
+	err = src.ForEach(func(_ []byte, b *bolt.Bucket) error {
+		total += b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.mtx.Lock()
+	c.start = time.Now()
+	c.progress.TotalKeys = total
+	c.mtx.Unlock()
+
+	db, err := bolt.Open(path, c.ix.opts.fileMode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	dst, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { dst.Rollback() }()
+
+	var size int64
+
+	err = walkKV(src, func(keys [][]byte, k, v []byte) error {
+		if c.canceled() {
+			return ErrCompactionCanceled
+		}
+		if size += int64(len(k) + len(v)); size > compactTxSize {
+			if err := dst.Commit(); err != nil {
+				return err
+			}
+			if dst, err = db.Begin(true); err != nil {
+				return err
+			}
+			size = 0
+		}
+		if len(keys) == 0 {
+			_, err := dst.CreateBucket(k)
+			return err
+		}
+		b := dst.Bucket(keys[0])
+		for _, bk := range keys[1:] {
+			b = b.Bucket(bk)
+		}
+		// Keys are inserted in order, so pages can be filled as far as
+		// the policy wants them to be.
+		b.FillPercent = c.ix.compactionPolicy.FillPercent(string(keys[0]))
+
+		c.mtx.Lock()
+		c.progress.Keys++
+		c.mtx.Unlock()
+
+		if v == nil {
+			_, err := b.CreateBucket(k)
+			return err
+		}
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return src.Size(), dst.Commit()
+}
+
+// walkKV calls fn for every bucket and key in the transaction. The keys of
+// the enclosing buckets are passed along. For buckets v is nil.
+func walkKV(tx *bolt.Tx, fn func(keys [][]byte, k, v []byte) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if err := fn(nil, name, nil); err != nil {
+			return err
+		}
+		return walkBucket(b, [][]byte{name}, fn)
+	})
+}
+
+func walkBucket(b *bolt.Bucket, keys [][]byte, fn func(keys [][]byte, k, v []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if err := fn(keys, k, v); err != nil {
+			return err
+		}
+		if v != nil {
+			return nil
+		}
+		return walkBucket(b.Bucket(k), append(keys[:len(keys):len(keys)], k), fn)
+	})
+}
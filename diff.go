@@ -0,0 +1,186 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// IndexDiff describes the differences between two indexes A and B, for
+// example an index and its migrated copy or replica.
+type IndexDiff struct {
+	// OnlyA and OnlyB are the documents, identified by their terms, that
+	// are only present in one of the indexes. Documents added several
+	// times are listed as often as they are missing. Their terms are
+	// sorted.
+	OnlyA, OnlyB []Terms
+	// Changed lists the documents with the same ID but different terms.
+	Changed []DocDiff
+	// Postings lists the terms whose postings lists differ in length.
+	Postings []PostingsDiff
+}
+
+// Empty returns whether the indexes have no differences.
+func (d *IndexDiff) Empty() bool {
+	return len(d.OnlyA) == 0 && len(d.OnlyB) == 0 && len(d.Changed) == 0 && len(d.Postings) == 0
+}
+
+// DocDiff is a document ID with different terms in two indexes.
+type DocDiff struct {
+	ID   DocID
+	A, B Terms // sorted terms, nil if the document is missing
+}
+
+// PostingsDiff is a term whose postings lists differ in length in two
+// indexes.
+type PostingsDiff struct {
+	Term Term
+	A, B int
+}
+
+// Diff compares the snapshots of two queriers. Soft-deleted documents are
+// compared like all others.
+func Diff(a, b *Querier) (*IndexDiff, error) {
+	docsA, err := a.docsByID()
+	if err != nil {
+		return nil, fmt.Errorf("reading documents of A: %w", err)
+	}
+	docsB, err := b.docsByID()
+	if err != nil {
+		return nil, fmt.Errorf("reading documents of B: %w", err)
+	}
+	d := &IndexDiff{}
+
+	// Documents are counted by their terms as IDs may be assigned differently.
+	var (
+		keys  = map[string]int{}
+		terms = map[string]Terms{}
+	)
+	for _, t := range docsA {
+		k := docKeyString(t)
+		keys[k]++
+		terms[k] = t
+	}
+	for _, t := range docsB {
+		k := docKeyString(t)
+		keys[k]--
+		terms[k] = t
+	}
+	for k, n := range keys {
+		for ; n > 0; n-- {
+			d.OnlyA = append(d.OnlyA, terms[k])
+		}
+		for ; n < 0; n++ {
+			d.OnlyB = append(d.OnlyB, terms[k])
+		}
+	}
+	sortDocs(d.OnlyA)
+	sortDocs(d.OnlyB)
+
+	for id, ta := range docsA {
+		tb, ok := docsB[id]
+		if !ok || docKeyString(ta) != docKeyString(tb) {
+			d.Changed = append(d.Changed, DocDiff{ID: id, A: ta, B: tb})
+		}
+	}
+	for id, tb := range docsB {
+		if _, ok := docsA[id]; !ok {
+			d.Changed = append(d.Changed, DocDiff{ID: id, B: tb})
+		}
+	}
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].ID < d.Changed[j].ID })
+
+	lensA, err := a.postingsLens()
+	if err != nil {
+		return nil, fmt.Errorf("reading postings of A: %w", err)
+	}
+	lensB, err := b.postingsLens()
+	if err != nil {
+		return nil, fmt.Errorf("reading postings of B: %w", err)
+	}
+	for t, n := range lensA {
+		if m := lensB[t]; m != n {
+			d.Postings = append(d.Postings, PostingsDiff{Term: t, A: n, B: m})
+		}
+	}
+	for t, m := range lensB {
+		if _, ok := lensA[t]; !ok {
+			d.Postings = append(d.Postings, PostingsDiff{Term: t, B: m})
+		}
+	}
+	sort.Slice(d.Postings, func(i, j int) bool {
+		ti, tj := d.Postings[i].Term, d.Postings[j].Term
+		return ti.Field < tj.Field || ti.Field == tj.Field && ti.Val < tj.Val
+	})
+	return d, nil
+}
+
+// sortDocs sorts documents by their keys.
+func sortDocs(docs []Terms) {
+	keys := make([]string, len(docs))
+	for i, d := range docs {
+		keys[i] = docKeyString(d)
+	}
+	sort.Sort(docsByKey{docs: docs, keys: keys})
+}
+
+// docsByID returns the sorted terms of all documents.
+func (q *Querier) docsByID() (map[DocID]Terms, error) {
+	res := map[DocID]Terms{}
+
+	it := &keyIterator{c: q.kvtx.Bucket(bktDocs).Cursor()}
+
+	err := forEachDoc(q.kvtx, q.ix.docs, it, func(id DocID, terms Terms) {
+		// Cached terms are shared.
+		terms = append(Terms(nil), terms...)
+		sort.Sort(terms)
+		res[id] = terms
+	})
+	return res, err
+}
+
+// postingsLens returns the length of the postings lists of all terms.
+func (q *Querier) postingsLens() (map[Term]int, error) {
+	var (
+		res    = map[Term]int{}
+		counts = q.kvtx.Bucket(bktCounts)
+	)
+	err := q.termBkt.ForEach(func(k, v []byte) error {
+		t, err := newTerm(k)
+		if err != nil {
+			return err
+		}
+		n, err := q.postingsLen(newTermID(v), counts)
+		if err != nil {
+			return err
+		}
+		res[t] = n
+		return nil
+	})
+	return res, err
+}
+
+// postingsLen returns the length of the term's postings list. It is read
+// from counts if possible, which may be nil for read-only indexes created
+// before counts were maintained.
+func (q *Querier) postingsLen(tid termid, counts *bolt.Bucket) (int, error) {
+	if counts != nil {
+		if c := counts.Get(tid.bytes()); c != nil {
+			return int(decodeUint64(c)), nil
+		}
+	}
+	it, err := q.postingsIter(tid, nil)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, err = it.Next(); err == nil; _, err = it.Next() {
+		n++
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	return n, nil
+}
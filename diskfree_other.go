@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package tindex
+
+func diskFree(path string) (uint64, error) {
+	return 0, errDiskFreeUnsupported
+}
@@ -0,0 +1,105 @@
+package tindex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+func (t pageType) String() string {
+	switch t {
+	case pageTypeDelta:
+		return "delta"
+	case pageTypeValue:
+		return "delta+value"
+	case pageTypeScore:
+		return "delta+score"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// Dump writes the skiplist and all decoded postings pages of term t in a
+// human readable form. It is meant for debugging corrupted indexes and
+// changes to the encoding. Pages that fail to decode are reported and
+// dumping continues with the next one.
+func (q *Querier) Dump(w io.Writer, t Term) error {
+	v := q.termBkt.Get(t.bytes())
+	if v == nil {
+		return fmt.Errorf("term %s=%q: %w", t.Field, t.Val, ErrNotFound)
+	}
+	tid := newTermID(v)
+
+	buffered, err := q.bufferedPostings(tid)
+	if err != nil {
+		return err
+	}
+	sl := q.skiplists.cursor(tid)
+	if sl == nil && len(buffered) == 0 {
+		return fmt.Errorf("skiplist for term %d: %w", tid, ErrNotFound)
+	}
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "term %s=%q id=%d encoding=%s", t.Field, t.Val, tid, q.ix.pageType)
+	if counts := q.kvtx.Bucket(bktCounts); counts != nil {
+		if c := counts.Get(tid.bytes()); c != nil {
+			fmt.Fprintf(bw, " postings=%d", decodeUint64(c))
+		}
+	}
+	fmt.Fprintln(bw)
+
+	if err := q.dumpPages(bw, sl); err != nil {
+		return err
+	}
+	if len(buffered) > 0 {
+		fmt.Fprintf(bw, "buffer ids=%d\n", len(buffered))
+
+		for _, id := range buffered {
+			fmt.Fprintf(bw, "  %d\n", id)
+		}
+	}
+	return bw.Flush()
+}
+
+// dumpPages writes all pages of the skiplist, which may be nil.
+func (q *Querier) dumpPages(bw *bufio.Writer, sl *boltSkiplistCursor) error {
+	if sl == nil {
+		return nil
+	}
+	return sl.forEach(func(first DocID, v []byte) error {
+		pid := decodeUint64(v)
+
+		fmt.Fprintf(bw, "page %d first=%d", pid, first)
+		if len(v) > 8 {
+			fmt.Fprintf(bw, " max_score=%d", v[8])
+		}
+		data, err := q.pbtx.Get(pid)
+		if err != nil {
+			fmt.Fprintf(bw, " err=%q\n", fmt.Errorf("page %d: %w", pid, ErrNotFound))
+			return nil
+		}
+		pc := q.ix.newPage(data).cursor()
+
+		var ids []string
+		id, err := pc.Seek(0)
+		for ; err == nil; id, err = pc.Next() {
+			switch c := pc.(type) {
+			case *pageValueCursor:
+				ids = append(ids, fmt.Sprintf("%d:%d", id, c.val))
+			case *pageScoreCursor:
+				ids = append(ids, fmt.Sprintf("%d:%d", id, c.score))
+			default:
+				ids = append(ids, fmt.Sprint(id))
+			}
+		}
+		fmt.Fprintf(bw, " ids=%d bytes=%d/%d", len(ids), pc.offset(), len(data))
+		if err != io.EOF {
+			fmt.Fprintf(bw, " err=%q", err)
+		}
+		fmt.Fprintln(bw)
+
+		for _, s := range ids {
+			fmt.Fprintf(bw, "  %s\n", s)
+		}
+		return nil
+	})
+}
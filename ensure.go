@@ -0,0 +1,70 @@
+package tindex
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktDocKeys maps the sorted term IDs of each document to its ID so that
+// documents can be looked up by their terms.
+var bktDocKeys = []byte("doc_keys")
+
+// docKey returns the lookup key of a document with the given term IDs.
+func docKey(tids termids) []byte {
+	s := make(termids, len(tids))
+	copy(s, tids)
+	sort.Sort(s)
+	return s.bytes()
+}
+
+// docKey returns the lookup key of a document with the given term IDs. It
+// is only valid until the next call.
+func (b *Batch) docKey(tids termids) []byte {
+	b.keyTIDs = append(b.keyTIDs[:0], tids...)
+	sort.Sort(b.keyTIDs)
+	b.keyBuf = b.keyTIDs.appendBytes(b.keyBuf[:0])
+	return b.keyBuf
+}
+
+// initDocKeys creates the document keys bucket. For indexes created before
+// keys were maintained, they are computed from all documents.
+func (ix *Index) initDocKeys(tx *bolt.Tx) error {
+	if tx.Bucket(bktDocKeys) != nil {
+		return nil
+	}
+	keys, err := tx.CreateBucket(bktDocKeys)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktDocKeys), err)
+	}
+	return tx.Bucket(bktDocs).ForEach(func(k, v []byte) error {
+		return keys.Put(docKey(newTermIDs(v)), k)
+	})
+}
+
+// Ensure returns the ID of the document with exactly the given terms. If no
+// such document exists in the index or the batch, it is added and created is
+// true.
+func (b *Batch) Ensure(terms Terms) (id DocID, created bool) {
+	tids := b.lookTIDs[:0]
+
+	for _, t := range terms {
+		tid, ok := b.termID(t)
+		if !ok {
+			// A term that does not exist yet implies a new document.
+			return b.Add(terms), true
+		}
+		tids = append(tids, tid)
+	}
+	b.lookTIDs = tids
+	key := b.docKey(tids)
+
+	if id, ok := b.keys[string(key)]; ok {
+		return id, false
+	}
+	if v := b.tx.Bucket(bktDocKeys).Get(key); v != nil {
+		return newDocID(v), false
+	}
+	return b.Add(terms), true
+}
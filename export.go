@@ -0,0 +1,189 @@
+package tindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// An export is a stream of JSON objects, one per document in order of their
+// IDs. Besides its terms, each document lists the terms it was added to
+// through SecondaryIndex. Values and scores of postings are not exported.
+
+// exportDoc is a document in an export.
+type exportDoc struct {
+	ID        DocID `json:"id"`
+	Terms     Terms `json:"terms"`
+	Secondary Terms `json:"secondary,omitempty"`
+}
+
+// Export writes all documents of the querier's snapshot to w.
+func (q *Querier) Export(w io.Writer) error {
+	return q.export(w, false)
+}
+
+// export writes the documents of the querier's snapshot to w. Soft-deleted
+// documents are skipped if live is set.
+func (q *Querier) export(w io.Writer, live bool) error {
+	bw := bufio.NewWriter(w)
+
+	secondary, err := q.secondaryPostings()
+	if err != nil {
+		return err
+	}
+	if err := q.exportDocs(json.NewEncoder(bw), 0, live, secondary); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// secondaryTerms provides the terms documents were added to through
+// SecondaryIndex as they are exported.
+type secondaryTerms interface {
+	// terms returns the terms the document was added to that are not among
+	// its own terms. It is called with increasing IDs.
+	terms(id DocID, own termids) (Terms, error)
+}
+
+// exportDocs encodes all documents with IDs greater than after. Soft-deleted
+// documents are skipped if live is set.
+func (q *Querier) exportDocs(enc *json.Encoder, after DocID, live bool, secondary secondaryTerms) error {
+	var (
+		docsBkt   = q.kvtx.Bucket(bktDocs)
+		termidBkt = q.kvtx.Bucket(bktTermIDs)
+		cache     = map[termid]Term{}
+	)
+	c := docsBkt.Cursor()
+
+	for k, v := c.Seek((after + 1).bytes()); k != nil; k, v = c.Next() {
+		id := newDocID(k)
+		if live && q.isDeleted(id) {
+			continue
+		}
+		terms, err := q.ix.docs.doc(docsBkt, termidBkt, cache, id)
+		if err != nil {
+			return err
+		}
+		sec, err := secondary.terms(id, newTermIDs(v))
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(exportDoc{ID: id, Terms: terms, Secondary: sec}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secondaryPostings are the postings lists of terms that documents were
+// added to through SecondaryIndex. They are consumed as documents are
+// exported in order of their IDs.
+type secondaryPostings []*secondaryList
+
+type secondaryList struct {
+	tid  termid
+	term Term
+	it   Iterator
+	cur  DocID // zero before the first seek
+	done bool
+}
+
+// secondaryPostings returns the postings lists that are longer than the
+// number of documents containing their term.
+func (q *Querier) secondaryPostings() (secondaryPostings, error) {
+	var (
+		docsBkt = q.kvtx.Bucket(bktDocs)
+		counts  = q.kvtx.Bucket(bktCounts)
+		own     = map[termid]int{}
+		res     secondaryPostings
+	)
+	err := docsBkt.ForEach(func(_, v []byte) error {
+		for _, t := range newTermIDs(v) {
+			own[t]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = q.termBkt.ForEach(func(k, v []byte) error {
+		tid := newTermID(v)
+
+		n, err := q.postingsLen(tid, counts)
+		if err != nil || n <= own[tid] {
+			return err
+		}
+		t, err := newTerm(k)
+		if err != nil {
+			return err
+		}
+		it, err := q.postingsIter(tid, nil)
+		if err != nil {
+			return err
+		}
+		res = append(res, &secondaryList{tid: tid, term: t, it: it})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// terms implements secondaryTerms.
+func (sp secondaryPostings) terms(id DocID, own termids) (Terms, error) {
+	var res Terms
+
+	for _, l := range sp {
+		if l.done {
+			continue
+		}
+		if l.cur < id {
+			cur, err := l.it.Seek(id)
+			if err == io.EOF {
+				l.done = true
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			l.cur = cur
+		}
+		if l.cur == id && !own.contains(l.tid) {
+			res = append(res, l.term)
+		}
+	}
+	return res, nil
+}
+
+func (t termids) contains(x termid) bool {
+	for _, y := range t {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Import adds all documents of an export to the index, which must not hold
+// any documents yet. Documents keep their IDs. They are committed in batches,
+// so documents before a failing batch remain in the index.
+func (ix *Index) Import(r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	_, err := ix.ingest(func(b *Batch) error {
+		var d exportDoc
+		if err := dec.Decode(&d); err != nil {
+			return err
+		}
+		if id := b.Add(d.Terms); id != d.ID {
+			return fmt.Errorf("document %d imported with ID %d", d.ID, id)
+		}
+		if len(d.Secondary) > 0 {
+			b.SecondaryIndex(d.ID, d.Secondary...)
+		}
+		return nil
+	})
+	return err
+}
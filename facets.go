@@ -0,0 +1,196 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Facets counts the values of the named fields across all documents of the
+// iterator. The result maps each field to the number of documents per value.
+// Terms added through SecondaryIndex are not counted.
+func (ix *Index) Facets(it Iterator, names ...string) (map[string]map[string]int, error) {
+	return facets(ix.forEachDoc, it, names)
+}
+
+// Facets is like Index.Facets but reads the documents from the querier's
+// snapshot.
+func (q *Querier) Facets(it Iterator, names ...string) (map[string]map[string]int, error) {
+	return facets(q.forEachDoc, it, names)
+}
+
+// docsFunc calls fn with the terms of all documents in the iterator.
+type docsFunc func(it Iterator, fn func(DocID, Terms)) error
+
+func facets(forEachDoc docsFunc, it Iterator, names []string) (map[string]map[string]int, error) {
+	res := make(map[string]map[string]int, len(names))
+	for _, n := range names {
+		res[n] = map[string]int{}
+	}
+	err := forEachDoc(it, func(_ DocID, terms Terms) {
+		for _, t := range terms {
+			if counts, ok := res[t.Field]; ok {
+				counts[t.Val]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CountValues returns the number of distinct values of the named field across
+// all documents matching every selector. Without selectors, values of all
+// documents are counted. Values are found by intersecting the postings of
+// each value with those of the selection, so unlike Facets, terms added
+// through SecondaryIndex are counted.
+func (ix *Index) CountValues(name string, sels ...Selector) (int, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	return q.CountValues(name, sels...)
+}
+
+// CountValues is like Index.CountValues but counts values in the querier's
+// snapshot.
+func (q *Querier) CountValues(name string, sels ...Selector) (int, error) {
+	var sel []DocID
+
+	if len(sels) > 0 {
+		its := make([]Iterator, 0, len(sels))
+		for _, s := range sels {
+			it, err := q.Search(s.Field, s.Matcher)
+			if err != nil {
+				return 0, err
+			}
+			if it == nil {
+				return 0, nil
+			}
+			its = append(its, it)
+		}
+		ids, err := ExpandIterator(Intersect(its...))
+		if err != nil {
+			return 0, err
+		}
+		if len(ids) == 0 {
+			return 0, nil
+		}
+		sel = ids
+	}
+	n := 0
+	for _, v := range q.Values(name) {
+		it, err := q.Search(name, NewEqualMatcher(v))
+		if err != nil {
+			return 0, err
+		}
+		if it == nil {
+			continue
+		}
+		if sel != nil {
+			it = Intersect(it, &plainListIterator{list: sel})
+		}
+		switch _, err := it.Seek(0); err {
+		case nil:
+			n++
+		case io.EOF:
+		default:
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// GroupBy groups the documents of the iterator by the values of the named
+// fields. Group keys list the fields in the given order as in
+// `job="api",instance="a"`. Missing fields have an empty value.
+func (ix *Index) GroupBy(it Iterator, names ...string) (map[string][]DocID, error) {
+	return groupBy(ix.forEachDoc, it, names)
+}
+
+// GroupBy is like Index.GroupBy but reads the documents from the querier's
+// snapshot.
+func (q *Querier) GroupBy(it Iterator, names ...string) (map[string][]DocID, error) {
+	return groupBy(q.forEachDoc, it, names)
+}
+
+func groupBy(forEachDoc docsFunc, it Iterator, names []string) (map[string][]DocID, error) {
+	var (
+		res  = map[string][]DocID{}
+		vals = make([]string, len(names))
+		pos  = make(map[string]int, len(names))
+		sb   strings.Builder
+	)
+	for i, n := range names {
+		pos[n] = i
+	}
+	err := forEachDoc(it, func(id DocID, terms Terms) {
+		for i := range vals {
+			vals[i] = ""
+		}
+		for _, t := range terms {
+			if i, ok := pos[t.Field]; ok {
+				vals[i] = t.Val
+			}
+		}
+		sb.Reset()
+		for i, n := range names {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s=%q", n, vals[i])
+		}
+		k := sb.String()
+		res[k] = append(res[k], id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// forEachDoc calls fn with the terms of all documents in the iterator.
+func (ix *Index) forEachDoc(it Iterator, fn func(DocID, Terms)) error {
+	tx, done, err := ix.beginRead()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	return forEachDoc(tx, ix.docs, it, fn)
+}
+
+// forEachDoc calls fn with the terms of all documents in the iterator as
+// visible to the querier.
+func (q *Querier) forEachDoc(it Iterator, fn func(DocID, Terms)) error {
+	return forEachDoc(q.kvtx, q.ix.docs, it, fn)
+}
+
+// forEachDoc calls fn with the terms of all documents in the iterator
+// as stored in the transaction.
+func forEachDoc(tx *bolt.Tx, dc *docCache, it Iterator, fn func(DocID, Terms)) error {
+	var (
+		docsBkt   = tx.Bucket(bktDocs)
+		termidBkt = tx.Bucket(bktTermIDs)
+		// Documents share most of their terms.
+		cache = map[termid]Term{}
+	)
+	id, err := it.Seek(0)
+	for ; err == nil; id, err = it.Next() {
+		terms, err := dc.doc(docsBkt, termidBkt, cache, id)
+		if err != nil {
+			return err
+		}
+		fn(id, terms)
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,566 @@
+package tindex
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/fabxc/pagebuf"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// The golden files in testdata contain the on-disk encodings written by earlier
+// versions of the index. They must remain decodable so existing indexes can
+// be opened. Formats that are expected to be byte-for-byte stable are also
+// compared against newly encoded data.
+//
+// Run the tests with -update to rewrite the golden files after an
+// intentional format change.
+
+func TestGoldenFormats(t *testing.T) {
+	goldenPage := func() []byte {
+		pg := newPageDelta(make([]byte, pageSize-16))
+		if err := pg.init(1); err != nil {
+			t.Fatal(err)
+		}
+		c := pg.cursor()
+		for _, v := range []DocID{2, 130, 100000, 1 << 40} {
+			if err := c.append(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pg.data()
+	}
+
+	// pagePairs returns the IDs of a page along with their values or scores.
+	pagePairs := func(c Iterator, val func() uint64) (interface{}, error) {
+		var res [][2]uint64
+		id, err := c.Next()
+		for ; err == nil; id, err = c.Next() {
+			res = append(res, [2]uint64{uint64(id), val()})
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+		return res, nil
+	}
+	goldenValuePage := func() []byte {
+		pg := newPageValue(make([]byte, pageSize-16))
+		if err := pg.initValue(1, 0); err != nil {
+			t.Fatal(err)
+		}
+		c := pg.cursor().(*pageValueCursor)
+		for _, v := range [][2]uint64{{2, 7}, {130, 1 << 40}, {100000, 3}} {
+			if err := c.appendValue(DocID(v[0]), v[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pg.data()
+	}
+	goldenScorePage := func() []byte {
+		pg := newPageScore(make([]byte, pageSize-16))
+		if err := pg.initScore(1, 200); err != nil {
+			t.Fatal(err)
+		}
+		c := pg.cursor().(*pageScoreCursor)
+		for _, v := range [][2]uint64{{2, 0}, {130, 255}, {100000, 3}} {
+			if err := c.appendScore(DocID(v[0]), uint8(v[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pg.data()
+	}
+	goldenGen := Generation{Gen: 3, LastDocID: 1500, Time: time.Unix(0, 1700000000000000005)}
+	goldenMetaFile := Meta{
+		UUID:    "4f9c2f0e-0b7c-4a57-9a8e-2d7d2b1f6c11",
+		Created: time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		Version: 1,
+		Options: Options{History: true, DocCacheSize: 100, GroupCommitDelay: time.Second},
+	}
+
+	var cases = []struct {
+		file   string
+		stable bool
+		encode func() ([]byte, error)
+		decode func([]byte) (interface{}, error)
+		exp    interface{}
+	}{
+		{
+			file:   "page_delta.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return goldenPage(), nil },
+			decode: func(b []byte) (interface{}, error) {
+				return ExpandIterator(newPageDelta(b).cursor())
+			},
+			exp: []DocID{1, 2, 130, 100000, 1 << 40},
+		},
+		{
+			file:   "term.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return (&Term{"job", "api-server"}).bytes(), nil },
+			decode: func(b []byte) (interface{}, error) { return newTerm(b) },
+			exp:    Term{"job", "api-server"},
+		},
+		{
+			file:   "termids.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return termids{1, 300, 1 << 33}.bytes(), nil },
+			decode: func(b []byte) (interface{}, error) { return newTermIDs(b), nil },
+			exp:    termids{1, 300, 1 << 33},
+		},
+		{
+			file:   "uint64.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return DocID(1<<40 + 5).bytes(), nil },
+			decode: func(b []byte) (interface{}, error) { return newDocID(b), nil },
+			exp:    DocID(1<<40 + 5),
+		},
+		{
+			file:   "recovery.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				return tailPages{{term: 3, page: 12, last: 5000}, {term: 7, page: 1, last: 2}}.bytes(), nil
+			},
+			decode: func(b []byte) (interface{}, error) { return newTailPages(b) },
+			exp:    tailPages{{term: 3, page: 12, last: 5000}, {term: 7, page: 1, last: 2}},
+		},
+		{
+			file:   "page_value.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return goldenValuePage(), nil },
+			decode: func(b []byte) (interface{}, error) {
+				c := &pageValueCursor{data: b}
+				return pagePairs(c, func() uint64 { return c.val })
+			},
+			exp: [][2]uint64{{1, 0}, {2, 7}, {130, 1 << 40}, {100000, 3}},
+		},
+		{
+			file:   "page_score.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return goldenScorePage(), nil },
+			decode: func(b []byte) (interface{}, error) {
+				c := &pageScoreCursor{data: b}
+				return pagePairs(c, func() uint64 { return uint64(c.score) })
+			},
+			exp: [][2]uint64{{1, 200}, {2, 0}, {130, 255}, {100000, 3}},
+		},
+		{
+			file:   "tail_buffer.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return encodeTailBuffer(100, []DocID{105, 230, 1 << 33}), nil },
+			decode: func(b []byte) (interface{}, error) {
+				floor, ids, err := decodeTailBuffer(b)
+				return []interface{}{floor, ids}, err
+			},
+			exp: []interface{}{DocID(100), []DocID{105, 230, 1 << 33}},
+		},
+		{
+			file:   "skiplist_composite.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				sc := &boltSkiplistCursor{k: 7, prefix: termid(7).bytes()}
+				return sc.key(300), nil
+			},
+			decode: func(b []byte) (interface{}, error) {
+				sc := &boltSkiplistCursor{k: 7, prefix: termid(7).bytes()}
+				if !sc.owns(b) {
+					return nil, fmt.Errorf("key not owned by skiplist of term 7")
+				}
+				return sc.doc(b), nil
+			},
+			exp: DocID(300),
+		},
+		{
+			file:   "doc_key.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return docKey(termids{9, 3, 1 << 33}), nil },
+			decode: func(b []byte) (interface{}, error) { return newTermIDs(b), nil },
+			exp:    termids{3, 9, 1 << 33},
+		},
+		{
+			// The key of the history entry followed by its value.
+			file:   "history.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				k, v := encodeGeneration(goldenGen)
+				return append(k, v...), nil
+			},
+			decode: func(b []byte) (interface{}, error) { return decodeGeneration(b[:8], b[8:]) },
+			exp:    goldenGen,
+		},
+		{
+			file:   "deletion.golden",
+			stable: true,
+			encode: func() ([]byte, error) { return encodeDeletion(time.Unix(1700000000, 0), 9), nil },
+			decode: func(b []byte) (interface{}, error) {
+				t, gen := decodeDeletion(b)
+				return []interface{}{t, gen}, nil
+			},
+			exp: []interface{}{time.Unix(1700000000, 0), uint64(9)},
+		},
+		{
+			file:   "secondary_log.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				return encodeSecondaryPost(9, secondaryPost{id: 42, term: 7}), nil
+			},
+			decode: func(b []byte) (interface{}, error) {
+				gen, p, err := decodeSecondaryPost(b)
+				return []interface{}{gen, p}, err
+			},
+			exp: []interface{}{uint64(9), secondaryPost{id: 42, term: 7}},
+		},
+		{
+			file:   "bloom.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				b := newBloom(bloomCapacity(0))
+				for id := DocID(1); id <= 100; id++ {
+					b.add(id * 3)
+				}
+				return b, nil
+			},
+			decode: func(b []byte) (interface{}, error) {
+				for id := DocID(1); id <= 100; id++ {
+					if !bloom(b).has(id * 3) {
+						return nil, fmt.Errorf("missing ID %d", id*3)
+					}
+				}
+				return bloom(b).count(), nil
+			},
+			exp: uint64(100),
+		},
+		{
+			file:   "hll.golden",
+			stable: true,
+			encode: func() ([]byte, error) {
+				h := newHLL()
+				for i := 0; i < 50; i++ {
+					h.insert(fmt.Sprint("value-", i))
+				}
+				return h, nil
+			},
+			decode: func(b []byte) (interface{}, error) { return hll(b).estimate(), nil },
+			// The sketch's estimate of the 50 inserted values.
+			exp: uint64(49),
+		},
+		{
+			file:   "meta_fields.golden",
+			encode: (&meta{LastDocID: 1000, LastTermID: 20, PageType: pageTypeScore, Generation: 7, CompositeSkiplists: true}).bytes,
+			decode: func(b []byte) (interface{}, error) {
+				var m meta
+				err := m.read(b)
+				return m, err
+			},
+			exp: meta{LastDocID: 1000, LastTermID: 20, PageType: pageTypeScore, Generation: 7, CompositeSkiplists: true},
+		},
+		{
+			// The meta file records all options and thus changes whenever
+			// options are added.
+			file: "meta_file.golden",
+			encode: func() ([]byte, error) {
+				dir, err := ioutil.TempDir("", "tindex_golden")
+				if err != nil {
+					return nil, err
+				}
+				defer os.RemoveAll(dir)
+
+				if err := writeMeta(dir, &goldenMetaFile, 0666); err != nil {
+					return nil, err
+				}
+				return ioutil.ReadFile(filepath.Join(dir, metaFile))
+			},
+			decode: func(b []byte) (interface{}, error) {
+				dir, err := ioutil.TempDir("", "tindex_golden")
+				if err != nil {
+					return nil, err
+				}
+				defer os.RemoveAll(dir)
+
+				if err := ioutil.WriteFile(filepath.Join(dir, metaFile), b, 0666); err != nil {
+					return nil, err
+				}
+				m, err := readMeta(dir)
+				if err != nil {
+					return nil, err
+				}
+				return *m, nil
+			},
+			exp: goldenMetaFile,
+		},
+		{
+			// The meta encoding changes whenever fields are added and thus
+			// is only checked for being decodable.
+			file:   "meta.golden",
+			encode: (&meta{LastDocID: 1000, LastTermID: 20}).bytes,
+			decode: func(b []byte) (interface{}, error) {
+				var m meta
+				err := m.read(b)
+				return m, err
+			},
+			exp: meta{LastDocID: 1000, LastTermID: 20},
+		},
+	}
+
+	for _, c := range cases {
+		fn := filepath.Join("testdata", c.file)
+
+		if *update {
+			b, err := c.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(fn, b, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		golden, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.decode(golden)
+		if err != nil {
+			t.Fatalf("%s: decoding failed: %s", c.file, err)
+		}
+		if !reflect.DeepEqual(res, c.exp) {
+			t.Fatalf("%s: expected %v but got %v", c.file, c.exp, res)
+		}
+		if !c.stable {
+			continue
+		}
+		b, err := c.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, golden) {
+			t.Fatalf("%s: encoding does not match golden file", c.file)
+		}
+	}
+}
+
+// The index in testdata/index_baseline was written by the initial version of
+// the index and must never be regenerated. It holds 2500 documents added in
+// batches of 1500 and 1000. Document i, counting from zero, has the terms
+//
+//	env="prod", job="api" or "db" alternating, instance="host-<i%5>"
+//
+// and every hundredth document was added to alias="canary" through
+// SecondaryIndex.
+//
+// kv.gz is the compressed key/value store. As the page store's file format
+// is owned by pagebuf, pages.gz holds the raw pages instead, each prefixed
+// with its 8-byte page ID, from which the page store is rebuilt.
+
+// openBaselineIndex copies the baseline index into a new directory and opens
+// it with the given options.
+func openBaselineIndex(t *testing.T, opts *Options) (*Index, func()) {
+	dir, err := ioutil.TempDir("", "tindex_baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readGzip := func(name string) []byte {
+		f, err := os.Open(filepath.Join("testdata", "index_baseline", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kv"), readGzip("kv.gz"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	pb, err := pagebuf.Open(filepath.Join(dir, "pb"), 0666, &pagebuf.Options{PageSize: pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbtx, err := pb.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Page IDs allocated by the page store may differ from the recorded ones.
+	pages := readGzip("pages.gz")
+	ids := map[uint64]uint64{}
+
+	for len(pages) > 0 {
+		n := 8 + pageSize - pagebuf.PageHeaderSize
+		if len(pages) < n {
+			t.Fatalf("truncated page record of %d bytes", len(pages))
+		}
+		id, err := pbtx.Add(pages[8:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[binary.BigEndian.Uint64(pages[:8])] = id
+		pages = pages[n:]
+	}
+	if err := pbtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "kv"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktSkiplist).ForEach(func(k, _ []byte) error {
+			sl := tx.Bucket(bktSkiplist).Bucket(k)
+			return sl.ForEach(func(k, v []byte) error {
+				id, ok := ids[decodeUint64(v)]
+				if !ok {
+					return fmt.Errorf("page %d: %w", decodeUint64(v), ErrNotFound)
+				}
+				return sl.Put(k, encodeUint64(id))
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return ix, func() {
+		ix.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBaselineIndex(t *testing.T) {
+	check := func(t *testing.T, ix *Index, counts bool) {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		for _, c := range []struct {
+			key, val string
+			n        int
+		}{
+			{"env", "prod", 2500},
+			{"job", "api", 1250},
+			{"instance", "host-3", 500},
+			{"alias", "canary", 25},
+		} {
+			it, err := q.Search(c.key, NewEqualMatcher(c.val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := ExpandIterator(it)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != c.n {
+				t.Fatalf("%s=%q: expected %d documents but got %d", c.key, c.val, c.n, len(res))
+			}
+		}
+		d, err := q.Doc(102)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := (Terms{{"env", "prod"}, {"job", "db"}, {"instance", "host-1"}}); !reflect.DeepEqual(d, exp) {
+			t.Fatalf("expected document %v but got %v", exp, d)
+		}
+
+		tcs, err := q.Explain("job", NewEqualMatcher("api"))
+		if !counts {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound explaining without counts but got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if exp := []TermCount{{Term{"job", "api"}, 1250}}; !reflect.DeepEqual(tcs, exp) {
+			t.Fatalf("expected explanation %v but got %v", exp, tcs)
+		}
+
+		var buf bytes.Buffer
+		if err := q.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			n   int
+			sec []DocID
+		)
+		for sc := bufio.NewScanner(&buf); sc.Scan(); n++ {
+			var d exportDoc
+			if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
+				t.Fatal(err)
+			}
+			if len(d.Secondary) > 0 {
+				if exp := (Terms{{"alias", "canary"}}); !reflect.DeepEqual(d.Secondary, exp) {
+					t.Fatalf("unexpected secondary terms %v of document %d", d.Secondary, d.ID)
+				}
+				sec = append(sec, d.ID)
+			}
+		}
+		if n != 2500 || len(sec) != 25 || sec[0] != 1 || sec[1] != 101 {
+			t.Fatalf("unexpected export of %d documents with secondary terms %v", n, sec)
+		}
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		ix, cleanup := openBaselineIndex(t, &Options{ReadOnly: true})
+		defer cleanup()
+
+		// Read-only opens do not migrate the index.
+		check(t, ix, false)
+	})
+	t.Run("writable", func(t *testing.T) {
+		ix, cleanup := openBaselineIndex(t, nil)
+		defer cleanup()
+
+		check(t, ix, true)
+
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := b.Add(Terms{{"env", "prod"}, {"job", "api"}})
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if id != 2501 {
+			t.Fatalf("expected ID 2501 for new document but got %d", id)
+		}
+		res, err := ix.Search("env", NewEqualMatcher("prod"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2501 {
+			t.Fatalf("expected 2501 documents but got %d", len(res))
+		}
+		if corrupt, err := ix.Verify(); err != nil || len(corrupt) > 0 {
+			t.Fatalf("verification failed: %v %v", corrupt, err)
+		}
+	})
+}
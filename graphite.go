@@ -0,0 +1,84 @@
+package tindex
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// matchAll matches any value of a tag.
+var matchAll = regexp.MustCompile("")
+
+// SeriesByTag returns the documents matching Graphite seriesByTag
+// expressions, with tags stored as fields. The supported operators are
+//
+//	tag=value    the tag has the value
+//	tag!=value   the tag does not have the value or is absent
+//	tag=~regex   the tag matches the regular expression
+//	tag!=~regex  the tag does not match the regular expression or is absent
+//
+// Regular expressions are anchored at the start as in Graphite. An empty
+// value with = selects documents without the tag, with != those having it.
+// At least one expression must select documents having a tag. As for Search,
+// the returned iterator is nil if no document can match.
+func (q *Querier) SeriesByTag(exprs ...string) (Iterator, error) {
+	var pos, neg []Iterator
+
+	for _, e := range exprs {
+		tag, op, val, err := parseTagExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			m        Matcher
+			positive = op == "=" || op == "=~"
+		)
+		switch {
+		case val == "" && (op == "=" || op == "!="):
+			// Empty values select on the presence of the tag.
+			m, positive = &RegexpMatcher{re: matchAll}, !positive
+		case op == "=" || op == "!=":
+			m = NewEqualMatcher(val)
+		default:
+			if m, err = NewRegexpMatcher("^(?:" + val + ")"); err != nil {
+				return nil, fmt.Errorf("expression %q: %w", e, err)
+			}
+		}
+		it, err := q.Search(tag, m)
+		if err != nil {
+			return nil, err
+		}
+		if positive {
+			if it == nil {
+				return nil, nil
+			}
+			pos = append(pos, it)
+		} else if it != nil {
+			neg = append(neg, it)
+		}
+	}
+	if len(pos) == 0 {
+		return nil, errors.New("at least one expression must select documents having a tag")
+	}
+	it := Intersect(pos...)
+	for _, n := range neg {
+		it = &differenceIterator{i1: it, i2: n}
+	}
+	return it, nil
+}
+
+// parseTagExpr splits a Graphite tag expression into its tag, operator,
+// and value.
+func parseTagExpr(e string) (tag, op, val string, err error) {
+	i := strings.IndexAny(e, "!=")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("invalid tag expression %q", e)
+	}
+	for _, o := range []string{"!=~", "!=", "=~", "="} {
+		if strings.HasPrefix(e[i:], o) {
+			return e[:i], o, e[i+len(o):], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("invalid operator in tag expression %q", e)
+}
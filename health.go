@@ -0,0 +1,180 @@
+package tindex
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errDiskFreeUnsupported is returned if the free disk space cannot be
+	// determined on the platform.
+	errDiskFreeUnsupported = errors.New("disk space check not supported")
+	// errUnrecovered is returned if the pages of a failed commit could not
+	// be restored. They are restored when the index is opened next.
+	errUnrecovered = errors.New("postings of a failed commit not restored")
+)
+
+// Health returns an error if the index is not able to serve reads and writes.
+// It checks that the index was not opened read-only, that pages of a failed
+// commit were restored, that both underlying stores are open and writable,
+// that the last compaction did not fail and, if MinFreeSpace is set, that
+// enough disk space is available. It does not switch the index to read-only.
+func (ix *Index) Health() error {
+	if ix.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if atomic.LoadInt32(&ix.unrecovered) == 1 {
+		return errUnrecovered
+	}
+	if err := ix.spaceState(); err != nil {
+		return err
+	}
+	ix.cmtx.Lock()
+	cerr := ix.compactErr
+	ix.cmtx.Unlock()
+
+	if cerr != nil && !errors.Is(cerr, ErrCompactionCanceled) {
+		return fmt.Errorf("last compaction failed: %w", cerr)
+	}
+
+	kvtx, done, err := ix.beginRead()
+	if err != nil {
+		return fmt.Errorf("key/value store: %w", err)
+	}
+	defer done()
+
+	if err := kvtx.Rollback(); err != nil {
+		return fmt.Errorf("key/value store: %w", err)
+	}
+	pbtx, err := ix.beginPB(false)
+	if err != nil {
+		return fmt.Errorf("page store: %w", err)
+	}
+	if err := pbtx.Rollback(); err != nil {
+		return fmt.Errorf("page store: %w", err)
+	}
+	return ix.probeWrite()
+}
+
+// probeWrite checks that write transactions can be started on both stores.
+// If a batch or compaction keeps holding the write lock for longer than
+// lockTimeout, writes are in progress and the probe is skipped.
+func (ix *Index) probeWrite() error {
+	deadline := time.Now().Add(lockTimeout)
+	for !ix.rwlock.TryLock() {
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(lockTimeout / 10)
+	}
+	defer ix.rwlock.Unlock()
+
+	if ix.kvErr != nil {
+		return ix.kvErr
+	}
+	kvtx, err := ix.beginKV(true)
+	if err != nil {
+		return fmt.Errorf("key/value store: %w", err)
+	}
+	if err := kvtx.Rollback(); err != nil {
+		return fmt.Errorf("key/value store: %w", err)
+	}
+	pbtx, err := ix.beginPB(true)
+	if err != nil {
+		return fmt.Errorf("page store: %w", err)
+	}
+	if err := pbtx.Rollback(); err != nil {
+		return fmt.Errorf("page store: %w", err)
+	}
+	return nil
+}
+
+// freeSpace returns the free disk space of the fullest volume holding a store
+// of the index.
+func (ix *Index) freeSpace() (uint64, error) {
+	var min uint64
+	for i, dir := range ix.opts.storeDirs(ix.path) {
+		free, err := diskFree(dir)
+		if err == errDiskFreeUnsupported {
+			return 0, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("checking disk space of %s: %w", dir, err)
+		}
+		if i == 0 || free < min {
+			min = free
+		}
+	}
+	return min, nil
+}
+
+// lowSpace reports whether the free disk space is below the configured
+// minimum.
+func (ix *Index) lowSpace() (bool, uint64, error) {
+	if ix.opts.MinFreeSpace == 0 {
+		return false, 0, nil
+	}
+	free, err := ix.freeSpace()
+	if err == errDiskFreeUnsupported {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return free < ix.opts.MinFreeSpace, free, nil
+}
+
+// spaceState returns ErrNoSpace if the free disk space is below the
+// configured minimum. Unlike checkSpace it does not change the state of the
+// index.
+func (ix *Index) spaceState() error {
+	low, _, err := ix.lowSpace()
+	if err != nil {
+		return err
+	}
+	if low {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// checkReadOnly returns ErrNoSpace if the index was switched to read-only
+// and the free disk space is still below the configured minimum. It is
+// called before writes are started so that they are rejected up front.
+func (ix *Index) checkReadOnly() error {
+	if atomic.LoadInt32(&ix.readOnly) == 0 {
+		return nil
+	}
+	return ix.checkSpace()
+}
+
+// checkSpace returns ErrNoSpace if the free disk space is below the
+// configured minimum. In that case the index is switched to read-only as
+// appending to the stores on a nearly full disk may corrupt them. It is
+// switched back to writable once enough space was freed.
+func (ix *Index) checkSpace() error {
+	low, free, err := ix.lowSpace()
+	if err != nil {
+		return err
+	}
+	if !low {
+		if atomic.CompareAndSwapInt32(&ix.readOnly, 1, 0) {
+			ix.logger.Log(
+				"msg", "free disk space above minimum, switching to writable",
+				"free", free,
+				"min", ix.opts.MinFreeSpace,
+			)
+		}
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&ix.readOnly, 0, 1) {
+		ix.logger.Log(
+			"msg", "free disk space below minimum, switching to read-only",
+			"free", free,
+			"min", ix.opts.MinFreeSpace,
+		)
+	}
+	return ErrNoSpace
+}
@@ -0,0 +1,164 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktHistory records the state of the index after every commit if the index
+// is opened with History. It maps the generation of each commit to the last
+// document ID and the time of the commit.
+//
+// Documents are never modified once added and their IDs increase with every
+// commit. The documents of a generation are therefore all documents up to
+// its last ID, except for those soft-deleted up to the generation.
+var bktHistory = []byte("history")
+
+// Generation describes the state of the index after a commit.
+type Generation struct {
+	Gen       uint64
+	LastDocID DocID
+	Time      time.Time
+}
+
+// Generation returns the number of batches committed to the index since it
+// was created. It increases with every commit, so caches and replicas can
+// compare it to the generation they last read to detect changes.
+func (ix *Index) Generation() uint64 {
+	ix.snaplock.RLock()
+	defer ix.snaplock.RUnlock()
+
+	return ix.meta.Generation
+}
+
+func (ix *Index) initHistory(tx *bolt.Tx) error {
+	if !ix.opts.History {
+		return nil
+	}
+	if _, err := tx.CreateBucketIfNotExists(bktHistory); err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktHistory), err)
+	}
+	return ix.initSecondaryLog(tx)
+}
+
+// recordGeneration records the generation of the batch's commit.
+func (b *Batch) recordGeneration(tx *bolt.Tx) error {
+	bkt := tx.Bucket(bktHistory)
+	if bkt == nil {
+		return nil
+	}
+	k, v := encodeGeneration(Generation{
+		Gen:       b.meta.Generation,
+		LastDocID: b.meta.LastDocID,
+		Time:      time.Now(),
+	})
+	return bkt.Put(k, v)
+}
+
+// encodeGeneration returns the key and value of the generation's history
+// entry.
+func encodeGeneration(g Generation) (k, v []byte) {
+	v = append(encodeUint64(uint64(g.LastDocID)), encodeUint64(uint64(g.Time.UnixNano()))...)
+	return encodeUint64(g.Gen), v
+}
+
+func decodeGeneration(k, v []byte) (Generation, error) {
+	if len(k) != 8 || len(v) != 16 {
+		return Generation{}, fmt.Errorf("invalid history entry of length %d", len(v))
+	}
+	return Generation{
+		Gen:       decodeUint64(k),
+		LastDocID: DocID(decodeUint64(v)),
+		Time:      time.Unix(0, int64(decodeUint64(v[8:]))),
+	}, nil
+}
+
+// History returns all recorded generations in order.
+func (q *Querier) History() ([]Generation, error) {
+	bkt := q.kvtx.Bucket(bktHistory)
+	if bkt == nil {
+		return nil, nil
+	}
+	var res []Generation
+
+	err := bkt.ForEach(func(k, v []byte) error {
+		g, err := decodeGeneration(k, v)
+		if err != nil {
+			return err
+		}
+		res = append(res, g)
+		return nil
+	})
+	return res, err
+}
+
+// AsOf returns a querier over the state of the index after the commit of
+// the given generation, which must have been recorded with History. Its
+// searches only match documents that existed and were not soft-deleted
+// at the time. Terms and postings added through SecondaryIndex later are
+// visible, as are soft deletions that were undone.
+func (ix *Index) AsOf(gen uint64) (*Querier, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	bkt := q.kvtx.Bucket(bktHistory)
+	if bkt == nil {
+		q.Close()
+		return nil, fmt.Errorf("history: %w", ErrNotFound)
+	}
+	v := bkt.Get(encodeUint64(gen))
+	if v == nil {
+		q.Close()
+		return nil, fmt.Errorf("generation %d: %w", gen, ErrNotFound)
+	}
+	g, err := decodeGeneration(encodeUint64(gen), v)
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	q.asOf = &g
+	return q, nil
+}
+
+// visible returns whether the document is part of the querier's view.
+func (q *Querier) visible(id DocID) bool {
+	if q.asOf != nil && id > q.asOf.LastDocID {
+		return false
+	}
+	return !q.isDeleted(id)
+}
+
+// boundIterator iterates over the IDs of an iterator up to a maximum.
+type boundIterator struct {
+	it  Iterator
+	max DocID
+}
+
+func (it *boundIterator) Next() (DocID, error) {
+	return it.bound(it.it.Next())
+}
+
+func (it *boundIterator) Seek(id DocID) (DocID, error) {
+	return it.bound(it.it.Seek(id))
+}
+
+func (it *boundIterator) bound(id DocID, err error) (DocID, error) {
+	if err == nil && id > it.max {
+		return 0, io.EOF
+	}
+	return id, err
+}
+
+// ValueAt implements the ValueIterator interface.
+func (it *boundIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.it, id)
+}
+
+// Score implements the ScoredIterator interface.
+func (it *boundIterator) Score() uint64 {
+	return scoreOf(it.it)
+}
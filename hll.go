@@ -0,0 +1,152 @@
+package tindex
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktSketches holds a HyperLogLog sketch of the values of each field.
+var bktSketches = []byte("field_sketches")
+
+// hllPrecision is the number of hash bits used to select a register.
+// The standard error of estimates is 1.04/sqrt(2^hllPrecision), about 1.6%.
+const hllPrecision = 12
+
+// hll is a HyperLogLog sketch estimating the number of distinct values
+// inserted into it.
+type hll []uint8
+
+func newHLL() hll {
+	return make(hll, 1<<hllPrecision)
+}
+
+// insert adds the value to the sketch.
+func (h hll) insert(v string) {
+	f := fnv.New64a()
+	f.Write([]byte(v))
+	x := mix64(f.Sum64())
+
+	i := x >> (64 - hllPrecision)
+	// Count leading zeros of the remaining bits. The appended one bit caps it.
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rho > h[i] {
+		h[i] = rho
+	}
+}
+
+// estimate returns the approximate number of distinct values in the sketch.
+func (h hll) estimate() uint64 {
+	var (
+		m     = float64(len(h))
+		sum   float64
+		zeros int
+	)
+	for _, r := range h {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Use linear counting for small cardinalities.
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// mix64 scrambles the bits of x as FNV hashes of short strings are not
+// distributed uniformly enough.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// initSketches creates the field sketches if enabled and removes them
+// otherwise, so that they are rebuilt from all terms once enabled again.
+func (ix *Index) initSketches(tx *bolt.Tx) error {
+	if !ix.opts.FieldSketches {
+		if tx.Bucket(bktSketches) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(bktSketches)
+	}
+	if tx.Bucket(bktSketches) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket(bktSketches); err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktSketches), err)
+	}
+	terms := map[Term]struct{}{}
+
+	err := tx.Bucket(bktTerms).ForEach(func(k, _ []byte) error {
+		t, err := newTerm(k)
+		if err != nil {
+			return err
+		}
+		terms[t] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return updateSketches(tx, terms)
+}
+
+// updateSketches inserts the values of all terms into the sketches of
+// their fields.
+func updateSketches(tx *bolt.Tx, terms map[Term]struct{}) error {
+	var (
+		bkt    = tx.Bucket(bktSketches)
+		fields = map[string]hll{}
+	)
+	for t := range terms {
+		h, ok := fields[t.Field]
+		if !ok {
+			h = newHLL()
+			copy(h, bkt.Get([]byte(t.Field)))
+			fields[t.Field] = h
+		}
+		h.insert(t.Val)
+	}
+	for f, h := range fields {
+		if err := bkt.Put([]byte(f), h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FieldCardinality returns the approximate number of distinct values of
+// the field. It requires the index to be opened with FieldSketches.
+func (ix *Index) FieldCardinality(field string) (uint64, error) {
+	if !ix.opts.FieldSketches {
+		return 0, errors.New("field sketches not enabled")
+	}
+	tx, done, err := ix.beginRead()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	bkt := tx.Bucket(bktSketches)
+	if bkt == nil {
+		return 0, fmt.Errorf("field sketches: %w", ErrNotFound)
+	}
+	v := bkt.Get([]byte(field))
+	if v == nil {
+		return 0, nil
+	}
+	return hll(v).estimate(), nil
+}
@@ -2,28 +2,242 @@ package tindex
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"math"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/fabxc/pagebuf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 var (
-	errOutOfOrder = errors.New("out of order")
-	errNotFound   = errors.New("not found")
+	// ErrOutOfOrder is returned if document IDs are not added to a postings
+	// list in strictly increasing order.
+	ErrOutOfOrder = errors.New("out of order")
+	// ErrNotFound is returned if a document, term, or page does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNoSpace is returned if a write is rejected because the free disk
+	// space dropped below Options.MinFreeSpace.
+	ErrNoSpace = errors.New("insufficient disk space")
+	// ErrLocked is returned by Open if the index is already opened by
+	// another process in a conflicting mode.
+	ErrLocked = errors.New("index locked")
+	// ErrReadOnly is returned for writes to an index opened read-only.
+	ErrReadOnly = errors.New("index opened read-only")
+	// ErrRateLimited is returned on commit of a batch that exceeds the
+	// MaxAddRate if FailOnRateLimit is set.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrSchemaViolation is returned on commit of a batch that adds
+	// documents not conforming to the schema of the index.
+	ErrSchemaViolation = errors.New("schema violation")
+	// ErrQuotaExceeded is returned on commit of a batch that adds documents
+	// beyond the quotas of their tenant.
+	ErrQuotaExceeded = errors.New("quota exceeded")
 )
 
 // Options for an Index.
 type Options struct {
+	// ReadOnly opens an existing index for queries only. Several processes
+	// may open the index read-only at the same time, but opening it fails
+	// with ErrLocked while another process has it opened for writing.
+	ReadOnly bool
+
+	// Strict enables validation of all terms and document IDs added to
+	// a batch. Invalid input fails the batch on commit with a descriptive
+	// error before anything is written to the index.
+	Strict bool
+
+	// SkipCorruptPages makes queries skip postings pages that are missing
+	// or cannot be decoded instead of failing. Skipped pages are quarantined
+	// and reported by Verify.
+	SkipCorruptPages bool
+
+	// IgnoreExisting makes batches skip document IDs that are not greater
+	// than the last ID in a term's postings list instead of failing with
+	// ErrOutOfOrder. This allows to safely re-apply a batch that may have
+	// been committed before.
+	IgnoreExisting bool
+
+	// Retries is the number of times opening the index is retried while
+	// another process holds it locked. Other errors are returned right away.
+	Retries int
+	// RetryBackoff is the wait before the first retry. It doubles with
+	// every subsequent retry. Zero means 100ms.
+	RetryBackoff time.Duration
+
+	// Logger receives reports about recoveries and corrupted pages.
+	// If nil, nothing is logged.
+	Logger Logger `json:"-"`
+
+	// DirMode is the permission of directories created for the index before
+	// the umask is applied. It defaults to 0777.
+	DirMode os.FileMode
+	// FileMode is the permission of files created for the index before the
+	// umask is applied. It defaults to 0666.
+	FileMode os.FileMode
+
+	// KVDir and PostingsDir are the directories of the key/value store and
+	// the postings pages, for example to place them on separate volumes.
+	// Relative paths are resolved against the index directory, which is
+	// the default for both. The lock and meta files always reside in the
+	// index directory.
+	KVDir       string
+	PostingsDir string
+
+	// TracerProvider is used to create spans for commits, searches, and
+	// recoveries. If nil, no spans are recorded.
+	TracerProvider trace.TracerProvider `json:"-"`
+
+	// SlowQueryThreshold enables logging of searches whose iterator takes
+	// longer than the threshold to be exhausted. Zero disables it.
+	SlowQueryThreshold time.Duration
+
+	// MinFreeSpace is the number of bytes of free disk space below which
+	// the index is reported as unhealthy. Once a write finds less space
+	// available, the index becomes read-only and rejects batches, writes
+	// and compactions with ErrNoSpace until enough space is available
+	// again. Opening the index for writing fails as well. Zero disables
+	// the check.
+	MinFreeSpace uint64
+
+	// FieldSketches enables maintaining a HyperLogLog sketch per field
+	// from which FieldCardinality estimates the number of distinct values.
+	FieldSketches bool
+
+	// DeterministicIDs makes the term and page IDs allocated by a batch
+	// depend only on the documents added to it. New terms of a document are
+	// assigned IDs in sorted order rather than the order they were passed in,
+	// and postings are written in order of term IDs. Indexes built from the
+	// same sequence of documents are then identical, which is mostly useful
+	// for reproducible tests.
+	DeterministicIDs bool
+
+	// BloomFilters enables maintaining Bloom filters over the document IDs
+	// of each term, which allow Querier.Contains to rule out most absent
+	// IDs without reading postings pages.
+	BloomFilters bool
+
+	// GroupCommitDelay is the time the writer of AddAsync waits for further
+	// requests to commit in the same batch. If zero, only requests that are
+	// already queued are added to the batch.
+	GroupCommitDelay time.Duration
+	// GroupCommitSize is the number of documents after which a batch of
+	// requests is committed without waiting further. Zero means no limit.
+	// All requests in a batch fail if the commit fails.
+	GroupCommitSize int
+
+	// MaxCommitDocs is the maximum number of documents written in a single
+	// transaction. Larger batches are committed in several transactions to
+	// bound the time writes are stalled. If a transaction fails, documents
+	// of the preceding ones remain in the index. Zero means no limit.
+	MaxCommitDocs int
+
+	// InitialMmapSize is the initial size of the memory mapping of the
+	// key/value store. Commits that grow the store beyond the mapping wait
+	// for all open queriers and snapshots to be closed.
+	InitialMmapSize int
+
+	// NoSync skips syncing the key/value store to disk after every commit.
+	// This speeds up bulk loads but may corrupt the index if the system
+	// crashes.
+	NoSync bool
+
+	// Values makes postings store a value with each document ID, which is
+	// set through Batch.SetValue and read through ValueIterator. It only
+	// takes effect when the index is created.
+	Values bool
+
+	// Scores makes postings store a score with each document ID, which is
+	// set through Batch.SetScore and read through ScoredIterator. It only
+	// takes effect when the index is created and cannot be combined with
+	// Values.
+	Scores bool
+
+	// CompositeSkiplists stores the skiplists of all terms in a single
+	// bucket instead of a bucket per term, which reduces the size of the
+	// key/value store for indexes with many terms. Existing indexes are
+	// migrated when opened writable with a different setting.
+	CompositeSkiplists bool
+
+	// TailBuffer is the number of the most recent IDs of each postings list
+	// that are kept in the key/value store before they are written to the
+	// postings pages. This avoids rewriting the tail pages of many postings
+	// lists on every small batch. It cannot be combined with Values or Scores.
+	TailBuffer int
+
+	// DocCacheSize is the number of decoded documents kept in memory to
+	// serve repeated lookups through Doc, Docs, and facets. Zero disables
+	// the cache.
+	DocCacheSize int
+
+	// QueryCacheSize is the number of search results kept in memory to
+	// serve repeated searches with the same field and matcher. Results are
+	// dropped once documents with terms of their field are committed, and
+	// matchers are identified by their String method. Zero disables the
+	// cache. It has no effect for indexes with values or scores.
+	QueryCacheSize int
+
+	// OpenScanWorkers is the number of goroutines that scan the index when
+	// it is opened. The scan checks the meta state against the stored
+	// documents and terms, verifies all postings pages like Verify, and
+	// fills the document cache, so that the first queries don't pay for
+	// cold caches. Open fails if the meta state is inconsistent. Zero skips
+	// the scan for fast startup.
+	OpenScanWorkers int
+
+	// TenantField is the field whose value identifies the tenant of a
+	// document. Documents without it are not subject to quotas.
+	TenantField string
+	// MaxTenantDocs is the maximum number of documents of each tenant.
+	// Batches exceeding it fail with ErrQuotaExceeded. Zero means no limit.
+	MaxTenantDocs int
+	// MaxTenantDocTerms is the maximum number of terms of each document of a
+	// tenant. Batches exceeding it fail with ErrQuotaExceeded. Zero means no
+	// limit.
+	MaxTenantDocTerms int
+
+	// VirtualFields are fields whose values are derived from another field
+	// at query time. They can be searched like stored fields and take
+	// precedence over stored fields of the same name.
+	VirtualFields map[string]VirtualField `json:"-"`
+
+	// Schema constrains the terms of added documents. If nil, any terms
+	// are accepted.
+	Schema *Schema
+
+	// CompactionPolicy decides when the key/value store is compacted
+	// automatically and how compactions lay out its buckets. If nil,
+	// DefaultCompactionPolicy is used.
+	CompactionPolicy CompactionPolicy `json:"-"`
+
+	// History records the last document ID of every commit so that AsOf
+	// can query earlier states of the index.
+	History bool
+
+	// MaxAddRate is the maximum number of documents committed per second.
+	// Commits exceeding it wait until the rate allows them. Zero means no
+	// limit.
+	MaxAddRate float64
+	// AddBurst is the number of documents that can be committed at once
+	// after the rate was not exhausted. It defaults to MaxAddRate.
+	AddBurst int
+	// FailOnRateLimit makes commits exceeding the MaxAddRate fail with
+	// ErrRateLimited instead of waiting.
+	FailOnRateLimit bool
 }
 
 // DefaultOptions used for opening a new index.
@@ -32,49 +246,309 @@ var DefaultOptions = &Options{}
 // Index is a fully persistent inverted index of documents with any number of fields
 // that map to exactly one term.
 type Index struct {
-	pbuf *pagebuf.DB
-	bolt *bolt.DB
-	meta *meta
-
-	rwlock sync.Mutex
+	path   string
+	lockf  *os.File
+	pbuf   *pagebuf.DB
+	bolt   *kvStore
+	meta   *meta
+	info   *Meta // nil if the index has no meta file
+	opts   *Options
+	logger Logger
+	tracer trace.Tracer
+
+	// Encoding of postings pages. It is fixed when the index is created.
+	pageType pageType
+	// Layout of the skiplists. It is fixed once the index is opened.
+	compositeSkiplists bool
+
+	schema  *schema      // compiled Options.Schema, nil if not set
+	docs    *docCache    // decoded documents, nil if disabled
+	queries *queryCache  // postings matched by searches, nil if disabled
+	limiter *rateLimiter // limits committed documents, nil if disabled
+
+	tailCursors map[termid]tailCursor // guarded by rwlock
+	// kvErr is set if a compaction replaced the key/value store file but
+	// could not reopen it. Writes fail with it. Guarded by rwlock.
+	kvErr error
+
+	rwlock      sync.Mutex
+	readOnly    int32 // set atomically while disk space is low
+	unrecovered int32 // set atomically if restoring pages after a failed commit failed
+
+	// kvlock is held for reading while a transaction on the key/value store
+	// is begun and for writing while a compaction replaces the store. It is
+	// never held while waiting for other locks or readers.
+	kvlock sync.RWMutex
+	// snaplock guards the in-memory state of the last commit. It is only
+	// held for writing while that state is swapped after a commit.
+	snaplock sync.RWMutex
+	gen      uint64 // number of commits since opening, guarded by snaplock
+	// committing is set while a commit is applied to both stores. Readers
+	// wait on committed until it is unset so that they never begin
+	// transactions in between. Guarded by snaplock.
+	committing bool
+	committed  *sync.Cond
+
+	cmtx       sync.Mutex
+	compaction *Compaction // currently running compaction
+	compactErr error       // result of the last compaction
+
+	compactionPolicy    CompactionPolicy
+	commitsSinceCompact int // guarded by rwlock
+
+	wmtx       sync.Mutex
+	writeq     chan *writeReq // queue of the background writer
+	writerDone chan struct{}
+	closed     bool
+
+	qmtx        sync.Mutex
+	quarantines map[uint64]CorruptPage
+
+	scan *ScanSummary // result of the scan on opening, if any
+
+	smtx sync.Mutex
+	subs map[*subscription]struct{} // subscriptions to new documents
+
+	counters counters
+	vars     *expvar.Map
+
+	// Directory removed on close if the index was opened from a bundle.
+	tmpdir string
 }
 
 // Open returns an index located in the given path. If none exists a new
 // one is created.
-func Open(path string, opts *Options) (*Index, error) {
+func Open(path string, opts *Options) (_ *Index, err error) {
 	if opts == nil {
 		opts = DefaultOptions
 	}
-
-	if err := os.MkdirAll(path, 0777); err != nil {
+	if opts.Values && opts.Scores {
+		return nil, errors.New("values and scores cannot be combined")
+	}
+	schema, err := opts.Schema.compile()
+	if err != nil {
 		return nil, err
 	}
+	if schema != nil && len(schema.ttls) > 0 && !opts.History {
+		return nil, errTTLWithoutHistory
+	}
 
-	bdb, err := bolt.Open(filepath.Join(path, "kv"), 0666, nil)
+	// Opening the index from several processes corrupts it. Only read-only
+	// opens may share it.
+	var lockf *os.File
+	if !opts.ReadOnly {
+		for _, dir := range append([]string{path}, opts.storeDirs(path)...) {
+			if err := os.MkdirAll(dir, opts.dirMode()); err != nil {
+				return nil, err
+			}
+		}
+		err = opts.retry(func() (err error) {
+			lockf, err = lockDir(path, opts.fileMode())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				lockf.Close()
+			}
+		}()
+	}
+
+	bdb, err := openKV(opts.kvPath(path), opts)
 	if err != nil {
 		return nil, err
 	}
-	pdb, err := pagebuf.Open(filepath.Join(path, "pb"), 0666, &pagebuf.Options{
+	defer func() {
+		if err != nil {
+			bdb.Close()
+		}
+	}()
+	pdb, err := pagebuf.Open(opts.pbPath(path), opts.fileMode(), &pagebuf.Options{
 		PageSize: pageSize,
 	})
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			pdb.Close()
+		}
+	}()
 	ix := &Index{
-		bolt: bdb,
-		pbuf: pdb,
-		meta: &meta{},
+		path:   path,
+		lockf:  lockf,
+		bolt:   &kvStore{DB: bdb},
+		pbuf:   pdb,
+		meta:   &meta{},
+		opts:   opts,
+		logger: opts.Logger,
+
+		quarantines: map[uint64]CorruptPage{},
+		subs:        map[*subscription]struct{}{},
+		schema:      schema,
+		docs:        newDocCache(opts.DocCacheSize),
+		queries:     newQueryCache(opts.QueryCacheSize),
+		limiter:     newRateLimiter(opts.MaxAddRate, opts.AddBurst),
+		tailCursors: map[termid]tailCursor{},
+
+		compactionPolicy: opts.CompactionPolicy,
+	}
+	ix.vars = newVars(&ix.counters)
+	ix.committed = sync.NewCond(ix.snaplock.RLocker())
+
+	if ix.compactionPolicy == nil {
+		ix.compactionPolicy = DefaultCompactionPolicy
+	}
+
+	if ix.logger == nil {
+		ix.logger = nopLogger{}
+	}
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
 	}
-	if err := ix.bolt.Update(ix.init); err != nil {
+	ix.tracer = tp.Tracer(tracerName)
+
+	if opts.ReadOnly {
+		if err := ix.bolt.View(ix.initReadOnly); err != nil {
+			return nil, err
+		}
+		if err := ix.initMeta(); err != nil {
+			return nil, err
+		}
+		if err := ix.openScan(); err != nil {
+			return nil, err
+		}
+		return ix, nil
+	}
+	// Opening the index for writing writes to the key/value store.
+	if err := ix.checkSpace(); err != nil {
+		return nil, err
+	}
+	if err := ix.initMeta(); err != nil {
+		return nil, err
+	}
+	if err := ix.update(ix.initWritable); err != nil {
+		return nil, err
+	}
+	if err := ix.openScan(); err != nil {
 		return nil, err
 	}
 	return ix, nil
 }
 
-// Close closes the index.
+// kvStore is an open key/value store along with its read transactions.
+// A store replaced by a compaction is closed once they have ended.
+type kvStore struct {
+	*bolt.DB
+	readers sync.WaitGroup
+}
+
+// beginRead begins a read transaction on the current key/value store. The
+// returned function must be called once the transaction was rolled back.
+func (ix *Index) beginRead() (*bolt.Tx, func(), error) {
+	ix.kvlock.RLock()
+	defer ix.kvlock.RUnlock()
+
+	kv := ix.bolt
+	tx, err := ix.beginKV(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	kv.readers.Add(1)
+	return tx, kv.readers.Done, nil
+}
+
+// lockTimeout is how long opening the key/value store waits for a file lock
+// held by another process.
+const lockTimeout = 100 * time.Millisecond
+
+// openKV opens the key/value store at the given path. It returns ErrLocked if
+// another process holds a conflicting lock on it.
+func openKV(path string, opts *Options) (db *bolt.DB, err error) {
+	// Fail on a locked database after a timeout instead of blocking
+	// indefinitely.
+	bopts := &bolt.Options{
+		ReadOnly:        opts.ReadOnly,
+		InitialMmapSize: opts.InitialMmapSize,
+		Timeout:         lockTimeout,
+	}
+	err = opts.retry(func() (err error) {
+		db, err = bolt.Open(path, opts.fileMode(), bopts)
+		if err == bolt.ErrTimeout {
+			return ErrLocked
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = opts.NoSync
+	return db, nil
+}
+
+// initReadOnly reads the meta state of an existing index.
+func (ix *Index) initReadOnly(tx *bolt.Tx) error {
+	for _, bn := range [][]byte{
+		bktMeta, bktTerms, bktTermIDs, bktDocs, bktSkiplist,
+	} {
+		if tx.Bucket(bn) == nil {
+			return fmt.Errorf("bucket %q: %w", string(bn), ErrNotFound)
+		}
+	}
+	mbkt := tx.Bucket(bktMeta)
+	if mbkt.Get(keyRecovery) != nil {
+		return errors.New("index requires recovery, open it writable first")
+	}
+	v := mbkt.Get(keyMeta)
+	if v == nil {
+		return fmt.Errorf("meta: %w", ErrNotFound)
+	}
+	if err := ix.meta.read(v); err != nil {
+		return fmt.Errorf("decoding meta failed: %w", err)
+	}
+	ix.pageType = ix.meta.PageType
+	ix.compositeSkiplists = ix.meta.CompositeSkiplists
+	return nil
+}
+
+// Close commits all requests queued by AddAsync, cancels a running compaction,
+// and closes the index. Closing an index again has no effect.
 func (ix *Index) Close() error {
-	err0 := ix.pbuf.Close()
-	err1 := ix.bolt.Close()
+	if !ix.stopWriter() {
+		return nil
+	}
+	ix.cmtx.Lock()
+	c := ix.compaction
+	ix.cmtx.Unlock()
+
+	if c != nil {
+		c.Cancel()
+		c.Wait()
+	}
+	var err0, err1 error
+
+	if !ix.opts.ReadOnly && atomic.LoadInt32(&ix.unrecovered) == 0 {
+		err1 = ix.update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bktMeta).Delete(keyOpen)
+		})
+	}
+	// Commits were not synced to disk if NoSync is set.
+	if ix.opts.NoSync && !ix.opts.ReadOnly && err1 == nil {
+		err1 = ix.bolt.Sync()
+	}
+	err0 = ix.pbuf.Close()
+	if err := ix.bolt.Close(); err1 == nil {
+		err1 = err
+	}
+	if ix.lockf != nil {
+		ix.lockf.Close()
+	}
+	if ix.tmpdir != "" {
+		os.RemoveAll(ix.tmpdir)
+	}
 	if err0 != nil {
 		return err0
 	}
@@ -88,9 +562,43 @@ var (
 	bktTermIDs  = []byte("term_ids")
 	bktSkiplist = []byte("skiplist")
 
-	keyMeta = []byte("meta")
+	keyMeta     = []byte("meta")
+	keyRecovery = []byte("recovery")
+	keyOpen     = []byte("open")
 )
 
+// initWritable sets up the key/value store, restores the postings of an
+// unfinished commit and migrates the store to the current format. It runs
+// in a single transaction so that opening the index commits only once.
+func (ix *Index) initWritable(tx *bolt.Tx) error {
+	for _, f := range []func(*bolt.Tx) error{
+		ix.init,
+		ix.initSkiplists,
+		ix.initTailBuffers,
+		ix.initHistory,
+	} {
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	if err := ix.recover(tx); err != nil {
+		return fmt.Errorf("recovery failed: %w", err)
+	}
+	for _, f := range []func(*bolt.Tx) error{
+		ix.initCounts,
+		ix.initLastIDs,
+		ix.initPageLasts,
+		ix.initDocKeys,
+		ix.initSketches,
+		ix.initBlooms,
+	} {
+		if err := f(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ix *Index) init(tx *bolt.Tx) error {
 	// Ensure all buckets exist. Any other index methods assume
 	// that these buckets exist and may panic otherwise.
@@ -98,7 +606,7 @@ func (ix *Index) init(tx *bolt.Tx) error {
 		bktMeta, bktTerms, bktTermIDs, bktDocs, bktSkiplist,
 	} {
 		if _, err := tx.CreateBucketIfNotExists(bn); err != nil {
-			return fmt.Errorf("create bucket %q failed: %s", string(bn), err)
+			return fmt.Errorf("create bucket %q failed: %w", string(bn), err)
 		}
 	}
 
@@ -106,58 +614,97 @@ func (ix *Index) init(tx *bolt.Tx) error {
 	mbkt := tx.Bucket(bktMeta)
 	if v := mbkt.Get(keyMeta); v != nil {
 		if err := ix.meta.read(v); err != nil {
-			return fmt.Errorf("decoding meta failed: %s", err)
+			return fmt.Errorf("decoding meta failed: %w", err)
 		}
 	} else {
 		// Index not initialized yet, set up meta information.
 		ix.meta = &meta{
 			LastDocID:  0,
 			LastTermID: 0,
+			PageType:   pageTypeDelta,
+
+			CompositeSkiplists: ix.opts.CompositeSkiplists,
+		}
+		if ix.opts.Values {
+			ix.meta.PageType = pageTypeValue
+		}
+		if ix.opts.Scores {
+			ix.meta.PageType = pageTypeScore
 		}
 		v, err := ix.meta.bytes()
 		if err != nil {
-			return fmt.Errorf("encoding meta failed: %s", err)
+			return fmt.Errorf("encoding meta failed: %w", err)
 		}
 		if err := mbkt.Put(keyMeta, v); err != nil {
-			return fmt.Errorf("creating meta failed: %s", err)
+			return fmt.Errorf("creating meta failed: %w", err)
 		}
 	}
+	ix.pageType = ix.meta.PageType
 
 	return nil
 }
 
-// Querier starts a new query session against the index.
+// Querier starts a new query session against the index. It reads from a
+// consistent snapshot of the index that is not affected by batches committed
+// after it was started. Iterators returned by it are valid until it is closed.
 func (ix *Index) Querier() (*Querier, error) {
-	kvtx, err := ix.bolt.Begin(false)
+	ix.snaplock.RLock()
+	defer ix.snaplock.RUnlock()
+
+	for ix.committing {
+		ix.committed.Wait()
+	}
+	ix.kvlock.RLock()
+	defer ix.kvlock.RUnlock()
+
+	kvtx, err := ix.beginKV(false)
 	if err != nil {
 		return nil, err
 	}
-	pbtx, err := ix.pbuf.Begin(false)
+	pbtx, err := ix.beginPB(false)
 	if err != nil {
 		kvtx.Rollback()
 		return nil, err
 	}
+	gen := ix.gen
+	kv := ix.bolt
+	kv.readers.Add(1)
+	ix.counters.openQueriers.Add(1)
+
 	return &Querier{
-		kvtx:        kvtx,
-		pbtx:        pbtx,
-		termBkt:     kvtx.Bucket(bktTerms),
-		skiplistBkt: kvtx.Bucket(bktSkiplist),
+		ix:        ix,
+		gen:       gen,
+		kvtx:      kvtx,
+		kvDone:    kv.readers.Done,
+		pbtx:      pbtx,
+		termBkt:   kvtx.Bucket(bktTerms),
+		skiplists: ix.skiplists(kvtx),
 	}, nil
 }
 
 // Querier encapsulates the index for several queries.
 type Querier struct {
+	ix   *Index
+	gen  uint64
 	kvtx *bolt.Tx
 	pbtx *pagebuf.Tx
 
-	termBkt     *bolt.Bucket
-	skiplistBkt *bolt.Bucket
+	kvDone func() // releases the key/value store once kvtx ended
+
+	termBkt   *bolt.Bucket
+	skiplists skiplists
+
+	asOf *Generation // generation the querier is restricted to, if any
 }
 
 // Close closes the underlying index transactions.
 func (q *Querier) Close() error {
+	q.ix.counters.openQueriers.Add(-1)
+
 	err0 := q.pbtx.Rollback()
 	err1 := q.kvtx.Rollback()
+	q.kvDone()
+
 	if err0 != nil {
 		return err0
 	}
@@ -167,51 +714,182 @@ func (q *Querier) Close() error {
 // Search returns an iterator over all document IDs that match all
 // provided matchers.
 func (q *Querier) Search(key string, m Matcher) (Iterator, error) {
+	return q.SearchContext(context.Background(), key, m)
+}
+
+// SearchContext is like Search but the returned iterator fails with the
+// context's error once it is canceled.
+func (q *Querier) SearchContext(ctx context.Context, key string, m Matcher) (_ Iterator, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, span := q.ix.tracer.Start(ctx, "tindex.Querier.Search",
+		trace.WithAttributes(attribute.String("key", key)),
+	)
+	defer func() { endSpan(span, err) }()
+
+	q.ix.counters.searches.Add(1)
+
+	var qs *queryStats
+	if q.ix.opts.SlowQueryThreshold > 0 {
+		qs = &queryStats{start: time.Now(), key: key, matcher: m}
+	}
+
+	// Cached postings carry no values or scores.
+	cache := q.ix.queries
+	if q.ix.pageType != pageTypeDelta {
+		cache = nil
+	}
+	var (
+		field, _ = q.ix.resolveField(key, m)
+		query    = key + "\xff" + m.String()
+	)
+	ids, cached := cache.get(field, query, q.gen)
+	if cached {
+		q.ix.counters.queryCacheHits.Add(1)
+		span.SetAttributes(attribute.Bool("cached", true))
+
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		return q.searchResult(ctx, &plainListIterator{list: ids}, qs), nil
+	}
+	if cache != nil {
+		q.ix.counters.queryCacheMisses.Add(1)
+	}
+
 	tids := q.termsForMatcher(key, m)
 	its := make([]Iterator, 0, len(tids))
 
+	span.SetAttributes(attribute.Int("terms", len(tids)))
+
 	for _, t := range tids {
-		it, err := q.postingsIter(t)
+		it, err := q.postingsIter(t, qs)
 		if err != nil {
 			return nil, err
 		}
 		its = append(its, it)
 	}
+	if qs != nil {
+		qs.terms = len(tids)
+	}
+	if cache != nil {
+		var ids []DocID
+		if len(its) > 0 {
+			if ids, err = ExpandIterator(Merge(its...)); err != nil {
+				return nil, err
+			}
+		}
+		cache.add(field, query, q.gen, ids)
+
+		its = its[:0]
+		if len(ids) > 0 {
+			its = append(its, &plainListIterator{list: ids})
+		}
+	}
 
 	if len(its) == 0 {
 		return nil, nil
 	}
-	return Merge(its...), nil
+	return q.searchResult(ctx, Merge(its...), qs), nil
+}
+
+// searchResult wraps the postings matched by a search into the iterator
+// returned to the caller.
+func (q *Querier) searchResult(ctx context.Context, it Iterator, qs *queryStats) Iterator {
+	it = q.filter(it)
+	if ctx.Done() != nil {
+		it = &contextIterator{ctx: ctx, it: it}
+	}
+	if qs != nil {
+		return &slowQueryIterator{Iterator: it, ix: q.ix, stats: qs}
+	}
+	return it
 }
 
 // postingsIter returns an iterator over the postings list of term t.
-func (q *Querier) postingsIter(t termid) (Iterator, error) {
-	b := q.skiplistBkt.Bucket(t.bytes())
-	if b == nil {
-		return nil, errNotFound
-	}
-
-	it := &skippingIterator{
-		skiplist: &boltSkiplistCursor{
-			k:   uint64(t),
-			c:   b.Cursor(),
-			bkt: b,
-		},
-		iterators: iteratorStoreFunc(func(k uint64) (Iterator, error) {
+// If qs is not nil, the pages read by the iterator are counted in it.
+func (q *Querier) postingsIter(t termid, qs *queryStats) (Iterator, error) {
+	buffered, err := q.bufferedPostings(t)
+	if err != nil {
+		return nil, err
+	}
+	sl := q.skiplists.cursor(t)
+	if sl == nil {
+		if len(buffered) > 0 {
+			return newPlainListIterator(buffered), nil
+		}
+		return nil, fmt.Errorf("skiplist for term %d: %w", t, ErrNotFound)
+	}
+
+	sit := &skippingIterator{
+		skiplist: sl,
+		iterators: iteratorStoreFunc(func(v DocID, k uint64) (Iterator, error) {
+			skip := q.ix.opts.SkipCorruptPages
+			if skip && q.ix.quarantined(k) {
+				return newPlainListIterator(nil), nil
+			}
 			data, err := q.pbtx.Get(k)
 			if err != nil {
-				return nil, errNotFound
+				if invariants && !skip {
+					panic(fmt.Sprintf("invariant violated: skiplist entry %d of term %d points to missing page %d", v, t, k))
+				}
+				err = fmt.Errorf("page %d: %w", k, ErrNotFound)
+				if skip {
+					q.quarantine(t, v, k, err)
+					return newPlainListIterator(nil), nil
+				}
+				return nil, err
 			}
-			// TODO(fabxc): for now, offset is zero, pages have no header
-			// and are always delta encoded.
-			return newPageDelta(data).cursor(), nil
+			if qs != nil {
+				qs.pages++
+			}
+			// TODO(fabxc): for now, offset is zero and pages have no header.
+			pg := q.ix.newPage(data)
+
+			if skip {
+				if err := pg.verify(v, 0); err != nil {
+					q.quarantine(t, v, k, err)
+					return newPlainListIterator(nil), nil
+				}
+			}
+			if invariants {
+				if first, err := pg.cursor().Seek(0); err == nil && first != v {
+					panic(fmt.Sprintf("invariant violated: page %d of term %d starts at %d instead of %d", k, t, first, v))
+				}
+				return newCheckedIterator(pg.cursor(), "page %d of term %d", k, t), nil
+			}
+			return pg.cursor(), nil
 		}),
 	}
+	if q.kvtx.Bucket(bktPageLasts) != nil {
+		sit.last = q.pageLast
+	}
+	var it Iterator = sit
 
+	if invariants {
+		it = newCheckedIterator(it, "postings of term %d", t)
+	}
+	if len(buffered) > 0 {
+		// Buffered IDs follow all IDs in the pages.
+		it = Merge(it, newPlainListIterator(buffered))
+	}
 	return it, nil
 }
 
+// quarantine marks the page of term t starting at min as corrupted.
+func (q *Querier) quarantine(t termid, min DocID, page uint64, err error) {
+	cp := CorruptPage{Page: page, Min: min, Err: err}
+
+	if v := q.kvtx.Bucket(bktTermIDs).Get(t.bytes()); v != nil {
+		cp.Term, _ = newTerm(v)
+	}
+	q.ix.quarantine(cp)
+}
+
 func (q *Querier) termsForMatcher(key string, m Matcher) termids {
+	key, m = q.ix.resolveField(key, m)
+
 	c := q.termBkt.Cursor()
 	pref := append([]byte(key), 0xff)
 
@@ -226,36 +904,143 @@ func (q *Querier) termsForMatcher(key string, m Matcher) termids {
 	return ids
 }
 
+// Values returns all values of the field in the index in sorted order.
+func (q *Querier) Values(key string) []string {
+	if vf, ok := q.ix.opts.VirtualFields[key]; ok {
+		return q.virtualValues(vf)
+	}
+	return q.values(key)
+}
+
+func (q *Querier) values(key string) []string {
+	c := q.termBkt.Cursor()
+	pref := append([]byte(key), 0xff)
+
+	var vals []string
+	for k, _ := c.Seek(pref); bytes.HasPrefix(k, pref); k, _ = c.Next() {
+		vals = append(vals, string(k[len(pref):]))
+	}
+	return vals
+}
+
+// Explain returns the terms a search for the key and matcher merges along
+// with the lengths of their postings lists. For virtual fields, these are
+// terms of the source field. It fails with ErrNotFound for indexes opened
+// read-only that were created before postings were counted.
+func (q *Querier) Explain(key string, m Matcher) ([]TermCount, error) {
+	key, m = q.ix.resolveField(key, m)
+
+	var (
+		c      = q.termBkt.Cursor()
+		counts = q.kvtx.Bucket(bktCounts)
+		pref   = append([]byte(key), 0xff)
+		res    []TermCount
+	)
+	if counts == nil {
+		return nil, fmt.Errorf("postings counts: %w", ErrNotFound)
+	}
+	for k, v := c.Seek(pref); bytes.HasPrefix(k, pref); k, v = c.Next() {
+		val := string(k[len(pref):])
+		if !m.Match(val) {
+			continue
+		}
+		n := counts.Get(v)
+		if n == nil {
+			return nil, fmt.Errorf("postings count of term %d: %w", newTermID(v), ErrNotFound)
+		}
+		res = append(res, TermCount{
+			Term: Term{Field: key, Val: val},
+			Docs: int(decodeUint64(n)),
+		})
+	}
+	return res, nil
+}
+
 // Doc returns the document with the given ID.
 func (ix *Index) Doc(id DocID) (Terms, error) {
-	tx, err := ix.bolt.Begin(false)
+	res, err := ix.Docs(id)
 	if err != nil {
 		return nil, err
 	}
+	return res[0].Terms, res[0].Err
+}
+
+// Doc is like Index.Doc but reads the document from the querier's snapshot.
+func (q *Querier) Doc(id DocID) (Terms, error) {
+	res := q.ix.docsFrom(q.kvtx, []DocID{id})
+	return res[0].Terms, res[0].Err
+}
+
+// DocResult is the result of looking up a single document.
+type DocResult struct {
+	Terms Terms
+	Err   error
+}
+
+// Docs returns the documents with the given IDs in the same order. Documents
+// that cannot be retrieved have their error set. The returned error is only
+// set if the lookup failed as a whole.
+func (ix *Index) Docs(ids ...DocID) ([]DocResult, error) {
+	tx, done, err := ix.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	defer tx.Rollback()
 
-	bdocs := tx.Bucket(bktDocs)
+	return ix.docsFrom(tx, ids), nil
+}
+
+// Docs is like Index.Docs but reads the documents from the querier's
+// snapshot.
+func (q *Querier) Docs(ids ...DocID) ([]DocResult, error) {
+	return q.ix.docsFrom(q.kvtx, ids), nil
+}
+
+// docsFrom looks up the documents with the given IDs in the transaction.
+func (ix *Index) docsFrom(tx *bolt.Tx, ids []DocID) []DocResult {
+	var (
+		docsBkt   = tx.Bucket(bktDocs)
+		termidBkt = tx.Bucket(bktTermIDs)
+		// Documents share most of their terms.
+		cache = map[termid]Term{}
+		res   = make([]DocResult, len(ids))
+	)
+	for i, id := range ids {
+		res[i].Terms, res[i].Err = ix.docs.doc(docsBkt, termidBkt, cache, id)
+
+		// Cached documents are shared with other callers.
+		if ix.docs != nil && res[i].Err == nil {
+			res[i].Terms = append(Terms(nil), res[i].Terms...)
+		}
+	}
+	return res
+}
 
-	v := bdocs.Get(id.bytes())
+func doc(docsBkt, termidBkt *bolt.Bucket, cache map[termid]Term, id DocID) (Terms, error) {
+	v := docsBkt.Get(id.bytes())
 	if v == nil {
-		return nil, errNotFound
+		return nil, fmt.Errorf("document %d: %w", id, ErrNotFound)
 	}
-	l, n := binary.Uvarint(v)
-	tids := newTermIDs(v[n : n+int(l)])
+	tids := newTermIDs(v)
 
-	b := tx.Bucket(bktTermIDs)
 	terms := make(Terms, len(tids))
 	for i, t := range tids {
+		if term, ok := cache[t]; ok {
+			terms[i] = term
+			continue
+		}
 		// TODO(fabxc): is this encode/decode cycle here worth the space savings?
 		// If we stored plain uint64s we can just pass the slice back in.
-		v := b.Get(t.bytes())
+		v := termidBkt.Get(t.bytes())
 		if v == nil {
-			return nil, fmt.Errorf("term not found")
+			return nil, fmt.Errorf("term %d: %w", t, ErrNotFound)
 		}
 		term, err := newTerm(v)
 		if err != nil {
 			return nil, err
 		}
+		cache[t] = term
 		terms[i] = term
 	}
 	return terms, nil
@@ -269,11 +1054,23 @@ func (ix *Index) Delete(it Iterator) (int, error) {
 
 // Batch starts a new batch against the index.
 func (ix *Index) Batch() (*Batch, error) {
-	// Lock writes so we can safely pre-allocate term and doc IDs.
+	if ix.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := ix.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	// Lock writes so we can safely pre-allocate term and doc IDs. It also
+	// keeps compactions from replacing the key/value store.
 	ix.rwlock.Lock()
 
-	tx, err := ix.bolt.Begin(false)
+	if ix.kvErr != nil {
+		ix.rwlock.Unlock()
+		return nil, ix.kvErr
+	}
+	tx, err := ix.beginKV(false)
 	if err != nil {
+		ix.rwlock.Unlock()
 		return nil, err
 	}
 	b := &Batch{
@@ -283,15 +1080,36 @@ func (ix *Index) Batch() (*Batch, error) {
 		termBkt:   tx.Bucket(bktTerms),
 		termidBkt: tx.Bucket(bktTermIDs),
 		terms:     map[Term]*batchTerm{},
+		keys:      map[string]DocID{},
+		values:    map[DocID]uint64{},
 	}
 	*b.meta = *ix.meta
+
+	ix.counters.openBatches.Add(1)
+
 	return b, nil
 }
 
+// newPage returns a page over data in the encoding of the index.
+func (ix *Index) newPage(data []byte) page {
+	switch ix.pageType {
+	case pageTypeValue:
+		return newPageValue(data)
+	case pageTypeScore:
+		return newPageScore(data)
+	}
+	return newPageDelta(data)
+}
+
 // meta contains information about the state of the index.
 type meta struct {
 	LastDocID  DocID
 	LastTermID termid
+	PageType   pageType
+	// Generation is the number of commits applied to the index.
+	Generation uint64
+
+	CompositeSkiplists bool
 }
 
 // read initilizes the meta from a byte slice.
@@ -332,7 +1150,7 @@ type Term struct {
 func newTerm(b []byte) (t Term, e error) {
 	c := bytes.SplitN(b, []byte{0xff}, 2)
 	if len(c) != 2 {
-		return t, fmt.Errorf("invalid term")
+		return t, fmt.Errorf("invalid term %q", b)
 	}
 	t.Field = string(c[0])
 	t.Val = string(c[1])
@@ -341,15 +1159,46 @@ func newTerm(b []byte) (t Term, e error) {
 
 // bytes returns a byte slice representation of the term.
 func (t *Term) bytes() []byte {
-	b := make([]byte, 0, len(t.Field)+1+len(t.Val))
-	b = append(b, []byte(t.Field)...)
+	return t.appendBytes(make([]byte, 0, len(t.Field)+1+len(t.Val)))
+}
+
+// appendBytes appends the byte representation of the term to b.
+func (t *Term) appendBytes(b []byte) []byte {
+	b = append(b, t.Field...)
 	b = append(b, 0xff)
-	return append(b, []byte(t.Val)...)
+	return append(b, t.Val...)
 }
 
 // Matcher checks whether a value for a key satisfies a check condition.
 type Matcher interface {
 	Match(value string) bool
+	// String returns a readable representation of the condition.
+	String() string
+}
+
+// Inverse returns a matcher that matches all values m does not match.
+func Inverse(m Matcher) Matcher {
+	if nm, ok := m.(*notMatcher); ok {
+		return nm.m
+	}
+	return &notMatcher{m: m}
+}
+
+// notMatcher matches all values its underlying matcher does not match.
+type notMatcher struct {
+	m Matcher
+}
+
+func (m *notMatcher) Match(s string) bool { return !m.m.Match(s) }
+
+func (m *notMatcher) String() string {
+	switch mm := m.m.(type) {
+	case *EqualMatcher:
+		return fmt.Sprintf("!=%q", mm.val)
+	case *RegexpMatcher:
+		return fmt.Sprintf("!~%q", mm.re)
+	}
+	return "!(" + m.m.String() + ")"
 }
 
 // EqualMatcher matches exactly one value for a particular label.
@@ -363,6 +1212,8 @@ func NewEqualMatcher(val string) *EqualMatcher {
 
 func (m *EqualMatcher) Match(s string) bool { return m.val == s }
 
+func (m *EqualMatcher) String() string { return fmt.Sprintf("=%q", m.val) }
+
 // RegexpMatcher matches labels for the fixed key for which the value
 // matches a regular expression.
 type RegexpMatcher struct {
@@ -379,6 +1230,8 @@ func NewRegexpMatcher(expr string) (*RegexpMatcher, error) {
 
 func (m *RegexpMatcher) Match(s string) bool { return m.re.MatchString(s) }
 
+func (m *RegexpMatcher) String() string { return fmt.Sprintf("=~%q", m.re) }
+
 // DocID is a unique identifier for a document.
 type DocID uint64
 
@@ -419,12 +1272,17 @@ func newTermIDs(b []byte) (t termids) {
 
 // bytes encodes the term IDs as a sequence of uvarints.
 func (t termids) bytes() []byte {
-	b := make([]byte, len(t)*binary.MaxVarintLen64)
-	n := 0
+	return t.appendBytes(make([]byte, 0, len(t)*binary.MaxVarintLen64))
+}
+
+// appendBytes appends the byte representation of the term IDs to b.
+func (t termids) appendBytes(b []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
 	for _, x := range t {
-		n += binary.PutUvarint(b[n:], uint64(x))
+		n := binary.PutUvarint(buf[:], uint64(x))
+		b = append(b, buf[:n]...)
 	}
-	return b[:n]
+	return b
 }
 
 // Batch collects multiple indexing actions and allows to apply them
@@ -439,6 +1297,25 @@ type Batch struct {
 
 	docs  []*batchDoc
 	terms map[Term]*batchTerm
+	keys  map[string]DocID // documents by their key
+
+	values map[DocID]uint64 // values stored with the documents' postings
+
+	deletions map[DocID]bool  // soft deletions, false for undeletions
+	secondary []secondaryPost // postings added through SecondaryIndex
+
+	err   error // first validation error in strict mode
+	pages int   // number of pages written on commit
+
+	tailCursors map[termid]tailCursor // tail cursors after commit
+
+	// IDs of existing terms looked up but not yet added to the batch.
+	termIDs map[Term]termid
+	// Scratch space reused across calls to Add and Ensure.
+	termBuf  []byte
+	keyBuf   []byte
+	keyTIDs  termids
+	lookTIDs termids
 }
 
 type batchDoc struct {
@@ -447,8 +1324,11 @@ type batchDoc struct {
 }
 
 type batchTerm struct {
-	id   termid  // zero if term has not been added yet
-	docs []DocID // documents to be indexed for the term
+	id      termid  // zero if term has not been added yet
+	docs    []DocID // documents to be indexed for the term
+	created bool    // term is new to the index, set on commit
+
+	scores map[DocID]uint8 // scores of the term's postings
 }
 
 // Add adds a new document with the given terms to the index and
@@ -457,6 +1337,20 @@ type batchTerm struct {
 func (b *Batch) Add(terms Terms) DocID {
 	b.meta.LastDocID++
 	id := b.meta.LastDocID
+
+	if b.ix.opts.Strict {
+		if err := validateTerms(terms); err != nil {
+			b.fail(fmt.Errorf("document %d: %w", id, err))
+		}
+	}
+	if b.ix.schema != nil {
+		if err := b.ix.schema.validate(terms); err != nil {
+			b.fail(fmt.Errorf("document %d: %w", id, err))
+		}
+	}
+	b.checkQuota(id, terms)
+
+	b.allocTerms(terms)
 	tids := make(termids, 0, len(terms))
 
 	// Subtract last document ID before this batch was started.
@@ -465,120 +1359,509 @@ func (b *Batch) Add(terms Terms) DocID {
 	}
 
 	b.docs = append(b.docs, &batchDoc{id: id, terms: tids})
+	b.keys[string(b.docKey(tids))] = id
+
 	return id
 }
 
+// SetValue sets the value stored with all postings of the document that are
+// written by the batch. It requires the index to be created with Values.
+func (b *Batch) SetValue(id DocID, v uint64) {
+	if b.meta.PageType != pageTypeValue {
+		b.fail(errors.New("index does not store values"))
+		return
+	}
+	b.values[id] = v
+}
+
+// SetScore sets the score stored with the posting of the document for term t.
+// The document must have been added to the term in the batch. It requires the
+// index to be created with Scores.
+func (b *Batch) SetScore(id DocID, t Term, score uint8) {
+	if b.meta.PageType != pageTypeScore {
+		b.fail(errors.New("index does not store scores"))
+		return
+	}
+	tb, ok := b.terms[t]
+	if !ok {
+		b.fail(fmt.Errorf("score for document %d of term %s=%q not added in batch", id, t.Field, t.Val))
+		return
+	}
+	if tb.scores == nil {
+		tb.scores = map[DocID]uint8{}
+	}
+	tb.scores[id] = score
+}
+
 // SecondaryIndex indexes the document ID for additional terms. The temrs
 // are not stored as part of the document's forward index as the initial terms.
 // The caller has to ensure that the document IDs are added to terms in
 // increasing order.
 func (b *Batch) SecondaryIndex(id DocID, terms ...Term) {
+	if b.ix.opts.Strict {
+		if id == 0 || id > b.meta.LastDocID {
+			b.fail(fmt.Errorf("secondary index for unknown document %d", id))
+		}
+		for _, t := range terms {
+			if err := validateTerm(t); err != nil {
+				b.fail(fmt.Errorf("document %d: %w", id, err))
+			}
+		}
+	}
+	b.allocTerms(terms)
 	for _, t := range terms {
-		b.addTerm(id, t)
+		tid := b.addTerm(id, t)
+		b.secondary = append(b.secondary, secondaryPost{id: id, term: tid})
+	}
+}
+
+// allocTerms allocates IDs for the terms in sorted order if the index uses
+// deterministic IDs. Otherwise they are allocated as they are added.
+func (b *Batch) allocTerms(terms Terms) {
+	if !b.ix.opts.DeterministicIDs || sort.IsSorted(terms) {
+		return
+	}
+	sorted := append(Terms(nil), terms...)
+	sort.Sort(sorted)
+
+	for _, t := range sorted {
+		b.batchTerm(t)
 	}
 }
 
 // addTerm adds the document ID to the term's postings list and returns
 // the Term's ID.
 func (b *Batch) addTerm(id DocID, t Term) termid {
+	tb := b.batchTerm(t)
+
+	if b.ix.opts.Strict {
+		if n := len(tb.docs); n > 0 && tb.docs[n-1] >= id {
+			b.fail(fmt.Errorf("document %d for term %s=%q after %d: %w", id, t.Field, t.Val, tb.docs[n-1], ErrOutOfOrder))
+		}
+	}
+	tb.docs = append(tb.docs, id)
+	return tb.id
+}
+
+// batchTerm returns the batch entry of the term. It populates the entry if
+// necessary and allocates a new ID if the term hasn't been created in the
+// database before.
+func (b *Batch) batchTerm(t Term) *batchTerm {
 	tb := b.terms[t]
-	// Populate term if necessary and allocate a new ID if it
-	// hasn't been created in the database before.
 	if tb == nil {
-		tb = &batchTerm{docs: make([]DocID, 0, 1024)}
-		b.terms[t] = tb
+		tb = &batchTerm{}
 
-		if idb := b.termBkt.Get(t.bytes()); idb != nil {
-			tb.id = termid(decodeUint64(idb))
+		if tid, ok := b.termID(t); ok {
+			tb.id = tid
 		} else {
 			b.meta.LastTermID++
 			tb.id = b.meta.LastTermID
 		}
+		b.terms[t] = tb
+	}
+	return tb
+}
+
+// termID returns the ID of the term if it exists in the batch or the index.
+// Lookups in the index are cached for the lifetime of the batch.
+func (b *Batch) termID(t Term) (termid, bool) {
+	if tb, ok := b.terms[t]; ok {
+		return tb.id, true
+	}
+	if tid, ok := b.termIDs[t]; ok {
+		return tid, true
+	}
+	b.termBuf = t.appendBytes(b.termBuf[:0])
+
+	idb := b.termBkt.Get(b.termBuf)
+	if idb == nil {
+		return 0, false
+	}
+	if b.termIDs == nil {
+		b.termIDs = map[Term]termid{}
+	}
+	tid := newTermID(idb)
+	b.termIDs[t] = tid
+	return tid, true
+}
+
+// fail records the first error encountered while populating the batch.
+func (b *Batch) fail(err error) {
+	if b.err == nil {
+		b.err = err
 	}
-	tb.docs = append(tb.docs, id)
-	return tb.id
 }
 
 // Commit executes the batched indexing against the underlying index.
 func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit but aborts and rolls back the batch if the
+// context is canceled before the batch was applied.
+func (b *Batch) CommitContext(ctx context.Context) (err error) {
 	defer b.ix.rwlock.Unlock()
+
+	_, span := b.ix.tracer.Start(ctx, "tindex.Batch.Commit",
+		trace.WithAttributes(
+			attribute.Int("docs", len(b.docs)),
+			attribute.Int("terms", len(b.terms)),
+		),
+	)
+	defer func() {
+		span.SetAttributes(attribute.Int("pages", b.pages))
+		endSpan(span, err)
+	}()
+	defer func() {
+		c := &b.ix.counters
+		c.openBatches.Add(-1)
+
+		if err != nil {
+			c.commitFailures.Add(1)
+			return
+		}
+		b.ix.publish(b)
+		b.ix.maybeCompact()
+
+		c.commits.Add(1)
+		c.docs.Add(int64(len(b.docs)))
+		c.pagesWritten.Add(int64(b.pages))
+		for _, tb := range b.terms {
+			c.postings.Add(int64(len(tb.docs)))
+		}
+	}()
 	// Close read transaction to open a write transaction. The outer rwlock
 	// stil guards against intermittend writes between switching.
+	if b.err != nil {
+		b.tx.Rollback()
+		return b.err
+	}
+	if err := b.ix.checkSpace(); err != nil {
+		b.tx.Rollback()
+		return err
+	}
+	if err := b.ix.throttle(ctx, len(b.docs)); err != nil {
+		b.tx.Rollback()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		b.tx.Rollback()
+		return err
+	}
 	if err := b.tx.Rollback(); err != nil {
 		return err
 	}
-	err := b.ix.bolt.Update(func(tx *bolt.Tx) error {
+	for _, tb := range b.terms {
+		tb.created = tb.id > b.ix.meta.LastTermID
+	}
+	if max := b.ix.opts.MaxCommitDocs; max > 0 && len(b.docs) > max {
+		for i, c := range b.split(max) {
+			err := c.apply(ctx)
+			b.pages += c.pages
+			if err != nil && i > 0 {
+				return fmt.Errorf("documents up to %d committed: %w", b.ix.meta.LastDocID, err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return b.apply(ctx)
+}
+
+// sortedTerms returns the terms of the batch in the order their postings are
+// written. With deterministic IDs they are sorted by term ID, otherwise their
+// order is undefined.
+func (b *Batch) sortedTerms() []*batchTerm {
+	tbs := make([]*batchTerm, 0, len(b.terms))
+	for _, tb := range b.terms {
+		tbs = append(tbs, tb)
+	}
+	if b.ix.opts.DeterministicIDs {
+		sort.Slice(tbs, func(i, j int) bool { return tbs[i].id < tbs[j].id })
+	}
+	return tbs
+}
+
+// split splits the batch into batches of n documents each. Postings for
+// documents of previous batches are added to the first one.
+func (b *Batch) split(n int) []*Batch {
+	var res []*Batch
+
+	for i := 0; i < len(b.docs); i += n {
+		j := i + n
+		if j > len(b.docs) {
+			j = len(b.docs)
+		}
+		m := *b.meta
+		m.LastDocID = b.docs[j-1].id
+
+		res = append(res, &Batch{
+			ix:     b.ix,
+			meta:   &m,
+			docs:   b.docs[i:j],
+			terms:  map[Term]*batchTerm{},
+			values: b.values,
+		})
+	}
+	for t, tb := range b.terms {
+		docs := tb.docs
+
+		for i, c := range res {
+			k := len(docs)
+			if i < len(res)-1 {
+				k = sort.Search(len(docs), func(k int) bool { return docs[k] > c.meta.LastDocID })
+			}
+			if k == 0 {
+				continue
+			}
+			c.terms[t] = &batchTerm{id: tb.id, created: tb.created, docs: docs[:k], scores: tb.scores}
+			docs = docs[k:]
+		}
+	}
+	res[len(res)-1].deletions = b.deletions
+	res[len(res)-1].secondary = b.secondary
+
+	return res
+}
+
+// apply writes the batch to the index in a single transaction.
+func (b *Batch) apply(ctx context.Context) (err error) {
+	// Record the current tail pages of all postings lists the batch appends to
+	// so that a partially applied commit can be rolled back.
+	tx, err := b.ix.beginKV(false)
+	if err != nil {
+		return err
+	}
+	tails, err := b.tails(tx)
+	tx.Rollback()
+	if err != nil {
+		return err
+	}
+	// Set once the page store may be committed ahead of the key/value store.
+	var committing bool
+
+	err = b.ix.update(func(tx *bolt.Tx) error {
+		b.meta.Generation = b.ix.meta.Generation + 1
+
 		docsBkt := tx.Bucket(bktDocs)
+		keysBkt := tx.Bucket(bktDocKeys)
 		// Add document IDs to forward index,
 		for _, d := range b.docs {
 			if err := docsBkt.Put(d.id.bytes(), d.terms.bytes()); err != nil {
 				return err
 			}
+			if err := keysBkt.Put(docKey(d.terms), d.id.bytes()); err != nil {
+				return err
+			}
 		}
 		// Add newly allocated terms.
 		termBkt := tx.Bucket(bktTerms)
 		termidBkt := tx.Bucket(bktTermIDs)
+		created := map[Term]struct{}{}
 
 		for t, tb := range b.terms {
-			if tb.id > b.ix.meta.LastTermID {
+			if tb.created {
 				bid := encodeUint64(uint64(tb.id))
 				tby := t.bytes()
 
 				if err := termBkt.Put(tby, bid); err != nil {
-					return fmt.Errorf("setting term failed: %s", err)
+					return fmt.Errorf("setting term %s=%q failed: %w", t.Field, t.Val, err)
 				}
 				if err := termidBkt.Put(bid, tby); err != nil {
-					return fmt.Errorf("setting term failed: %s", err)
+					return fmt.Errorf("setting term %s=%q failed: %w", t.Field, t.Val, err)
 				}
+				created[t] = struct{}{}
+			}
+		}
+		if b.ix.opts.FieldSketches {
+			if err := updateSketches(tx, created); err != nil {
+				return fmt.Errorf("updating field sketches failed: %w", err)
 			}
 		}
 
-		pbtx, err := b.ix.pbuf.Begin(true)
+		pbtx, err := b.ix.beginPB(true)
 		if err != nil {
 			return err
 		}
-		if err := b.writePostingsBatch(tx, pbtx); err != nil {
+		if err := b.writePostingsBatch(ctx, tx, pbtx); err != nil {
 			pbtx.Rollback()
 			return err
 		}
+		b.ix.snaplock.Lock()
+		b.ix.committing = true
+		b.ix.snaplock.Unlock()
+		committing = true
+
 		if err := pbtx.Commit(); err != nil {
 			return err
 		}
+		if err := b.applyDeletions(tx); err != nil {
+			return err
+		}
+		if err := b.recordGeneration(tx); err != nil {
+			return err
+		}
+		if err := b.recordSecondary(tx); err != nil {
+			return err
+		}
 		return b.updateMeta(tx)
 	})
+	b.ix.updateTailCursors(b.tailCursors, err)
+	if err != nil && len(tails) > 0 {
+		// The postings pages may have been written even though the transaction
+		// failed. Restore them to their state before the batch.
+		b.ix.logger.Log("msg", "commit failed, restoring postings", "err", err)
+
+		if _, rerr := b.ix.truncateTails(tails); rerr != nil {
+			// Keep the open marker so that the pages are restored when the
+			// index is opened next.
+			atomic.StoreInt32(&b.ix.unrecovered, 1)
+			err = fmt.Errorf("%w; recovery failed: %w", err, rerr)
+		}
+	}
+	if committing {
+		b.ix.snaplock.Lock()
+		if err == nil {
+			// The meta state is only applied in memory once it was
+			// committed.
+			b.ix.meta = b.meta
+			b.ix.gen++
+			if b.ix.queries != nil {
+				b.ix.queries.invalidate(b.fields(), b.ix.gen)
+			}
+		}
+		b.ix.committing = false
+		b.ix.committed.Broadcast()
+		b.ix.snaplock.Unlock()
+	}
 	return err
 }
 
 // Rollback drops all changes applied in the batch.
 func (b *Batch) Rollback() error {
+	b.ix.counters.openBatches.Add(-1)
+
+	err := b.tx.Rollback()
 	b.ix.rwlock.Unlock()
-	return b.tx.Rollback()
+	return err
 }
 
 // writePostings adds the postings batch to the index.
-func (b *Batch) writePostingsBatch(kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
-	skiplist := kvtx.Bucket(bktSkiplist)
-
-	// createPage allocates a new delta-encoded page starting with id as its first entry.
-	createPage := func(id DocID) (page, error) {
-		pg := newPageDelta(make([]byte, pageSize-pagebuf.PageHeaderSize))
+func (b *Batch) writePostingsBatch(ctx context.Context, kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
+	skiplists := b.ix.skiplists(kvtx)
+	counts := kvtx.Bucket(bktCounts)
+	blooms := kvtx.Bucket(bktBlooms)
+	tails := kvtx.Bucket(bktTailBuffers)
+	lasts := kvtx.Bucket(bktLastIDs)
+	pageLasts := kvtx.Bucket(bktPageLasts)
+
+	// createPage allocates a new page starting with id as its first entry.
+	createPage := func(tb *batchTerm, id DocID) (page, error) {
+		pg := b.ix.newPage(make([]byte, pageSize-pagebuf.PageHeaderSize))
+
+		switch p := pg.(type) {
+		case *pageValue:
+			return pg, p.initValue(id, b.values[id])
+		case *pageScore:
+			return pg, p.initScore(id, tb.scores[id])
+		}
 		if err := pg.init(id); err != nil {
 			return nil, err
 		}
 		return pg, nil
 	}
+	// appendID appends id to the page along with its value or score if the
+	// page holds them.
+	appendID := func(tb *batchTerm, pc pageCursor, id DocID) error {
+		switch c := pc.(type) {
+		case *pageValueCursor:
+			return c.appendValue(id, b.values[id])
+		case *pageScoreCursor:
+			return c.appendScore(id, tb.scores[id])
+		}
+		return pc.append(id)
+	}
 
-	for _, tb := range b.terms {
-		ids := tb.docs
+	// savePage writes the page with ID pid and returns its ID. If pid is zero,
+	// the page is new and added to the skiplist.
+	savePage := func(sl *boltSkiplistCursor, pg page, pc pageCursor, pid uint64) (uint64, error) {
+		b.pages++
 
-		b, err := skiplist.CreateBucketIfNotExists(tb.id.bytes())
+		ps, scored := pg.(*pageScore)
+		if pid != 0 {
+			if err := pbtx.Set(pid, pg.data()); err != nil {
+				return 0, err
+			}
+			if !scored {
+				return pid, nil
+			}
+		}
+		first, err := pc.Seek(0)
 		if err != nil {
+			return 0, err
+		}
+		if pid == 0 {
+			if pid, err = pbtx.Add(pg.data()); err != nil {
+				return 0, err
+			}
+			if err := sl.append(first, pid); err != nil {
+				return 0, err
+			}
+		}
+		if scored {
+			// Appending to an existing page may have raised its maximum score.
+			return pid, sl.setMaxScore(first, pid, ps.maxScore())
+		}
+		return pid, nil
+	}
+
+	ignoreExisting := b.ix.opts.IgnoreExisting
+	b.tailCursors = make(map[termid]tailCursor, len(b.terms))
+
+	for _, tb := range b.sortedTerms() {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		sl := &boltSkiplistCursor{
-			k:   uint64(tb.id),
-			c:   b.Cursor(),
-			bkt: b,
+		ids := tb.docs
+
+		if tails != nil && (b.ix.opts.TailBuffer > 0 || tails.Get(tb.id.bytes()) != nil) {
+			// Buffered IDs are validated and accounted for when they are added
+			// to the buffer.
+			var err error
+			if ids, err = b.bufferPostings(tails, counts, blooms, lasts, tb, ids); err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				continue
+			}
+		} else {
+			last := getLastID(lasts, tb.id)
+			if ignoreExisting {
+				if ids = idsAfter(ids, last); len(ids) == 0 {
+					continue
+				}
+			}
+			if ids[0] <= last {
+				return ErrOutOfOrder
+			}
+			if err := addTermCount(counts, tb.id, len(ids)); err != nil {
+				return err
+			}
+			if blooms != nil {
+				if err := addBloom(blooms, tb.id, ids); err != nil {
+					return err
+				}
+			}
+			if err := lasts.Put(tb.id.bytes(), ids[len(ids)-1].bytes()); err != nil {
+				return err
+			}
+		}
+
+		sl, err := skiplists.create(tb.id)
+		if err != nil {
+			return err
 		}
 
 		var (
@@ -587,14 +1870,19 @@ func (b *Batch) writePostingsBatch(kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
 			pid uint64     // Its ID.
 		)
 		// Get the most recent page. If none exist, the entire postings list is new.
-		_, pid, err = sl.seek(math.MaxUint64)
+		tc, cached := b.ix.tailCursors[tb.id]
+		if cached {
+			pid = tc.page
+		} else {
+			_, pid, err = sl.seek(math.MaxUint64)
+		}
 		if err != nil {
 			if err != io.EOF {
 				return err
 			}
 			// No most recent page for the key exists. The postings list is new and
 			// we have to allocate a new page ID for it.
-			if pg, err = createPage(ids[0]); err != nil {
+			if pg, err = createPage(tb, ids[0]); err != nil {
 				return err
 			}
 			pc = pg.cursor()
@@ -602,8 +1890,8 @@ func (b *Batch) writePostingsBatch(kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
 		} else {
 			// Load the most recent page.
 			pdata, err := pbtx.Get(pid)
-			if pdata == nil {
-				return fmt.Errorf("error getting page for ID %q: %s", pid, err)
+			if err != nil || pdata == nil {
+				return fmt.Errorf("page %d of term %d: %w", pid, tb.id, ErrNotFound)
 			}
 
 			pdatac := make([]byte, len(pdata))
@@ -611,36 +1899,37 @@ func (b *Batch) writePostingsBatch(kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
 			// pdatac := make([]byte, len(pdata))
 			copy(pdatac, pdata)
 
-			pg = newPageDelta(pdatac)
+			pg = b.ix.newPage(pdatac)
 			pc = pg.cursor()
+
+			if cached {
+				pc.resume(tc.offset, tc.last)
+			}
 		}
 
 		for i := 0; i < len(ids); i++ {
-			if err = pc.append(ids[i]); err == errPageFull {
+			if err = appendID(tb, pc, ids[i]); err == errPageFull {
 				// We couldn't append to the page because it was full.
 				// Store away the old page...
-				if pid == 0 {
-					// The page was new.
-					pid, err = pbtx.Add(pg.data())
-					if err != nil {
-						return err
-					}
-					first, err := pc.Seek(0)
-					if err != nil {
-						return err
-					}
-					if err := sl.append(first, pid); err != nil {
-						return err
-					}
-				} else {
-					if err = pbtx.Set(pid, pg.data()); err != nil {
-						return err
-					}
+				full, err := savePage(sl, pg, pc, pid)
+				if err != nil {
+					return err
+				}
+				// ... along with its last ID, which is only unknown if the
+				// page was full before the batch...
+				var plast DocID
+				if i > 0 {
+					plast = ids[i-1]
+				} else if plast, err = lastDocID(pg.cursor()); err != nil {
+					return err
+				}
+				if err := pageLasts.Put(encodeUint64(full), plast.bytes()); err != nil {
+					return err
 				}
 
 				// ... and allocate a new page.
 				pid = 0
-				if pg, err = createPage(ids[i]); err != nil {
+				if pg, err = createPage(tb, ids[i]); err != nil {
 					return err
 				}
 				pc = pg.cursor()
@@ -648,40 +1937,52 @@ func (b *Batch) writePostingsBatch(kvtx *bolt.Tx, pbtx *pagebuf.Tx) error {
 				return err
 			}
 		}
-		// Save the last page we have written to.
-		if pid == 0 {
-			// The page was new.
-			pid, err = pbtx.Add(pg.data())
-			if err != nil {
-				return err
-			}
-			first, err := pc.Seek(0)
-			if err != nil {
-				return err
-			}
-			if err := sl.append(first, pid); err != nil {
-				return err
-			}
-		} else {
-			if err = pbtx.Set(pid, pg.data()); err != nil {
+		var last DocID
+		if len(ids) > 0 {
+			last = ids[len(ids)-1]
+		}
+		// The cursor is behind the last ID unless the page only holds its
+		// first one.
+		if pc.offset() == 0 {
+			if last, err = pc.Next(); err != nil {
 				return err
 			}
 		}
+		tc = tailCursor{last: last, offset: pc.offset()}
+
+		// Save the last page we have written to.
+		if tc.page, err = savePage(sl, pg, pc, pid); err != nil {
+			return err
+		}
+		b.tailCursors[tb.id] = tc
 	}
 	return nil
 }
 
-// updateMeta updates the index's meta information based on the changes
-// applied with the batch.
+// idsAfter returns the strictly increasing subsequence of IDs greater than last.
+// The input slice is modified.
+func idsAfter(ids []DocID, last DocID) []DocID {
+	res := ids[:0]
+	for _, id := range ids {
+		if id > last {
+			res = append(res, id)
+			last = id
+		}
+	}
+	return res
+}
+
+// updateMeta writes the index's meta information based on the changes
+// applied with the batch. It is applied in memory once the transaction
+// committed.
 func (b *Batch) updateMeta(tx *bolt.Tx) error {
-	b.ix.meta = b.meta
 	bkt := tx.Bucket([]byte(bktMeta))
 	if bkt == nil {
-		return fmt.Errorf("meta bucket not found")
+		return fmt.Errorf("bucket %q: %w", string(bktMeta), ErrNotFound)
 	}
-	v, err := b.ix.meta.bytes()
+	v, err := b.meta.bytes()
 	if err != nil {
-		return fmt.Errorf("error encoding meta: %s", err)
+		return fmt.Errorf("encoding meta failed: %w", err)
 	}
 	return bkt.Put([]byte(keyMeta), v)
 }
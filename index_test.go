@@ -1 +1,4872 @@
 package tindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/fabxc/pagebuf"
+)
+
+func openTestIndex(t testing.TB, opts *Options) (*Index, func()) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return ix, func() {
+		ix.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type testLogger [][]interface{}
+
+func (l *testLogger) Log(keyvals ...interface{}) error {
+	*l = append(*l, keyvals)
+	return nil
+}
+
+func TestStrictBatch(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Strict: true})
+	defer cleanup()
+
+	var cases = []struct {
+		add    []Terms
+		fail   bool
+		errIs  error
+		second func(b *Batch, ids []DocID)
+	}{
+		{
+			add: []Terms{{{"a", "1"}, {"b", "2"}}, {{"a", "2"}}},
+		},
+		{
+			add:  []Terms{{{"", "1"}}},
+			fail: true,
+		},
+		{
+			add:  []Terms{{{"a", ""}}},
+			fail: true,
+		},
+		{
+			add:  []Terms{{{"a", "\xff\xfe"}}},
+			fail: true,
+		},
+		{
+			add:  []Terms{{{"a", "1"}, {"a", "2"}}},
+			fail: true,
+		},
+		{
+			add: []Terms{{{"a", "1"}}, {{"a", "2"}}},
+			second: func(b *Batch, ids []DocID) {
+				b.SecondaryIndex(ids[1], Term{"c", "1"})
+				b.SecondaryIndex(ids[0], Term{"c", "1"})
+			},
+			fail:  true,
+			errIs: ErrOutOfOrder,
+		},
+		{
+			add: []Terms{{{"a", "1"}}},
+			second: func(b *Batch, ids []DocID) {
+				b.SecondaryIndex(ids[0]+100, Term{"c", "1"})
+			},
+			fail: true,
+		},
+	}
+
+	for i, c := range cases {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []DocID
+		for _, terms := range c.add {
+			ids = append(ids, b.Add(terms))
+		}
+		if c.second != nil {
+			c.second(b, ids)
+		}
+		err = b.Commit()
+		if c.fail && err == nil {
+			t.Fatalf("case %d: expected error but got none", i)
+		}
+		if !c.fail && err != nil {
+			t.Fatalf("case %d: unexpected error: %s", i, err)
+		}
+		if c.errIs != nil && !errors.Is(err, c.errIs) {
+			t.Fatalf("case %d: expected error %q but got %q", i, c.errIs, err)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	// Crashed processes leave the open marker behind. Earlier versions wrote
+	// a recovery record before each commit instead.
+	for _, record := range []bool{false, true} {
+		t.Run(fmt.Sprintf("record=%v", record), func(t *testing.T) {
+			testRecovery(t, record)
+		})
+	}
+}
+
+func testRecovery(t *testing.T, record bool) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []DocID{
+		b.Add(Terms{{"a", "1"}}),
+		b.Add(Terms{{"a", "1"}}),
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the postings of a second batch but fail the index transaction
+	// as if the process crashed after the pages were committed.
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"a", "1"}})
+
+	tails, err := b.tails(b.tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.tx.Rollback()
+
+	if record {
+		err = ix.bolt.Update(func(tx *bolt.Tx) error {
+			mbkt := tx.Bucket(bktMeta)
+			if err := mbkt.Put(keyRecovery, tails.bytes()); err != nil {
+				return err
+			}
+			return mbkt.Delete(keyOpen)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errCrash := errors.New("crash")
+
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		pbtx, err := ix.pbuf.Begin(true)
+		if err != nil {
+			return err
+		}
+		if err := b.writePostingsBatch(context.Background(), tx, pbtx); err != nil {
+			pbtx.Rollback()
+			return err
+		}
+		if err := pbtx.Commit(); err != nil {
+			return err
+		}
+		return errCrash
+	})
+	if err != errCrash {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ix.rwlock.Unlock()
+
+	// Close the stores without deleting the open marker.
+	ix.stopWriter()
+	ix.pbuf.Close()
+	ix.bolt.Close()
+	ix.lockf.Close()
+
+	var logger testLogger
+
+	ix, err = Open(dir, &Options{Logger: &logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if len(logger) != 1 {
+		t.Fatalf("expected recovery to be logged once but got %v", logger)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := q.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	// Appending after recovery must not conflict with the discarded postings.
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"a", "1"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is restored after closing cleanly.
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logger = nil
+
+	ix, err = Open(dir, &Options{Logger: &logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if len(logger) != 0 {
+		t.Fatalf("unexpected log entries %v", logger)
+	}
+}
+
+func TestVerifyCorruptPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir, &Options{SkipCorruptPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []DocID
+	for i := 0; i < 5000; i++ {
+		ids = append(ids, b.Add(Terms{{"a", "1"}}))
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the second page of the postings list with garbage.
+	var (
+		min, max DocID
+		page     uint64
+	)
+	err = ix.bolt.View(func(tx *bolt.Tx) error {
+		tid := newTermID(tx.Bucket(bktTerms).Get((&Term{"a", "1"}).bytes()))
+		sl := ix.skiplists(tx).cursor(tid)
+
+		sl.seek(0)
+		min, page, _ = sl.next()
+		max, _, _ = sl.next()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbtx, err := ix.pbuf.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := make([]byte, pageSize-pagebuf.PageHeaderSize)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+	if err := pbtx.Set(page, garbage); err != nil {
+		t.Fatal(err)
+	}
+	if err := pbtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt, err := ix.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 {
+		t.Fatalf("expected 1 corrupt page but got %v", corrupt)
+	}
+	if c := corrupt[0]; c.Page != page || c.Min != min || c.Max != max || c.Term != (Term{"a", "1"}) {
+		t.Fatalf("unexpected corrupt page %s", c)
+	}
+	if !errors.Is(corrupt[0].Err, errPageCorrupt) {
+		t.Fatalf("expected page corruption error but got %v", corrupt[0].Err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exp []DocID
+	for _, id := range ids {
+		if id < min || id >= max {
+			exp = append(exp, id)
+		}
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %d documents but got %d", len(exp), len(res))
+	}
+}
+
+func TestIgnoreExisting(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		ix, cleanup := openTestIndex(t, &Options{IgnoreExisting: ignore})
+
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []DocID
+		for i := 0; i < 3; i++ {
+			ids = append(ids, b.Add(Terms{{"a", "1"}}))
+		}
+		b.SecondaryIndex(ids[0], Term{"b", "1"})
+		b.SecondaryIndex(ids[1], Term{"b", "1"})
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Re-apply the secondary index partially along with a new document ID.
+		b, err = ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SecondaryIndex(ids[1], Term{"b", "1"})
+		b.SecondaryIndex(ids[2], Term{"b", "1"})
+
+		err = b.Commit()
+		if !ignore {
+			if !errors.Is(err, ErrOutOfOrder) {
+				t.Fatalf("expected out of order error but got %v", err)
+			}
+			cleanup()
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := q.Search("b", NewEqualMatcher("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Close()
+
+		if !reflect.DeepEqual(res, ids) {
+			t.Fatalf("expected %v but got %v", ids, res)
+		}
+		cleanup()
+	}
+}
+
+func TestOptionsRetry(t *testing.T) {
+	var (
+		errTransient = ErrLocked
+		errAgain     = &os.PathError{Op: "open", Path: "x", Err: syscall.EAGAIN}
+		errAccess    = &os.PathError{Op: "open", Path: "x", Err: syscall.EACCES}
+		errNoSpace   = &os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}
+		errCallback  = errors.New("callback")
+	)
+	var cases = []struct {
+		retries int
+		errs    []error
+		calls   int
+		err     error
+	}{
+		{retries: 0, errs: []error{errTransient}, calls: 1, err: errTransient},
+		{retries: 2, errs: []error{errTransient, nil}, calls: 2, err: nil},
+		{retries: 2, errs: []error{errTransient, errTransient, errTransient, nil}, calls: 3, err: errTransient},
+		{retries: 2, errs: []error{bolt.ErrTimeout, nil}, calls: 2, err: nil},
+		// Permanent errors are returned on the first attempt.
+		{retries: 2, errs: []error{errAgain, nil}, calls: 1, err: errAgain},
+		{retries: 2, errs: []error{bolt.ErrDatabaseNotOpen, nil}, calls: 1, err: bolt.ErrDatabaseNotOpen},
+		{retries: 2, errs: []error{bolt.ErrInvalid, nil}, calls: 1, err: bolt.ErrInvalid},
+		{retries: 2, errs: []error{errAccess, nil}, calls: 1, err: errAccess},
+		{retries: 2, errs: []error{errNoSpace, nil}, calls: 1, err: errNoSpace},
+		{retries: 2, errs: []error{errCallback, nil}, calls: 1, err: errCallback},
+	}
+	for i, c := range cases {
+		var (
+			opts  = &Options{Retries: c.retries, RetryBackoff: time.Microsecond}
+			calls int
+		)
+		err := opts.retry(func() error {
+			err := c.errs[calls]
+			calls++
+			return err
+		})
+		if err != c.err {
+			t.Fatalf("case %d: expected error %v but got %v", i, c.err, err)
+		}
+		if calls != c.calls {
+			t.Fatalf("case %d: expected %d calls but got %d", i, c.calls, calls)
+		}
+	}
+}
+
+func TestUpdatePanic(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		ix.update(func(tx *bolt.Tx) error {
+			panic("update")
+		})
+	}()
+
+	// The transaction of the panicking update must have been rolled back.
+	done := make(chan error, 1)
+	go func() {
+		done <- ix.update(func(tx *bolt.Tx) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update blocked after panic")
+	}
+}
+
+func TestVars(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"a", "1"}, {"b", "1"}})
+	b.Add(Terms{{"a", "1"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Search("a", NewEqualMatcher("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() map[string]int64 {
+		rec := httptest.NewRecorder()
+		ix.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		var res map[string]int64
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	exp := map[string]int64{
+		"commits":           1,
+		"commit_failures":   0,
+		"docs_added":        2,
+		"postings_added":    3,
+		"pages_written":     2,
+		"searches":          1,
+		"open_batches":      0,
+		"open_queriers":     1,
+		"recoveries":        0,
+		"quarantined_pages": 0,
+
+		"commits_rate_limited": 0,
+		"subscription_drops":   0,
+		"query_cache_hits":     0,
+		"query_cache_misses":   0,
+	}
+	if res := get(); !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	q.Close()
+	exp["open_queriers"] = 0
+
+	if res := get(); !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	var logger testLogger
+
+	ix, cleanup := openTestIndex(t, &Options{
+		Logger:             &logger,
+		SlowQueryThreshold: time.Nanosecond,
+	})
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"a", "1"}})
+	b.Add(Terms{{"a", "2"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	m, err := NewRegexpMatcher("1|2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := q.Search("a", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger) != 0 {
+		t.Fatalf("unexpected log before iterator was exhausted: %v", logger)
+	}
+	if _, err := ExpandIterator(it); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger) != 1 {
+		t.Fatalf("expected one log entry but got %v", logger)
+	}
+	kvs := map[interface{}]interface{}{}
+	for i := 0; i+1 < len(logger[0]); i += 2 {
+		kvs[logger[0][i]] = logger[0][i+1]
+	}
+	if kvs["msg"] != "slow query" || kvs["key"] != "a" || kvs["terms"] != 2 || kvs["pages"] != 2 {
+		t.Fatalf("unexpected log entry %v", logger[0])
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ix.opts = &Options{MinFreeSpace: math.MaxUint64}
+	if err := ix.Health(); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace but got %v", err)
+	}
+
+	// Reporting low disk space must not switch the index to read-only.
+	ix.opts = &Options{}
+
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "1"}})
+
+	// An open batch holds the write lock and must not make the index
+	// unhealthy.
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&ix.unrecovered, 1)
+	if err := ix.Health(); err != errUnrecovered {
+		t.Fatalf("expected errUnrecovered but got %v", err)
+	}
+	atomic.StoreInt32(&ix.unrecovered, 0)
+}
+
+func TestNoSpace(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	ix.opts = &Options{MinFreeSpace: math.MaxUint64}
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "1"}})
+	if err := b.Commit(); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace but got %v", err)
+	}
+	// Once read-only, writes are rejected before they start.
+	if _, err := ix.Batch(); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace but got %v", err)
+	}
+	if r := <-ix.AddAsync(Terms{{Field: "a", Val: "1"}}); r.Err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace but got %v", r.Err)
+	}
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Open(dir, &Options{MinFreeSpace: math.MaxUint64}); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace opening index but got %v", err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Search("a", NewEqualMatcher("1")); err != nil {
+		t.Fatalf("unexpected search error: %s", err)
+	}
+	q.Close()
+
+	// Once space is freed, the next commit switches the index back to
+	// writable.
+	ix.opts = &Options{MinFreeSpace: 1}
+
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "1"}})
+	if err := b.Commit(); err != nil {
+		t.Fatalf("unexpected commit error: %s", err)
+	}
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	q, err = ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ExpandIterator(it); err != nil || len(res) != 1 {
+		t.Fatalf("unexpected search result %v, %v", res, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		b.Add(Terms{
+			{Field: "a", Val: fmt.Sprint(i % 10)},
+			{Field: "b", Val: fmt.Sprint(i)},
+		})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ix.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Compact(); err == nil {
+		t.Fatalf("expected error starting a second compaction")
+	}
+	if err := c.Wait(); err != nil {
+		t.Fatalf("compaction failed: %s", err)
+	}
+	if p := c.Progress(); p.Keys == 0 || p.Keys != p.TotalKeys {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected health error: %s", err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("a", NewEqualMatcher("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 100 {
+		t.Fatalf("expected 100 results but got %d", len(res))
+	}
+}
+
+func TestCompactReopenFailure(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	add := func(n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{{Field: "a", Val: "1"}})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(100)
+
+	errOpen := errors.New("open")
+	reopenKV = func(string, *Options) (*bolt.DB, error) { return nil, errOpen }
+	defer func() { reopenKV = openKV }()
+
+	c, err := ix.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); !errors.Is(err, errOpen) {
+		t.Fatalf("expected open error but got %v", err)
+	}
+	// The previous store must have been restored so that later commits
+	// persist.
+	add(10)
+
+	path := ix.path
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{".compact", ".old"} {
+		if _, err := os.Stat(ix.opts.kvPath(path) + p); !os.IsNotExist(err) {
+			t.Fatalf("unexpected file %s: %v", p, err)
+		}
+	}
+	ix, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	res, err := ix.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 110 {
+		t.Fatalf("expected 110 results but got %d", len(res))
+	}
+}
+
+func TestCompactOpenQuerier(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	add := func(n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{{Field: "a", Val: fmt.Sprint(i % 10)}})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(1000)
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Neither the compaction nor following commits wait for the querier.
+	c, err := ix.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); err != nil {
+		t.Fatalf("compaction failed: %s", err)
+	}
+	add(10)
+
+	// Looking up documents through the index while holding the querier
+	// does not block either.
+	it, err := q.Search("a", NewEqualMatcher("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ix.Facets(it, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f["a"]["3"] != 100 {
+		t.Fatalf("unexpected facets %v", f)
+	}
+	it, err = q.Search("a", NewEqualMatcher("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = q.Facets(it, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f["a"]["3"] != 100 {
+		t.Fatalf("unexpected facets of querier %v", f)
+	}
+	if _, err := q.Doc(1001); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected document committed after opening the querier to be missing but got %v", err)
+	}
+	if _, err := ix.Doc(1001); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testCompactionPolicy struct {
+	stats []CompactionStats
+	fills map[string]bool
+}
+
+func (p *testCompactionPolicy) Compact(s CompactionStats) bool {
+	p.stats = append(p.stats, s)
+	return s.Commits == 3
+}
+
+func (p *testCompactionPolicy) FillPercent(bucket string) float64 {
+	p.fills[bucket] = true
+	return 0.5
+}
+
+func TestCompactionPolicy(t *testing.T) {
+	p := &testCompactionPolicy{fills: map[string]bool{}}
+
+	ix, cleanup := openTestIndex(t, &Options{CompactionPolicy: p})
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if _, err := ix.Add(Terms{{"a", fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.cmtx.Lock()
+	c := ix.compaction
+	ix.cmtx.Unlock()
+
+	if c == nil {
+		t.Fatal("expected compaction to be started")
+	}
+	if err := c.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.fills[string(bktDocs)] {
+		t.Fatalf("fill percent not requested for bucket %q", bktDocs)
+	}
+	if _, err := ix.Add(Terms{{"a", "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.stats) != 4 {
+		t.Fatalf("expected 4 policy calls, got %d", len(p.stats))
+	}
+	if s := p.stats[3]; s.Commits != 1 || s.Size == 0 {
+		t.Fatalf("unexpected stats after compaction %+v", s)
+	}
+
+	fp := &FreeSpacePolicy{MinFreeRatio: 0.5, MinSize: 100}
+	for _, c := range []struct {
+		s   CompactionStats
+		exp bool
+	}{
+		{s: CompactionStats{Size: 50, FreeBytes: 40}, exp: false},
+		{s: CompactionStats{Size: 200, FreeBytes: 50}, exp: false},
+		{s: CompactionStats{Size: 200, FreeBytes: 100}, exp: true},
+	} {
+		if got := fp.Compact(c.s); got != c.exp {
+			t.Fatalf("stats %+v: expected %v, got %v", c.s, c.exp, got)
+		}
+	}
+	if (&FreeSpacePolicy{}).Compact(CompactionStats{Size: 200, FreeBytes: 200}) {
+		t.Fatal("expected no compaction with zero ratio")
+	}
+	// Compactions are opt-in.
+	if DefaultCompactionPolicy.Compact(CompactionStats{Size: 1 << 40, FreeBytes: 1 << 40}) {
+		t.Fatal("expected no compaction by default policy")
+	}
+}
+
+func TestCompactCancel(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	// The compaction cannot proceed while the batch is open.
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ix.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Cancel()
+
+	if err := b.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); err != ErrCompactionCanceled {
+		t.Fatalf("expected ErrCompactionCanceled but got %v", err)
+	}
+	if err := ix.Health(); err != nil {
+		t.Fatalf("unexpected health error: %s", err)
+	}
+}
+
+func TestPostingsStats(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	// Field a has postings lists of lengths 1 to 10.
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		for j := 0; j < i; j++ {
+			b.Add(Terms{{Field: "a", Val: fmt.Sprint(i)}})
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "10"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := PostingsStats{Terms: 10, P50: 5, P90: 9, P99: 9, Max: 11}
+
+	s, err := ix.PostingsStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != exp {
+		t.Fatalf("expected %+v but got %+v", exp, s)
+	}
+
+	// Counts must be rebuilt from the postings if they are missing.
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(bktCounts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.update(ix.initCounts); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = ix.PostingsStats(); err != nil {
+		t.Fatal(err)
+	}
+	if s != exp {
+		t.Fatalf("expected %+v but got %+v", exp, s)
+	}
+}
+
+func TestTopCardinality(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b.Add(Terms{
+			{Field: "a", Val: fmt.Sprint(i % 2)},
+			{Field: "b", Val: fmt.Sprint(i % 5)},
+		})
+	}
+	b.Add(Terms{{Field: "b", Val: "4"}})
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	fields, terms, err := ix.TopCardinality(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expFields := []FieldCount{{Field: "b", Docs: 11}, {Field: "a", Docs: 10}}
+	if !reflect.DeepEqual(fields, expFields) {
+		t.Fatalf("expected fields %v but got %v", expFields, fields)
+	}
+	expTerms := []TermCount{
+		{Term: Term{Field: "a", Val: "0"}, Docs: 5},
+		{Term: Term{Field: "a", Val: "1"}, Docs: 5},
+	}
+	if !reflect.DeepEqual(terms, expTerms) {
+		t.Fatalf("expected terms %v but got %v", expTerms, terms)
+	}
+}
+
+func TestFieldCardinality(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{FieldSketches: true})
+	defer cleanup()
+
+	for _, n := range []int{100, 10000} {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{{Field: "a", Val: fmt.Sprint(i)}})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		c, err := ix.FieldCardinality("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(c)-float64(n)) > 0.05*float64(n) {
+			t.Fatalf("estimate %d too far off from %d", c, n)
+		}
+	}
+	if c, err := ix.FieldCardinality("b"); err != nil || c != 0 {
+		t.Fatalf("expected 0 for unknown field but got %d, %v", c, err)
+	}
+}
+
+func TestTailCursors(t *testing.T) {
+	for _, opts := range []*Options{{}, {Values: true}, {Scores: true}} {
+		ix, cleanup := openTestIndex(t, opts)
+
+		for i := 0; i < 30; i++ {
+			b, err := ix.Batch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Small batches append to the same tail pages repeatedly.
+			for j := 0; j < 50+i; j++ {
+				b.Add(Terms{
+					{Field: "a", Val: "x"},
+					{Field: "b", Val: fmt.Sprint(j % 3)},
+					{Field: "c", Val: fmt.Sprint(i)},
+				})
+			}
+			if err := b.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			// The cached cursors must match the stored postings lists.
+			err = ix.bolt.View(func(tx *bolt.Tx) error {
+				pbtx, err := ix.pbuf.Begin(false)
+				if err != nil {
+					return err
+				}
+				defer pbtx.Rollback()
+
+				if len(ix.tailCursors) != 4+i+1 {
+					return fmt.Errorf("expected %d tail cursors but got %d", 4+i+1, len(ix.tailCursors))
+				}
+				for tid, tc := range ix.tailCursors {
+					_, pid, err := ix.skiplists(tx).cursor(tid).seek(math.MaxUint64)
+					if err != nil {
+						return err
+					}
+					data, err := pbtx.Get(pid)
+					if err != nil {
+						return err
+					}
+					pc := ix.newPage(data).cursor()
+					last, err := lastDocID(pc)
+					if err != nil {
+						return err
+					}
+					exp := tailCursor{page: pid, last: last, offset: pc.offset()}
+					if tc != exp {
+						return fmt.Errorf("term %d: expected tail cursor %+v but got %+v", tid, exp, tc)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := ix.Search("a", NewEqualMatcher("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := 30*50 + 29*30/2; len(res) != exp {
+			t.Fatalf("expected %d results but got %d", exp, len(res))
+		}
+		cleanup()
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		b.Add(Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i % 2)},
+		})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	all, err := ix.Warmup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all < 3 {
+		t.Fatalf("expected a page for each list, got %d pages", all)
+	}
+	a, err := ix.Warmup(
+		Selector{Field: "a", Matcher: NewEqualMatcher("x")},
+		Selector{Field: "a", Matcher: Inverse(NewEqualMatcher("y"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == 0 || a >= all {
+		t.Fatalf("unexpected number of pages %d for field a out of %d", a, all)
+	}
+	if n, err := ix.Warmup(Selector{Field: "c", Matcher: NewEqualMatcher("x")}); err != nil || n != 0 {
+		t.Fatalf("expected no pages for missing field, got %d (%v)", n, err)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Open(filepath.Join(dir, "values"), &Options{Values: true, TailBuffer: 10}); err == nil {
+		t.Fatalf("expected error combining tail buffers and values")
+	}
+	ix, err := Open(dir, &Options{TailBuffer: 100, BloomFilters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(ix *Index, n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{
+				{Field: "a", Val: "x"},
+				{Field: "b", Val: fmt.Sprint(i % 2)},
+			})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(ix *Index, n int) {
+		for _, c := range []struct {
+			key, val string
+			n        int
+		}{
+			{"a", "x", n},
+			{"b", "0", n / 2},
+		} {
+			res, err := ix.Search(c.key, NewEqualMatcher(c.val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != c.n {
+				t.Fatalf("%s=%s: expected %d results but got %d", c.key, c.val, c.n, len(res))
+			}
+			for i := 1; i < len(res); i++ {
+				if res[i] <= res[i-1] {
+					t.Fatalf("%s=%s: results out of order at %d", c.key, c.val, i)
+				}
+			}
+		}
+	}
+	buffered := func(ix *Index, term Term) int {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		ids, err := q.bufferedPostings(newTermID(q.termBkt.Get(term.bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ids)
+	}
+	for i := 1; i <= 25; i++ {
+		add(ix, 10)
+		check(ix, i*10)
+	}
+	// The buffer of a=x was flushed to pages at 100 and 200 IDs.
+	if n := buffered(ix, Term{"a", "x"}); n != 50 {
+		t.Fatalf("expected 50 buffered IDs but got %d", n)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []DocID{1, 150, 250} {
+		ok, err := q.Contains(Term{"a", "x"}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected document %d in postings list", id)
+		}
+	}
+	q.Close()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SecondaryIndex(10, Term{"a", "x"})
+	if err := b.Commit(); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("expected ErrOutOfOrder but got %v", err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once disabled, buffers are flushed by the next batch.
+	ix, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	check(ix, 250)
+	add(ix, 10)
+	check(ix, 260)
+
+	if n := buffered(ix, Term{"a", "x"}); n != 0 {
+		t.Fatalf("expected no buffered IDs but got %d", n)
+	}
+	corrupt, err := ix.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) > 0 {
+		t.Fatalf("unexpected corrupt pages %v", corrupt)
+	}
+}
+
+func TestDocCache(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{DocCacheSize: 2})
+	defer cleanup()
+
+	var docs []Terms
+	for i := 0; i < 5; i++ {
+		docs = append(docs, Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i)},
+		})
+	}
+	ids, err := ix.Add(docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := ix.Docs(ids[:3]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, r := range res {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+			if !reflect.DeepEqual(r.Terms, docs[j]) {
+				t.Fatalf("document %d: expected %v but got %v", ids[j], docs[j], r.Terms)
+			}
+			// Modifying results must not affect the cache.
+			r.Terms[0].Val = "y"
+		}
+	}
+	// Only the most recently used documents are kept.
+	for i, id := range ids {
+		if _, ok := ix.docs.get(id); ok != (i == 1 || i == 2) {
+			t.Fatalf("document %d: unexpected cache state %v", id, ok)
+		}
+	}
+	if _, err := ix.Doc(ids[4] + 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for missing document but got %v", err)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{QueryCacheSize: 2})
+	defer cleanup()
+
+	ids, err := ix.Add(
+		Terms{{"a", "x"}, {"b", "1"}},
+		Terms{{"a", "y"}, {"b", "1"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(key, val string, exp ...DocID) {
+		t.Helper()
+		res, err := ix.Search(key, NewEqualMatcher(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) == 0 && len(exp) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(res, exp) {
+			t.Fatalf("search %s=%q: expected %v, got %v", key, val, exp, res)
+		}
+	}
+	c := &ix.counters
+
+	search("a", "x", ids[0])
+	search("a", "x", ids[0])
+	search("b", "1", ids...)
+	search("a", "z")
+	search("a", "z")
+	if h, m := c.queryCacheHits.Value(), c.queryCacheMisses.Value(); h != 2 || m != 3 {
+		t.Fatalf("expected 2 hits and 3 misses, got %d and %d", h, m)
+	}
+	// Only the most recently used results are kept.
+	if _, ok := ix.queries.get("b", "b\xff"+NewEqualMatcher("1").String(), ix.gen); !ok {
+		t.Fatal("expected cached result for b")
+	}
+	if _, ok := ix.queries.get("a", "a\xff"+NewEqualMatcher("x").String(), ix.gen); ok {
+		t.Fatal("expected evicted result for a")
+	}
+
+	// Appends to a field invalidate its results, but not others.
+	gen := ix.gen
+	ids2, err := ix.Add(Terms{{"a", "z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search("a", "z", ids2[0])
+	search("b", "1", ids...)
+	if h := c.queryCacheHits.Value(); h != 3 {
+		t.Fatalf("expected 3 hits, got %d", h)
+	}
+	// Queriers started before the commit do not use results read after it.
+	if _, ok := ix.queries.get("a", "a\xff"+NewEqualMatcher("z").String(), gen); ok {
+		t.Fatal("expected no cached result for earlier generation")
+	}
+
+	// Soft deletions are applied to cached results.
+	if _, err := ix.SoftDelete(newPlainListIterator(ids[:1])); err != nil {
+		t.Fatal(err)
+	}
+	search("b", "1", ids[1])
+}
+
+func TestCompositeSkiplists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each reopen migrates the skiplists written so far to the other layout.
+	for i, opts := range []*Options{{}, {CompositeSkiplists: true}, {}, {CompositeSkiplists: true}} {
+		ix, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3000; j++ {
+			b.Add(Terms{
+				{Field: "a", Val: "x"},
+				{Field: "b", Val: fmt.Sprint(j % 5)},
+			})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		n := 3000 * (i + 1)
+
+		for _, c := range []struct {
+			key, val string
+			n        int
+		}{
+			{"a", "x", n},
+			{"b", "3", n / 5},
+		} {
+			res, err := ix.Search(c.key, NewEqualMatcher(c.val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != c.n {
+				t.Fatalf("%s=%s: expected %d results but got %d", c.key, c.val, c.n, len(res))
+			}
+		}
+		corrupt, err := ix.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(corrupt) > 0 {
+			t.Fatalf("unexpected corrupt pages %v", corrupt)
+		}
+
+		var buckets, entries int
+		err = ix.bolt.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(bktSkiplist).ForEach(func(_, v []byte) error {
+				if v == nil {
+					buckets++
+				} else {
+					entries++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.CompositeSkiplists && (buckets != 0 || entries == 0) {
+			t.Fatalf("expected only composite entries, got %d buckets and %d entries", buckets, entries)
+		}
+		if !opts.CompositeSkiplists && (buckets != 6 || entries != 0) {
+			t.Fatalf("expected only term buckets, got %d buckets and %d entries", buckets, entries)
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSkiplists(b *testing.B, fn func(b *testing.B, opts *Options)) {
+	for _, c := range []struct {
+		name string
+		opts *Options
+	}{
+		{"buckets", &Options{NoSync: true}},
+		{"composite", &Options{NoSync: true, CompositeSkiplists: true}},
+	} {
+		b.Run(c.name, func(b *testing.B) { fn(b, c.opts) })
+	}
+}
+
+// BenchmarkSkiplistsCommit measures commits creating and appending to the
+// skiplists of many terms.
+func BenchmarkSkiplistsCommit(b *testing.B) {
+	benchmarkSkiplists(b, func(b *testing.B, opts *Options) {
+		ix, cleanup := openTestIndex(b, opts)
+		defer cleanup()
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			batch, err := ix.Batch()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j := 0; j < 1000; j++ {
+				batch.Add(Terms{
+					{Field: "a", Val: fmt.Sprint(j % 20)},
+					{Field: "b", Val: fmt.Sprint((i*1000 + j) % 20000)},
+				})
+			}
+			if err := batch.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSkiplistsSearch measures searches merging the postings lists of
+// many terms.
+func BenchmarkSkiplistsSearch(b *testing.B) {
+	benchmarkSkiplists(b, func(b *testing.B, opts *Options) {
+		ix, cleanup := openTestIndex(b, opts)
+		defer cleanup()
+
+		for i := 0; i < 20; i++ {
+			batch, err := ix.Batch()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j := 0; j < 1000; j++ {
+				batch.Add(Terms{{Field: "b", Val: fmt.Sprint((i*1000 + j) % 20000)}})
+			}
+			if err := batch.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		m, err := NewRegexpMatcher("19.*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := ix.Search("b", m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkEnsure measures ensuring documents that mostly exist already.
+func BenchmarkEnsure(b *testing.B) {
+	ix, cleanup := openTestIndex(b, &Options{NoSync: true})
+	defer cleanup()
+
+	var docs []Terms
+	for i := 0; i < 10000; i++ {
+		docs = append(docs, Terms{
+			{Field: "__name__", Val: fmt.Sprintf("metric_%d", i%100)},
+			{Field: "instance", Val: fmt.Sprintf("host-%d", i%50)},
+			{Field: "job", Val: "api"},
+			{Field: "series", Val: fmt.Sprint(i)},
+		})
+	}
+	if _, err := ix.Add(docs[:9000]...); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		batch, err := ix.Batch()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, d := range docs {
+			batch.Ensure(d)
+		}
+		if err := batch.Rollback(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBloomFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The filters of the first batch are built when the index is reopened
+	// with them enabled.
+	for _, opts := range []*Options{{}, {BloomFilters: true}} {
+		ix, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3000; i++ {
+			b.Add(Terms{{Field: "a", Val: fmt.Sprint(i % 2)}})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix, err := Open(dir, &Options{BloomFilters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var (
+		term   = Term{Field: "a", Val: "0"}
+		tid    = newTermID(q.termBkt.Get(term.bytes()))
+		blooms = q.kvtx.Bucket(bktBlooms)
+		fp     int
+	)
+	for id := DocID(1); id <= 6000; id++ {
+		ok, err := q.Contains(term, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Documents with odd IDs have the value 0.
+		if ok != (id%2 == 1) {
+			t.Fatalf("unexpected containment %v for document %d", ok, id)
+		}
+		if id%2 == 0 && mayContain(blooms, tid, id) {
+			fp++
+		}
+	}
+	if fp > 3000/20 {
+		t.Fatalf("too many false positives: %d", fp)
+	}
+	if ok, err := q.Contains(Term{Field: "a", Val: "x"}, 1); err != nil || ok {
+		t.Fatalf("expected unknown term to not contain document but got %v, %v", ok, err)
+	}
+}
+
+func TestQuerierSnapshot(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	const (
+		batches   = 50
+		batchSize = 10
+	)
+	done := make(chan error)
+
+	// Every batch adds documents to the shared term a=x and a new term for
+	// the batch. A querier must see either all or none of a batch's documents
+	// in both.
+	go func() {
+		for i := 0; i < batches; i++ {
+			b, err := ix.Batch()
+			if err != nil {
+				done <- err
+				return
+			}
+			for j := 0; j < batchSize; j++ {
+				b.Add(Terms{
+					{Field: "a", Val: "x"},
+					{Field: "batch", Val: fmt.Sprint(i)},
+				})
+			}
+			if err := b.Commit(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	count := func(q *Querier, key string, m Matcher) int {
+		it, err := q.Search(key, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if it == nil {
+			return 0
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res)
+	}
+	all, err := NewRegexpMatcher(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := count(q, "a", NewEqualMatcher("x"))
+		if m := count(q, "batch", all); n != m {
+			t.Fatalf("inconsistent snapshot: %d documents for shared term but %d for batch terms", n, m)
+		}
+		q.Close()
+	}
+}
+
+func TestAddAsync(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	var results []<-chan AsyncResult
+	for i := 0; i < 10; i++ {
+		results = append(results, ix.AddAsync(
+			Terms{{Field: "a", Val: "x"}},
+			Terms{{Field: "a", Val: "y"}},
+		))
+	}
+	for i, res := range results {
+		r := <-res
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		exp := []DocID{DocID(2*i + 1), DocID(2*i + 2)}
+		if !reflect.DeepEqual(r.IDs, exp) {
+			t.Fatalf("expected IDs %v but got %v", exp, r.IDs)
+		}
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-ix.AddAsync(Terms{{Field: "a", Val: "x"}}); r.Err != errClosed {
+		t.Fatalf("expected errClosed but got %v", r.Err)
+	}
+}
+
+func TestAddAsyncGroupCommit(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{
+		GroupCommitDelay: time.Hour,
+		GroupCommitSize:  4,
+	})
+	defer cleanup()
+
+	// With a long delay, requests can only be committed once they add up
+	// to the group size.
+	var results []<-chan AsyncResult
+	for i := 0; i < 4; i++ {
+		results = append(results, ix.AddAsync(Terms{{Field: "a", Val: "x"}}))
+	}
+	for i, res := range results {
+		r := <-res
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if exp := []DocID{DocID(i + 1)}; !reflect.DeepEqual(r.IDs, exp) {
+			t.Fatalf("expected IDs %v but got %v", exp, r.IDs)
+		}
+	}
+	if v := ix.counters.commits.Value(); v != 1 {
+		t.Fatalf("expected 1 commit but got %d", v)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	if _, err := Open(ix.path, nil); err != ErrLocked {
+		t.Fatalf("expected ErrLocked but got %v", err)
+	}
+	// Read-only opens must not block while the index is opened for writing.
+	done := make(chan error, 1)
+	go func() {
+		ro, err := Open(ix.path, &Options{ReadOnly: true})
+		if err == nil {
+			ro.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrLocked {
+			t.Fatalf("expected ErrLocked but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read-only open blocked by writer")
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "x"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only opens can share the index.
+	opts := &Options{ReadOnly: true}
+
+	ro1, err := Open(ix.path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro1.Close()
+
+	ro2, err := Open(ix.path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro2.Close()
+
+	if _, err := ro1.Batch(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly but got %v", err)
+	}
+	if err := ro1.Health(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly but got %v", err)
+	}
+	q, err := ro2.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []DocID{1}; !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+}
+
+func TestOpenRetryLocked(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	// Release the lock while the second open is waiting for it.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ix.Close()
+	}()
+	ix2, err := Open(ix.path, &Options{Retries: 5, RetryBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("retrying open failed: %s", err)
+	}
+	ix2.Close()
+}
+
+func TestContextCanceled(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "x"}})
+	b.Add(Terms{{Field: "a", Val: "x"}})
+	if err := b.CommitContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.SearchContext(ctx, "a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := it.Next(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if _, err := it.Next(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+	if _, err := ix.VerifyContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "y"}})
+	if err := b.CommitContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{GroupCommitDelay: time.Hour})
+	defer cleanup()
+
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	res := ix.AddAsync(Terms{{Field: "a", Val: "x"}})
+
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-res:
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	default:
+		t.Fatalf("request not committed after flush")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{InitialMmapSize: 1 << 20})
+	defer cleanup()
+
+	add := func() {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Add(Terms{{Field: "a", Val: "x"}})
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add()
+
+	s, err := ix.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+
+	// Commits must not be blocked by the snapshot.
+	add()
+
+	if g := s.Generation(); g != 1 {
+		t.Fatalf("expected generation 1 but got %d", g)
+	}
+	for i := 0; i < 2; i++ {
+		it, err := s.Search("a", NewEqualMatcher("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := []DocID{1}; !reflect.DeepEqual(res, exp) {
+			t.Fatalf("expected %v but got %v", exp, res)
+		}
+	}
+}
+
+func TestSnapshotMmap(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{Field: "a", Val: "x"}})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ix.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Grow the key/value store beyond its initial memory mapping. The
+	// commit has to wait for the snapshot.
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		b.Add(Terms{{Field: "a", Val: "x"}, {Field: "b", Val: fmt.Sprint(i)}})
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Commit()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case err := <-done:
+		t.Fatalf("commit did not wait for snapshot: %v", err)
+	default:
+	}
+	// Reads other than new transactions must proceed meanwhile.
+	gen := make(chan uint64, 1)
+	go func() {
+		gen <- ix.Generation()
+	}()
+	select {
+	case g := <-gen:
+		if g != 1 {
+			t.Fatalf("expected generation 1 but got %d", g)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading generation blocked by commit")
+	}
+	res, err := s.Search("a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := ExpandIterator(res); err != nil || len(ids) != 1 {
+		t.Fatalf("unexpected snapshot result %v, %v", ids, err)
+	}
+	if err := s.Release(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("commit blocked after snapshot was released")
+	}
+	ids, err := ix.Search("a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 5001 {
+		t.Fatalf("expected 5001 results but got %d", len(ids))
+	}
+}
+
+func TestSnapshotCompact(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	add := func(n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{{Field: "a", Val: "1"}})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(100)
+
+	s, err := ix.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Release()
+
+	// Commits proceed while a compaction replaces the store under the
+	// snapshot.
+	for i := 0; i < 3; i++ {
+		c, err := ix.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(10)
+
+		if err := c.Wait(); err != nil {
+			t.Fatalf("compaction failed: %s", err)
+		}
+	}
+	add(10)
+
+	it, err := s.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 100 {
+		t.Fatalf("expected 100 results in snapshot but got %d", len(res))
+	}
+	res, err = ix.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 140 {
+		t.Fatalf("expected 140 results but got %d", len(res))
+	}
+}
+
+func TestMaxCommitDocs(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{MaxCommitDocs: 3})
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		id := b.Add(Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i)},
+		})
+		if i > 0 {
+			b.SecondaryIndex(id-1, Term{Field: "c", Val: "y"})
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, c := range []struct {
+		key, val string
+		n        int
+	}{
+		{"a", "x", 10},
+		{"b", "9", 1},
+		{"c", "y", 9},
+	} {
+		it, err := q.Search(c.key, NewEqualMatcher(c.val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != c.n {
+			t.Fatalf("%s=%s: expected %d results but got %d", c.key, c.val, c.n, len(res))
+		}
+	}
+	if ix.meta.LastDocID != 10 {
+		t.Fatalf("expected last document ID 10 but got %d", ix.meta.LastDocID)
+	}
+}
+
+// failAfterCommit is a context that is canceled once the meta state of the
+// index advanced beyond the given generation.
+type failAfterCommit struct {
+	context.Context
+	ix  *Index
+	gen uint64
+}
+
+func (c failAfterCommit) Err() error {
+	if c.ix.meta.Generation > c.gen {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestMaxCommitDocsFailure(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{MaxCommitDocs: 3})
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b.Add(Terms{{Field: "a", Val: "x"}, {Field: "b", Val: fmt.Sprint(i)}})
+	}
+	// Fail the second part of the split batch.
+	ctx := failAfterCommit{Context: context.Background(), ix: ix, gen: ix.meta.Generation}
+
+	if err := b.CommitContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelation but got %v", err)
+	}
+	// The meta state in memory must match the committed one.
+	var stored meta
+	err = ix.bolt.View(func(tx *bolt.Tx) error {
+		return stored.read(tx.Bucket(bktMeta).Get(keyMeta))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&stored, ix.meta) {
+		t.Fatalf("expected meta %+v but got %+v", stored, *ix.meta)
+	}
+	if ix.meta.LastDocID != 3 {
+		t.Fatalf("expected last document ID 3 but got %d", ix.meta.LastDocID)
+	}
+
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := b.Add(Terms{{Field: "a", Val: "x"}}); id != 4 {
+		t.Fatalf("expected document ID 4 but got %d", id)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Values: true})
+	defer cleanup()
+
+	// Add documents in two batches so that existing pages are appended to.
+	for n := 0; n < 2; n++ {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			id := b.Add(Terms{
+				{Field: "a", Val: "x"},
+				{Field: "b", Val: fmt.Sprint(i % 2)},
+			})
+			b.SetValue(id, uint64(id)*10)
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	i1, err := q.Search("a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Merge the postings of both values of b.
+	m, err := NewRegexpMatcher("0|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := q.Search("b", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := Intersect(i1, i2)
+	n := 0
+
+	id, err := it.Seek(0)
+	for ; err == nil; id, err = it.Next() {
+		v, err := it.(ValueIterator).ValueAt(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != uint64(id)*10 {
+			t.Fatalf("expected value %d for document %d but got %d", id*10, id, v)
+		}
+		n++
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("expected 1000 results but got %d", n)
+	}
+
+	it, err = q.Search("b", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := ExpandValues(it, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []uint64{100, 120, 140}; !reflect.DeepEqual(vals, exp) {
+		t.Fatalf("expected values %v but got %v", exp, vals)
+	}
+}
+
+func TestValuesDisabled(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetValue(b.Add(Terms{{Field: "a", Val: "x"}}), 1)
+
+	if err := b.Commit(); err == nil {
+		t.Fatalf("expected error for value without Values enabled")
+	}
+}
+
+func TestScores(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Scores: true})
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		var (
+			t1 = Term{Field: "a", Val: "x"}
+			t2 = Term{Field: "b", Val: fmt.Sprint(i % 2)}
+		)
+		id := b.Add(Terms{t1, t2})
+		b.SetScore(id, t1, uint8(i%10))
+		b.SetScore(id, t2, 1)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	i1, err := q.Search("a", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewRegexpMatcher("0|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := q.Search("b", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scores of both terms are summed up.
+	it := Intersect(i1, i2).(ScoredIterator)
+
+	id, err := it.Seek(0)
+	for ; err == nil; id, err = it.Next() {
+		if exp := uint64(id-1)%10 + 1; it.Score() != exp {
+			t.Fatalf("expected score %d for document %d but got %d", exp, id, it.Score())
+		}
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Scores: true})
+	defer cleanup()
+
+	var (
+		r      = rand.New(rand.NewSource(1))
+		scores = map[DocID]uint64{}
+	)
+	// Add documents in several batches so that the maximum scores of
+	// existing pages are updated.
+	for n := 0; n < 3; n++ {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			terms := Terms{{Field: "a", Val: fmt.Sprint(r.Intn(5))}}
+			if r.Intn(10) == 0 {
+				terms = append(terms, Term{Field: "a", Val: "x"})
+			}
+			id := b.Add(terms)
+
+			for _, t := range terms {
+				s := uint8(r.Intn(100))
+				// Few documents have high scores.
+				if r.Intn(100) == 0 {
+					s += 100
+				}
+				b.SetScore(id, t, s)
+				scores[id] += uint64(s)
+			}
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var exp []ScoredDoc
+	for id, s := range scores {
+		exp = append(exp, ScoredDoc{ID: id, Score: s})
+	}
+	sort.Slice(exp, func(i, j int) bool {
+		if exp[i].Score != exp[j].Score {
+			return exp[i].Score > exp[j].Score
+		}
+		return exp[i].ID < exp[j].ID
+	})
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	m, err := NewRegexpMatcher(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{1, 10, 100} {
+		res, err := q.TopK(k, "a", m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, exp[:k]) {
+			t.Fatalf("top %d: expected %v but got %v", k, exp[:k], res)
+		}
+	}
+}
+
+func TestFacets(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b.Add(Terms{
+			{Field: "job", Val: "api"},
+			{Field: "instance", Val: fmt.Sprint(i % 3)},
+			{Field: "env", Val: fmt.Sprint(i % 2)},
+		})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("env", NewEqualMatcher("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ix.Facets(it, "instance", "job", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]map[string]int{
+		"instance": {"0": 2, "1": 1, "2": 2},
+		"job":      {"api": 5},
+		"missing":  {},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	for _, c := range []struct {
+		sels []Selector
+		exp  int
+	}{
+		{sels: []Selector{{"env", NewEqualMatcher("1")}}, exp: 3},
+		{sels: []Selector{{"env", NewEqualMatcher("0")}, {"job", NewEqualMatcher("api")}}, exp: 3},
+		{sels: []Selector{{"instance", NewEqualMatcher("1")}}, exp: 1},
+		{sels: []Selector{{"env", NewEqualMatcher("2")}}, exp: 0},
+		{exp: 3},
+	} {
+		n, err := ix.CountValues("instance", c.sels...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != c.exp {
+			t.Fatalf("expected %d distinct instances for %v but got %d", c.exp, c.sels, n)
+		}
+		if n, err = q.CountValues("instance", c.sels...); err != nil {
+			t.Fatal(err)
+		}
+		if n != c.exp {
+			t.Fatalf("expected %d distinct instances for %v in querier but got %d", c.exp, c.sels, n)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		terms := Terms{
+			{Field: "job", Val: "api"},
+			{Field: "env", Val: fmt.Sprint(i % 2)},
+		}
+		if i < 4 {
+			terms = append(terms, Term{Field: "instance", Val: fmt.Sprint(i % 3)})
+		}
+		b.Add(terms)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("job", NewEqualMatcher("api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ix.GroupBy(it, "env", "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string][]DocID{
+		`env="0",instance="0"`: {1},
+		`env="1",instance="1"`: {2},
+		`env="0",instance="2"`: {3},
+		`env="1",instance="0"`: {4},
+		`env="0",instance=""`:  {5},
+		`env="1",instance=""`:  {6},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	n, err := ix.IngestJSON(strings.NewReader(`
+		{"job": "api", "instance": "a"}
+		{"job": "api", "instance": "b"}
+		{"instance": "a", "job": "api"}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records but got %d", n)
+	}
+	n, err = ix.IngestCSV(strings.NewReader("job,instance,env\napi,a,\ndb,c,prod\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 records but got %d", n)
+	}
+	// Records with equal terms share a document.
+	if ix.meta.LastDocID != 3 {
+		t.Fatalf("expected 3 documents but got %d", ix.meta.LastDocID)
+	}
+	terms, err := ix.Doc(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := Terms{{Field: "env", Val: "prod"}, {Field: "instance", Val: "c"}, {Field: "job", Val: "db"}}
+	if !reflect.DeepEqual(terms, exp) {
+		t.Fatalf("expected %v but got %v", exp, terms)
+	}
+	if _, err := ix.IngestJSON(strings.NewReader(`{"job": 1}`)); err == nil {
+		t.Fatalf("expected error for invalid record")
+	}
+}
+
+func TestDump(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Scores: true})
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := Term{Field: "a", Val: "x"}
+	for i := 0; i < 3; i++ {
+		b.SetScore(b.Add(Terms{term}), term, uint8(i))
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var buf bytes.Buffer
+	if err := q.Dump(&buf, term); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected 6 lines but got %q", lines)
+	}
+	if exp := `term a="x" id=1 encoding=delta+score postings=3`; lines[0] != exp {
+		t.Fatalf("expected %q but got %q", exp, lines[0])
+	}
+	exp := fmt.Sprintf("first=1 max_score=2 ids=3 bytes=6/%d", pageSize-pagebuf.PageHeaderSize)
+	if !strings.HasSuffix(lines[1], exp) {
+		t.Fatalf("expected page line ending in %q but got %q", exp, lines[1])
+	}
+	if exp := []string{"  1:0", "  2:1", "  3:2", ""}; !reflect.DeepEqual(lines[2:], exp) {
+		t.Fatalf("expected %q but got %q", exp, lines[2:])
+	}
+	if err := q.Dump(&buf, Term{Field: "a", Val: "y"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unknown term but got %v", err)
+	}
+}
+
+func TestBackupSince(t *testing.T) {
+	src, cleanup := openTestIndex(t, &Options{History: true})
+	defer cleanup()
+	dst, cleanup2 := openTestIndex(t, nil)
+	defer cleanup2()
+
+	add := func(n int) []DocID {
+		docs := make([]Terms, n)
+		for i := range docs {
+			docs[i] = Terms{{"a", "x"}, {"b", fmt.Sprint(i % 3)}}
+		}
+		ids, err := src.Add(docs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	backup := func(gen uint64) (uint64, *bytes.Buffer) {
+		var buf bytes.Buffer
+		next, err := src.BackupSince(gen, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.ApplyBackup(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		return next, &buf
+	}
+	check := func(extra ...Term) {
+		for _, term := range append([]Term{{"b", "0"}, {"b", "1"}, {"b", "2"}, {"c", "y"}}, extra...) {
+			exp, err := src.Search(term.Field, NewEqualMatcher(term.Val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := dst.Search(term.Field, NewEqualMatcher(term.Val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, exp) {
+				t.Fatalf("%s=%s: expected %v, got %v", term.Field, term.Val, exp, res)
+			}
+		}
+	}
+	ids := add(10)
+	b, err := src.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SecondaryIndex(ids[0], Term{"c", "y"})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	gen, _ := backup(0)
+	check()
+
+	add(5)
+	if _, err := src.SoftDelete(newPlainListIterator(ids[1:3])); err != nil {
+		t.Fatal(err)
+	}
+	next, buf := backup(gen)
+	check()
+
+	if next != src.Generation() {
+		t.Fatalf("expected backup to end with generation %d, got %d", src.Generation(), next)
+	}
+	// Only the changes are part of the backup.
+	if n := strings.Count(buf.String(), "\n"); n != 6 {
+		t.Fatalf("expected header and 5 documents, got %d lines", n)
+	}
+	if err := dst.ApplyBackup(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected error applying backup twice")
+	}
+	if _, err := src.BackupSince(next+1, ioutil.Discard); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unknown generation, got %v", err)
+	}
+
+	// Postings added to earlier documents and undeletions are part of
+	// incremental backups.
+	b, err = src.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := b.Add(Terms{{"a", "x"}, {"b", "0"}})
+	b.SecondaryIndex(ids[4], Term{"d", "z"})
+	b.SecondaryIndex(id, Term{"d", "z"})
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Undelete(newPlainListIterator(ids[1:2])); err != nil {
+		t.Fatal(err)
+	}
+	backup(next)
+	check(Term{"d", "z"})
+}
+
+func TestDiff(t *testing.T) {
+	a, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+	b, cleanup2 := openTestIndex(t, nil)
+	defer cleanup2()
+
+	if _, err := a.Add(
+		Terms{{"a", "1"}, {"b", "x"}},
+		Terms{{"b", "y"}, {"a", "2"}},
+		Terms{{"a", "3"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add(
+		Terms{{"a", "1"}, {"b", "x"}},
+		Terms{{"a", "2"}, {"b", "z"}},
+		Terms{{"a", "3"}},
+		Terms{{"a", "4"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	qa, err := a.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qa.Close()
+	qb, err := b.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qb.Close()
+
+	d, err := Diff(qa, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &IndexDiff{
+		OnlyA: []Terms{{{"a", "2"}, {"b", "y"}}},
+		OnlyB: []Terms{{{"a", "2"}, {"b", "z"}}, {{"a", "4"}}},
+		Changed: []DocDiff{
+			{ID: 2, A: Terms{{"a", "2"}, {"b", "y"}}, B: Terms{{"a", "2"}, {"b", "z"}}},
+			{ID: 4, B: Terms{{"a", "4"}}},
+		},
+		Postings: []PostingsDiff{
+			{Term: Term{"a", "4"}, A: 0, B: 1},
+			{Term: Term{"b", "y"}, A: 1, B: 0},
+			{Term: Term{"b", "z"}, A: 0, B: 1},
+		},
+	}
+	if !reflect.DeepEqual(d, exp) {
+		t.Fatalf("expected diff\n%+v\ngot\n%+v", exp, d)
+	}
+	if d, err := Diff(qa, qa); err != nil || !d.Empty() {
+		t.Fatalf("expected no differences to itself, got %+v (%v)", d, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2500; i++ {
+		id := b.Add(Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i % 3)},
+		})
+		if i%10 == 0 {
+			b.SecondaryIndex(id, Term{Field: "c", Val: "y"})
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	export := func(ix *Index) []byte {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		var buf bytes.Buffer
+		if err := q.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	exp := export(ix)
+
+	restored, cleanupRestored := openTestIndex(t, nil)
+	defer cleanupRestored()
+
+	if err := restored.Import(bytes.NewReader(exp)); err != nil {
+		t.Fatal(err)
+	}
+	if res := export(restored); !bytes.Equal(res, exp) {
+		t.Fatalf("export of restored index does not match")
+	}
+	q, err := restored.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, c := range []struct {
+		key, val string
+		n        int
+	}{
+		{"a", "x", 2500},
+		{"b", "0", 834},
+		{"c", "y", 250},
+	} {
+		it, err := q.Search(c.key, NewEqualMatcher(c.val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != c.n {
+			t.Fatalf("%s=%s: expected %d results but got %d", c.key, c.val, c.n, len(res))
+		}
+	}
+	// Documents cannot be imported into an index holding other documents.
+	if err := restored.Import(bytes.NewReader(exp)); err == nil {
+		t.Fatalf("expected error importing into non-empty index")
+	}
+}
+
+func TestExportWithoutCounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		id := b.Add(Terms{{Field: "a", Val: fmt.Sprint(i % 3)}})
+		if i%10 == 0 {
+			b.SecondaryIndex(id, Term{Field: "c", Val: "y"})
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	export := func(ix *Index) []byte {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		var buf bytes.Buffer
+		if err := q.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	exp := export(ix)
+
+	// Indexes created before postings were counted have no counts bucket.
+	// Read-only opens do not create it.
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(bktCounts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err = Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if res := export(ix); !bytes.Equal(res, exp) {
+		t.Fatalf("export without counts does not match")
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if _, err := q.Explain("a", NewEqualMatcher("1")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound explaining without counts but got %v", err)
+	}
+}
+func TestBundle(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		b.Add(Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i % 4)},
+		})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "tindex_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := ix.Bundle(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bix, err := OpenBundle(f.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := bix.tmpdir
+
+	q, err := bix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := q.Search("b", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ExpandIterator(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 250 {
+		t.Fatalf("expected 250 results but got %d", len(res))
+	}
+	q.Close()
+
+	if _, err := bix.Batch(); err == nil {
+		t.Fatalf("expected error writing to bundle")
+	}
+	m, err := ix.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm, err := bix.Meta(); err != nil || bm.UUID != m.UUID {
+		t.Fatalf("expected bundle meta with UUID %s, got %+v (%v)", m.UUID, bm, err)
+	}
+	if err := bix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected bundle directory to be removed, got %v", err)
+	}
+
+	// Archives missing a store are rejected.
+	g, err := ioutil.TempFile("", "tindex_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(g.Name())
+	g.Close()
+
+	if _, err := OpenBundle(g.Name(), nil); err == nil {
+		t.Fatalf("expected error opening empty bundle")
+	}
+}
+
+func TestQuerierValuesExplain(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b.Add(Terms{{Field: "a", Val: fmt.Sprint(i % 3)}, {Field: "ab", Val: "x"}})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if res, exp := q.Values("a"), []string{"0", "1", "2"}; !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected values %v but got %v", exp, res)
+	}
+	res, err := q.Explain("a", Inverse(NewEqualMatcher("1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []TermCount{
+		{Term: Term{Field: "a", Val: "0"}, Docs: 4},
+		{Term: Term{Field: "a", Val: "2"}, Docs: 3},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+}
+
+func TestSeriesByTag(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, terms := range []Terms{
+		{{Field: "name", Val: "cpu"}, {Field: "host", Val: "web1"}, {Field: "dc", Val: "east"}},
+		{{Field: "name", Val: "cpu"}, {Field: "host", Val: "web2"}, {Field: "dc", Val: "west"}},
+		{{Field: "name", Val: "cpu"}, {Field: "host", Val: "db1"}},
+		{{Field: "name", Val: "mem"}, {Field: "host", Val: "web1"}, {Field: "dc", Val: "east"}},
+	} {
+		b.Add(terms)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, c := range []struct {
+		exprs []string
+		res   []DocID
+	}{
+		{exprs: []string{"name=cpu"}, res: []DocID{1, 2, 3}},
+		{exprs: []string{"name=cpu", "host=~web"}, res: []DocID{1, 2}},
+		// Regular expressions are anchored at the start.
+		{exprs: []string{"name=cpu", "host=~eb"}, res: nil},
+		{exprs: []string{"name=cpu", "dc!=east"}, res: []DocID{2, 3}},
+		{exprs: []string{"host=~.*", "dc!=~e.*"}, res: []DocID{2, 3}},
+		{exprs: []string{"name=cpu", "dc="}, res: []DocID{3}},
+		{exprs: []string{"name=~.*", "dc!="}, res: []DocID{1, 2, 4}},
+	} {
+		it, err := q.SeriesByTag(c.exprs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []DocID
+		if it != nil {
+			if res, err = ExpandIterator(it); err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				res = nil
+			}
+		}
+		if !reflect.DeepEqual(res, c.res) {
+			t.Fatalf("%v: expected %v but got %v", c.exprs, c.res, res)
+		}
+	}
+	for _, exprs := range [][]string{{"dc!=east"}, {"name"}, {"name=~("}} {
+		if _, err := q.SeriesByTag(exprs...); err == nil {
+			t.Fatalf("%v: expected error", exprs)
+		}
+	}
+}
+
+func TestMeasurements(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(MeasurementTerms("cpu", map[string]string{"host": "a", "region": "east"}))
+	b.Add(MeasurementTerms("cpu", map[string]string{"host": "b"}))
+	b.Add(MeasurementTerms("mem", map[string]string{"host": "c", "dc": "x"}))
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	keys, err := q.ShowTagKeys("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"host", "region"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected tag keys %v but got %v", exp, keys)
+	}
+	vals, err := q.ShowTagValues("cpu", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"a", "b"}; !reflect.DeepEqual(vals, exp) {
+		t.Fatalf("expected tag values %v but got %v", exp, vals)
+	}
+	keys, err = q.ShowTagKeys("disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no tag keys for unknown measurement but got %v", keys)
+	}
+}
+
+func TestOptionsNoSync(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{NoSync: true})
+	defer cleanup()
+
+	if !ix.bolt.NoSync {
+		t.Fatalf("expected key/value store to not sync")
+	}
+}
+
+func TestTermsBuilder(t *testing.T) {
+	base := Terms{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+
+	terms, err := NewTermsBuilder(base).Set("b", "4").Del("c").Set("d", "5").Terms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := Terms{{"a", "1"}, {"b", "4"}, {"d", "5"}}
+	if !reflect.DeepEqual(terms, exp) {
+		t.Fatalf("expected %v but got %v", exp, terms)
+	}
+	for _, b := range []*TermsBuilder{
+		NewTermsBuilder(nil).Set("", "1"),
+		NewTermsBuilder(nil).Set("a", ""),
+		NewTermsBuilder(nil).Set("a\n", "1"),
+		NewTermsBuilder(Terms{{"a", "1"}, {"a", "2"}}),
+	} {
+		if _, err := b.Terms(); err == nil {
+			t.Fatalf("expected error for invalid terms")
+		}
+	}
+}
+
+func TestDocs(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []Terms{
+		{{"a", "1"}, {"b", "1"}},
+		{{"a", "1"}, {"b", "2"}},
+	}
+	var ids []DocID
+	for _, d := range docs {
+		ids = append(ids, b.Add(d))
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ix.Docs(ids[1], 100, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res[0].Terms, docs[1]) || res[0].Err != nil {
+		t.Fatalf("expected %v but got %v, %v", docs[1], res[0].Terms, res[0].Err)
+	}
+	if !errors.Is(res[1].Err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", res[1].Err)
+	}
+	if !reflect.DeepEqual(res[2].Terms, docs[0]) || res[2].Err != nil {
+		t.Fatalf("expected %v but got %v, %v", docs[0], res[2].Terms, res[2].Err)
+	}
+
+	terms, err := ix.Doc(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(terms, docs[0]) {
+		t.Fatalf("expected %v but got %v", docs[0], terms)
+	}
+}
+
+func TestBatchEnsure(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, created := b.Ensure(Terms{{"a", "1"}, {"b", "1"}})
+	if !created {
+		t.Fatalf("expected document to be created")
+	}
+	// Terms in a different order identify the same document.
+	if id, created := b.Ensure(Terms{{"b", "1"}, {"a", "1"}}); created || id != id1 {
+		t.Fatalf("expected existing document %d but got %d, created %v", id1, id, created)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys of existing documents must be rebuilt if they are missing.
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(bktDocKeys)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.update(ix.initDocKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Rollback()
+
+	if id, created := b.Ensure(Terms{{"a", "1"}, {"b", "1"}}); created || id != id1 {
+		t.Fatalf("expected existing document %d but got %d, created %v", id1, id, created)
+	}
+	for _, terms := range []Terms{
+		{{"a", "1"}},
+		{{"a", "1"}, {"b", "1"}, {"c", "1"}},
+	} {
+		if _, created := b.Ensure(terms); !created {
+			t.Fatalf("expected document %v to be created", terms)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{GroupCommitDelay: time.Hour, NoSync: true})
+	defer cleanup()
+
+	res := ix.AddAsync(Terms{{Field: "a", Val: "x"}})
+
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatalf("unexpected error closing twice: %s", err)
+	}
+	if r := <-res; r.Err != nil {
+		t.Fatalf("queued request failed: %s", r.Err)
+	}
+
+	ix, err := Open(ix.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if ix.meta.LastDocID != 1 {
+		t.Fatalf("expected queued document to be committed")
+	}
+}
+
+func TestStore(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	re, err := NewRegexpMatcher("1|2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The in-memory store must behave like the index.
+	for _, s := range []Store{ix, NewMemStore()} {
+		ids, err := s.Add(
+			Terms{{"a", "1"}, {"b", "1"}},
+			Terms{{"a", "2"}},
+			Terms{{"a", "3"}, {"b", "1"}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := []DocID{1, 2, 3}; !reflect.DeepEqual(ids, exp) {
+			t.Fatalf("%T: expected IDs %v but got %v", s, exp, ids)
+		}
+		for _, c := range []struct {
+			key string
+			m   Matcher
+			exp []DocID
+		}{
+			{"a", re, []DocID{1, 2}},
+			{"b", NewEqualMatcher("1"), []DocID{1, 3}},
+			{"c", NewEqualMatcher("1"), []DocID{}},
+		} {
+			res, err := s.Search(c.key, c.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, c.exp) {
+				t.Fatalf("%T: expected %v for key %q but got %v", s, c.exp, c.key, res)
+			}
+		}
+		docs, err := s.Docs(2, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := (Terms{{"a", "2"}}); !reflect.DeepEqual(docs[0].Terms, exp) {
+			t.Fatalf("%T: expected %v but got %v", s, exp, docs[0].Terms)
+		}
+		if !errors.Is(docs[1].Err, ErrNotFound) {
+			t.Fatalf("%T: expected ErrNotFound but got %v", s, docs[1].Err)
+		}
+	}
+}
+
+func TestMatcherInverse(t *testing.T) {
+	re, err := NewRegexpMatcher("a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		m        Matcher
+		str, inv string
+		val      string
+	}{
+		{NewEqualMatcher("a"), `="a"`, `!="a"`, "a"},
+		{re, `=~"a.*"`, `!~"a.*"`, "ab"},
+	} {
+		if s := c.m.String(); s != c.str {
+			t.Fatalf("expected %s but got %s", c.str, s)
+		}
+		inv := Inverse(c.m)
+		if s := inv.String(); s != c.inv {
+			t.Fatalf("expected %s but got %s", c.inv, s)
+		}
+		if !c.m.Match(c.val) || inv.Match(c.val) {
+			t.Fatalf("%s: unexpected inverse match for %q", c.m, c.val)
+		}
+		if Inverse(inv) != c.m {
+			t.Fatalf("%s: expected double inverse to return the matcher", c.m)
+		}
+	}
+}
+
+func TestPageLasts(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	// Every other document has the term so that pages are followed by gaps.
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		b.Add(Terms{{"a", fmt.Sprint(i % 2)}})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := Term{"a", "0"}
+	tid := newTermID(q.termBkt.Get(term.bytes()))
+
+	var firsts, pids []uint64
+	err = q.skiplists.cursor(tid).forEach(func(d DocID, v []byte) error {
+		firsts = append(firsts, uint64(d))
+		pids = append(pids, decodeUint64(v))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pids) < 2 {
+		t.Fatalf("expected several pages, got %d", len(pids))
+	}
+	last, ok := q.pageLast(pids[0])
+	if !ok {
+		t.Fatal("expected last ID of first page")
+	}
+	if _, ok := q.pageLast(pids[len(pids)-1]); ok {
+		t.Fatal("unexpected last ID of tail page")
+	}
+	q.Close()
+
+	seek := func(id DocID) (DocID, int) {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		qs := &queryStats{}
+		it, err := q.postingsIter(tid, qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := it.Seek(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, qs.pages
+	}
+	// The first page cannot hold the ID following its last one.
+	if id, pages := seek(last + 1); id != DocID(firsts[1]) || pages != 1 {
+		t.Fatalf("expected ID %d after reading 1 page, got %d after %d", firsts[1], id, pages)
+	}
+	if id, pages := seek(last); id != last || pages != 1 {
+		t.Fatalf("expected ID %d after reading 1 page, got %d after %d", last, id, pages)
+	}
+
+	// Indexes without last IDs of pages are backfilled.
+	dump := func() map[string]string {
+		res := map[string]string{}
+		err := ix.bolt.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(bktPageLasts).ForEach(func(k, v []byte) error {
+				res[string(k)] = string(v)
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	exp := dump()
+	if len(exp) == 0 {
+		t.Fatal("expected last IDs of full pages")
+	}
+	err = ix.update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bktPageLasts); err != nil {
+			return err
+		}
+		return ix.initPageLasts(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected backfilled entries %v, got %v", exp, got)
+	}
+}
+
+func TestLastID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	add := func(ix *Index, n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{
+				{Field: "a", Val: "x"},
+				{Field: "b", Val: fmt.Sprint(i % 2)},
+			})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(ix *Index) {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		for _, term := range []Term{{"a", "x"}, {"b", "0"}, {"b", "1"}, {"c", "y"}} {
+			res, err := ix.Search(term.Field, NewEqualMatcher(term.Val))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var exp DocID
+			if len(res) > 0 {
+				exp = res[len(res)-1]
+			}
+			last, err := q.LastID(term)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != exp {
+				t.Fatalf("%s=%s: expected last ID %d but got %d", term.Field, term.Val, exp, last)
+			}
+		}
+	}
+
+	ix, err := Open(dir, &Options{TailBuffer: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		add(ix, 30)
+		check(ix)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Last IDs are maintained once the tail buffers are flushed and are
+	// backfilled for indexes that did not record them.
+	ix, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(ix, 2000)
+	check(ix)
+
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(bktLastIDs)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(ro)
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	check(ix)
+
+	add(ix, 10)
+	check(ix)
+}
+
+func TestMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(opts *Options) Meta {
+		ix, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+
+		m, err := ix.Meta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := open(&Options{Scores: true, Logger: &testLogger{}})
+
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(m.UUID) {
+		t.Fatalf("invalid UUID %q", m.UUID)
+	}
+	if m.Version != FormatVersion {
+		t.Fatalf("expected version %d but got %d", FormatVersion, m.Version)
+	}
+	if !m.Options.Scores || m.Options.Logger != nil {
+		t.Fatalf("unexpected options %+v", m.Options)
+	}
+	if time.Since(m.Created) > time.Minute {
+		t.Fatalf("unexpected creation time %s", m.Created)
+	}
+
+	// The meta file is not rewritten when the index is reopened.
+	if m2 := open(&Options{ReadOnly: true}); !reflect.DeepEqual(m2, m) {
+		t.Fatalf("expected meta %+v but got %+v", m, m2)
+	}
+	if m2 := open(nil); !reflect.DeepEqual(m2, m) {
+		t.Fatalf("expected meta %+v but got %+v", m, m2)
+	}
+
+	// Indexes without a meta file are assigned a new one when opened writable.
+	if err := os.Remove(filepath.Join(dir, metaFile)); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Meta(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+	ix.Close()
+
+	if m2 := open(nil); m2.UUID == m.UUID {
+		t.Fatalf("expected new UUID")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "ix")
+		pbs  = filepath.Join(dir, "postings")
+		opts = &Options{
+			DirMode:     0750,
+			FileMode:    0640,
+			KVDir:       "state",
+			PostingsDir: pbs,
+		}
+	)
+	ix, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Add(Terms{{"a", "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ix.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	cdir := filepath.Join(dir, "clone")
+	if err := ix.CloneTo(cdir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{path: filepath.Join(path, "state"), mode: os.ModeDir | 0750},
+		{path: filepath.Join(path, "state", "kv"), mode: 0640},
+		{path: filepath.Join(pbs, "pb"), mode: 0640},
+		{path: filepath.Join(path, "lock"), mode: 0640},
+		{path: filepath.Join(path, metaFile), mode: 0640},
+		// Stores outside of the index directory are not shared by clones.
+		{path: filepath.Join(cdir, "state", "kv"), mode: 0640},
+		{path: filepath.Join(cdir, "pb"), mode: 0640},
+	} {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The umask may remove permissions.
+		if fi.Mode()&^c.mode != 0 || fi.Mode().IsDir() != c.mode.IsDir() {
+			t.Fatalf("%s: expected mode %s, got %s", c.path, c.mode, fi.Mode())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "pb")); !os.IsNotExist(err) {
+		t.Fatalf("expected no page store in index directory, got %v", err)
+	}
+
+	ix, err = Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	cix, err := Open(cdir, &Options{KVDir: "state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cix.Close()
+
+	for _, ix := range []*Index{ix, cix} {
+		if res, err := ix.Search("a", NewEqualMatcher("x")); err != nil || len(res) != 1 {
+			t.Fatalf("expected 1 result, got %v (%v)", res, err)
+		}
+	}
+}
+
+func TestCloneTo(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{BloomFilters: true})
+	defer cleanup()
+
+	add := func(ix *Index, n int) {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			b.Add(Terms{
+				{Field: "a", Val: "x"},
+				{Field: "b", Val: fmt.Sprint(i % 4)},
+			})
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(ix *Index) int {
+		res, err := ix.Search("a", NewEqualMatcher("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res)
+	}
+	add(ix, 1000)
+
+	dir, err := ioutil.TempDir("", "tindex_clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ix.CloneTo(dir); err == nil {
+		t.Fatalf("expected error cloning into existing directory")
+	}
+	cdir := filepath.Join(dir, "clone")
+	if err := ix.CloneTo(cdir); err != nil {
+		t.Fatal(err)
+	}
+	cix, err := Open(cdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cix.Close()
+
+	m, err := ix.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := cix.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.UUID == m.UUID {
+		t.Fatalf("expected clone to have a new UUID")
+	}
+	if !cm.Options.BloomFilters {
+		t.Fatalf("expected clone to keep the options of the index")
+	}
+
+	// Both copies are modified independently.
+	add(cix, 500)
+	add(ix, 10)
+
+	if n := count(ix); n != 1010 {
+		t.Fatalf("expected 1010 documents in index but got %d", n)
+	}
+	if n := count(cix); n != 1500 {
+		t.Fatalf("expected 1500 documents in clone but got %d", n)
+	}
+}
+
+func TestMultiIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{filepath.Join(dir, "0"), filepath.Join(dir, "1")}
+	parts := [][]Terms{
+		{
+			{{"job", "api"}, {"instance", "a"}},
+			{{"job", "api"}, {"instance", "b"}},
+			{{"job", "db"}, {"instance", "c"}},
+		},
+		{
+			// Added to both partitions with a different ID and term order.
+			{{"instance", "b"}, {"job", "api"}},
+			{{"job", "api"}, {"instance", "d"}},
+		},
+	}
+	for i, p := range paths {
+		ix, err := Open(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ix.Add(parts[i]...); err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := OpenMulti(append(paths, filepath.Join(dir, "missing")), &Options{ReadOnly: true}); err == nil {
+		t.Fatalf("expected error opening missing index")
+	}
+	mi, err := OpenMulti(paths, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mi.Close()
+
+	docs, err := mi.Search("job", NewEqualMatcher("api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Terms{
+		{{"instance", "a"}, {"job", "api"}},
+		{{"instance", "b"}, {"job", "api"}},
+		{{"instance", "d"}, {"job", "api"}},
+	}
+	if !reflect.DeepEqual(docs, exp) {
+		t.Fatalf("expected %v but got %v", exp, docs)
+	}
+
+	vals, err := mi.Values("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(vals, exp) {
+		t.Fatalf("expected values %v but got %v", exp, vals)
+	}
+}
+
+func TestSharder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for i := 0; i < 4; i++ {
+		paths = append(paths, filepath.Join(dir, fmt.Sprint(i)))
+	}
+	if _, err := OpenSharder(nil, nil); err == nil {
+		t.Fatalf("expected error opening sharder without shards")
+	}
+	s, err := OpenSharder(paths, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var docs []Terms
+	for i := 0; i < 200; i++ {
+		docs = append(docs, Terms{
+			{Field: "a", Val: "x"},
+			{Field: "b", Val: fmt.Sprint(i % 4)},
+			{Field: "c", Val: fmt.Sprint(i)},
+		})
+	}
+	ids, err := s.Add(docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Documents are spread across shards.
+	shards := map[int]bool{}
+	for _, id := range ids {
+		k, _ := splitDocID(id)
+		shards[k] = true
+	}
+	if len(shards) != len(paths) {
+		t.Fatalf("expected documents in %d shards but got %d", len(paths), len(shards))
+	}
+	// Routing does not depend on the order of terms.
+	if s.shard(Terms{{"b", "1"}, {"a", "x"}}) != s.shard(Terms{{"a", "x"}, {"b", "1"}}) {
+		t.Fatalf("expected equal shards for reordered terms")
+	}
+
+	res, err := s.Search("b", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 50 {
+		t.Fatalf("expected 50 results but got %d", len(res))
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i] <= res[i-1] {
+			t.Fatalf("results out of order at %d", i)
+		}
+	}
+
+	drs, err := s.Docs(append(ids, shardDocID(len(paths), 1))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range docs {
+		if drs[i].Err != nil {
+			t.Fatal(drs[i].Err)
+		}
+		if !reflect.DeepEqual(drs[i].Terms, d) {
+			t.Fatalf("expected document %v but got %v", d, drs[i].Terms)
+		}
+	}
+	if !errors.Is(drs[len(docs)].Err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unknown shard but got %v", drs[len(docs)].Err)
+	}
+
+	vals, err := s.Values("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"0", "1", "2", "3"}; !reflect.DeepEqual(vals, exp) {
+		t.Fatalf("expected values %v but got %v", exp, vals)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{
+		TenantField:       "tenant",
+		MaxTenantDocs:     3,
+		MaxTenantDocTerms: 3,
+	})
+	defer cleanup()
+
+	commit := func(docs ...Terms) error {
+		b, err := ix.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range docs {
+			b.Ensure(d)
+		}
+		return b.Commit()
+	}
+	doc := func(tenant string, i int) Terms {
+		return Terms{{"tenant", tenant}, {"a", fmt.Sprint(i)}}
+	}
+	if err := commit(doc("x", 0), doc("x", 1)); err != nil {
+		t.Fatal(err)
+	}
+	// Existing documents do not count against the quota again.
+	if err := commit(doc("x", 0), doc("x", 2), doc("y", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(doc("x", 3)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded but got %v", err)
+	}
+	if err := commit(doc("y", 1), doc("y", 2), doc("y", 3)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded but got %v", err)
+	}
+	if err := commit(Terms{{"tenant", "y"}, {"a", "1"}, {"b", "1"}, {"c", "1"}}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded but got %v", err)
+	}
+	// Documents without a tenant are not limited.
+	if err := commit(
+		Terms{{"a", "1"}, {"b", "1"}, {"c", "1"}, {"d", "1"}},
+		Terms{{"a", "2"}}, Terms{{"a", "3"}}, Terms{{"a", "4"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ix.Search("tenant", NewEqualMatcher("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("expected 1 document of tenant y but got %d", len(res))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	l := newRateLimiter(10, 5)
+	l.now = func() time.Time { return now }
+
+	if !l.allow(3) || !l.allow(2) {
+		t.Fatalf("expected burst to be allowed")
+	}
+	if l.allow(1) {
+		t.Fatalf("expected exhausted limiter to reject")
+	}
+	now = now.Add(300 * time.Millisecond)
+	if !l.allow(3) || l.allow(1) {
+		t.Fatalf("expected 3 tokens after 300ms")
+	}
+	// A full bucket admits batches larger than the burst.
+	now = now.Add(time.Hour)
+	if !l.allow(20) || l.allow(1) {
+		t.Fatalf("expected oversized batch to be allowed once")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+
+	ix, cleanup := openTestIndex(t, &Options{MaxAddRate: 1, AddBurst: 10, FailOnRateLimit: true})
+	defer cleanup()
+
+	docs := make([]Terms, 10)
+	for i := range docs {
+		docs[i] = Terms{{"a", fmt.Sprint(i)}}
+	}
+	if _, err := ix.Add(docs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Add(docs[0]); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited but got %v", err)
+	}
+
+	// Without FailOnRateLimit, commits wait for the rate.
+	wix, wcleanup := openTestIndex(t, &Options{MaxAddRate: 1000, AddBurst: 10})
+	defer wcleanup()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := wix.Add(docs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("expected commits to be delayed by the rate, took %s", d)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{Strict: true})
+	defer cleanup()
+
+	docs := make([]Terms, 10)
+	for i := range docs {
+		docs[i] = Terms{{"a", "x"}, {"b", fmt.Sprint(i % 2)}}
+	}
+	ids, err := ix.Add(docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func() []DocID {
+		res, err := ix.Search("a", NewEqualMatcher("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	n, err := ix.SoftDelete(newPlainListIterator([]DocID{ids[1], ids[3], ids[4]}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 deleted documents but got %d", n)
+	}
+	// Deleting again does not change anything.
+	if n, err = ix.SoftDelete(newPlainListIterator([]DocID{ids[1]})); err != nil || n != 0 {
+		t.Fatalf("expected no newly deleted documents but got %d (%v)", n, err)
+	}
+	exp := []DocID{ids[0], ids[2], ids[5], ids[6], ids[7], ids[8], ids[9]}
+	if res := search(); !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := ExpandIterator(q.Deleted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []DocID{ids[1], ids[3], ids[4]}; !reflect.DeepEqual(deleted, exp) {
+		t.Fatalf("expected deleted documents %v but got %v", exp, deleted)
+	}
+	if at, ok := q.DeletedAt(ids[1]); !ok || time.Since(at) > time.Minute {
+		t.Fatalf("unexpected deletion time %s (%v)", at, ok)
+	}
+	if _, ok := q.DeletedAt(ids[0]); ok {
+		t.Fatalf("expected document %d not to be deleted", ids[0])
+	}
+	if ok, err := q.Contains(Term{"b", "1"}, ids[1]); err != nil || ok {
+		t.Fatalf("expected deleted document not to be contained (%v)", err)
+	}
+	q.Close()
+
+	// Deleted documents are retained.
+	if d, err := ix.Doc(ids[1]); err != nil || !reflect.DeepEqual(d, docs[1]) {
+		t.Fatalf("expected deleted document %v but got %v (%v)", docs[1], d, err)
+	}
+
+	n, err = ix.Undelete(newPlainListIterator([]DocID{ids[0], ids[1], ids[3], ids[4]}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 restored documents but got %d", n)
+	}
+	if res := search(); !reflect.DeepEqual(res, ids) {
+		t.Fatalf("expected %v but got %v", ids, res)
+	}
+
+	// Deletions are committed along with other changes of a batch.
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := b.Add(Terms{{"a", "x"}})
+	b.SoftDelete(id, ids[0])
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if res := search(); !reflect.DeepEqual(res, ids[1:]) {
+		t.Fatalf("expected %v but got %v", ids[1:], res)
+	}
+
+	b, err = ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SoftDelete(1000)
+	if err := b.Commit(); err == nil {
+		t.Fatalf("expected error deleting unknown document")
+	}
+}
+
+func TestRewriteTerms(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []DocID
+	for i := 0; i < 1500; i++ {
+		ids = append(ids, b.Add(Terms{
+			{"job", "api"},
+			{"instance", fmt.Sprintf("host-%d:9090", i%3)},
+		}))
+	}
+	b.SecondaryIndex(ids[7], Term{"instance", "alias"})
+	b.SoftDelete(ids[0])
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tindex_rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ix.RewriteTerms(dir, nil, nil); err == nil {
+		t.Fatalf("expected error rewriting into existing directory")
+	}
+	rdir := filepath.Join(dir, "ix")
+
+	// Strip the port from the renamed field.
+	err = ix.RewriteTerms(rdir, map[string]string{"instance": "host"}, func(terms Terms) Terms {
+		for i, t := range terms {
+			if t.Field == "host" {
+				terms[i].Val = strings.Split(t.Val, ":")[0]
+			}
+		}
+		return terms
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rix, err := Open(rdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rix.Close()
+
+	d, err := rix.Doc(ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (Terms{{"job", "api"}, {"host", "host-1"}}); !reflect.DeepEqual(d, exp) {
+		t.Fatalf("expected document %v but got %v", exp, d)
+	}
+	res, err := rix.Search("host", NewEqualMatcher("host-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first document remains soft-deleted.
+	if len(res) != 499 || res[0] != ids[3] {
+		t.Fatalf("unexpected results %d, starting at %v", len(res), res[:1])
+	}
+	res, err = rix.Search("host", NewEqualMatcher("alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []DocID{ids[7]}) {
+		t.Fatalf("expected secondary posting for %d but got %v", ids[7], res)
+	}
+	q, err := rix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if vals := q.Values("instance"); len(vals) != 0 {
+		t.Fatalf("expected no values for renamed field but got %v", vals)
+	}
+}
+
+func TestVirtualFields(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{
+		VirtualFields: map[string]VirtualField{
+			"region": MapField("zone", map[string]string{
+				"eu-west-1a": "eu",
+				"eu-west-1b": "eu",
+				"us-east-1a": "us",
+			}),
+			"rack": {
+				Source: "host",
+				Value:  func(v string) string { return strings.SplitN(v, "-", 2)[0] },
+			},
+		},
+	})
+	defer cleanup()
+
+	docs := []Terms{
+		{{"zone", "eu-west-1a"}, {"host", "r1-a"}},
+		{{"zone", "us-east-1a"}, {"host", "r2-a"}},
+		{{"zone", "eu-west-1b"}, {"host", "r1-b"}},
+		{{"zone", "ap-south-1a"}, {"host", "r3-a"}},
+	}
+	ids, err := ix.Add(docs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Meta(); err != nil {
+		t.Fatal(err)
+	}
+	re, err := NewRegexpMatcher("r[13]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key string
+		m   Matcher
+		exp []DocID
+	}{
+		{"region", NewEqualMatcher("eu"), []DocID{ids[0], ids[2]}},
+		{"region", NewEqualMatcher("us"), []DocID{ids[1]}},
+		// Source values without a mapping have no virtual value.
+		{"region", Inverse(NewEqualMatcher("eu")), []DocID{ids[1]}},
+		{"rack", re, []DocID{ids[0], ids[2], ids[3]}},
+		{"zone", NewEqualMatcher("eu-west-1b"), []DocID{ids[2]}},
+	} {
+		res, err := ix.Search(c.key, c.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, c.exp) {
+			t.Fatalf("%s%s: expected %v but got %v", c.key, c.m, c.exp, res)
+		}
+	}
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if vals, exp := q.Values("region"), []string{"eu", "us"}; !reflect.DeepEqual(vals, exp) {
+		t.Fatalf("expected values %v but got %v", exp, vals)
+	}
+	tcs, err := q.Explain("region", NewEqualMatcher("eu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []TermCount{
+		{Term: Term{"zone", "eu-west-1a"}, Docs: 1},
+		{Term: Term{"zone", "eu-west-1b"}, Docs: 1},
+	}
+	if !reflect.DeepEqual(tcs, exp) {
+		t.Fatalf("expected %v but got %v", exp, tcs)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Open(dir, &Options{Schema: &Schema{Values: map[string]string{"a": "("}}}); err == nil {
+		t.Fatalf("expected error for invalid value expression")
+	}
+	ix, cleanup := openTestIndex(t, &Options{
+		Schema: &Schema{
+			Required: []string{"job"},
+			Values:   map[string]string{"job": "[a-z_]+"},
+			MaxTerms: 3,
+		},
+	})
+	defer cleanup()
+
+	for _, c := range []struct {
+		doc Terms
+		ok  bool
+	}{
+		{doc: Terms{{"job", "api_server"}, {"instance", "a"}}, ok: true},
+		{doc: Terms{{"instance", "a"}}},
+		// Values must match entirely.
+		{doc: Terms{{"job", "api-server"}}},
+		{doc: Terms{{"job", "api"}, {"a", "1"}, {"b", "1"}, {"c", "1"}}},
+	} {
+		_, err := ix.Add(c.doc)
+		if c.ok && err != nil {
+			t.Fatalf("%v: unexpected error %v", c.doc, err)
+		}
+		if !c.ok && !errors.Is(err, ErrSchemaViolation) {
+			t.Fatalf("%v: expected ErrSchemaViolation but got %v", c.doc, err)
+		}
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := ix.Generation(); g != 0 {
+		t.Fatalf("expected generation 0 for new index, got %d", g)
+	}
+	ids, err := ix.Add(Terms{{"a", "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"a", "y"}})
+	if err := b.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if g := ix.Generation(); g != 1 {
+		t.Fatalf("expected generation 1, got %d", g)
+	}
+	if _, err := ix.SoftDelete(newPlainListIterator(ids)); err != nil {
+		t.Fatal(err)
+	}
+	if g := ix.Generation(); g != 2 {
+		t.Fatalf("expected generation 2 after deletion, got %d", g)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if g := ix.Generation(); g != 2 {
+		t.Fatalf("expected generation 2 after reopening, got %d", g)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ix, cleanup := openTestIndex(t, &Options{History: true})
+	defer cleanup()
+
+	add := func(n int) []DocID {
+		docs := make([]Terms, n)
+		for i := range docs {
+			docs[i] = Terms{{"a", "x"}}
+		}
+		ids, err := ix.Add(docs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	search := func(q *Querier) []DocID {
+		it, err := q.Search("a", NewEqualMatcher("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	ids1 := add(3)
+	ids2 := add(2)
+	if _, err := ix.SoftDelete(newPlainListIterator(ids1[:1])); err != nil {
+		t.Fatal(err)
+	}
+	add(1)
+
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist, err := q.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if len(hist) != 4 {
+		t.Fatalf("expected 4 generations but got %d", len(hist))
+	}
+	for i, g := range hist {
+		if g.Gen != uint64(i+1) {
+			t.Fatalf("expected generation %d but got %d", i+1, g.Gen)
+		}
+	}
+	if hist[1].LastDocID != ids2[1] {
+		t.Fatalf("expected last document %d in generation 2 but got %d", ids2[1], hist[1].LastDocID)
+	}
+
+	for _, c := range []struct {
+		gen uint64
+		exp []DocID
+	}{
+		{1, ids1},
+		{2, append(append([]DocID{}, ids1...), ids2...)},
+		// The deletion in generation 3 is visible from then on.
+		{3, append(append([]DocID{}, ids1[1:]...), ids2...)},
+	} {
+		q, err := ix.AsOf(c.gen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := search(q); !reflect.DeepEqual(res, c.exp) {
+			t.Fatalf("generation %d: expected %v but got %v", c.gen, c.exp, res)
+		}
+		if ok, err := q.Contains(Term{"a", "x"}, ids2[0]); err != nil || ok != (c.gen > 1) {
+			t.Fatalf("generation %d: unexpected containment %v (%v)", c.gen, ok, err)
+		}
+		_, deleted := q.DeletedAt(ids1[0])
+		if deleted != (c.gen >= 3) {
+			t.Fatalf("generation %d: unexpected deletion state %v", c.gen, deleted)
+		}
+		q.Close()
+	}
+	if _, err := ix.AsOf(10); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unknown generation but got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	ch, cancel := ix.Subscribe(
+		Selector{Field: "job", Matcher: NewEqualMatcher("api")},
+		Selector{Field: "env", Matcher: NewEqualMatcher("prod")},
+	)
+	all, cancelAll := ix.Subscribe()
+	defer cancelAll()
+
+	ids, err := ix.Add(
+		Terms{{"job", "api"}, {"env", "prod"}},
+		Terms{{"job", "api"}, {"env", "dev"}},
+		Terms{{"job", "db"}, {"env", "prod"}},
+		Terms{{"env", "prod"}, {"job", "api"}, {"x", "y"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rolled back batches are not published.
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Terms{{"job", "api"}, {"env", "prod"}})
+	if err := b.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	var got []DocID
+	for id := range ch {
+		got = append(got, id)
+	}
+	if exp := []DocID{ids[0], ids[3]}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if len(all) != len(ids) {
+		t.Fatalf("expected %d documents for empty selector, got %d", len(ids), len(all))
+	}
+	// Cancelling twice is safe and cancelled subscriptions receive nothing.
+	cancel()
+	if _, err := ix.Add(Terms{{"job", "api"}, {"env", "prod"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{TTLs: map[string]time.Duration{
+		"deployment_id": time.Hour,
+		"pod":           2 * time.Hour,
+	}}
+	if _, err := Open(filepath.Join(dir, "nohist"), &Options{Schema: schema}); err != errTTLWithoutHistory {
+		t.Fatalf("expected error for TTLs without history but got %v", err)
+	}
+	ix, err := Open(filepath.Join(dir, "ix"), &Options{Schema: schema, History: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	ids, err := ix.Add(
+		Terms{{"job", "api"}},
+		Terms{{"job", "api"}, {"deployment_id", "d1"}},
+		Terms{{"job", "api"}, {"deployment_id", "d2"}, {"pod", "p1"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for _, c := range []struct {
+		at  time.Duration
+		n   int
+		exp []DocID
+	}{
+		{at: 30 * time.Minute, n: 0, exp: ids},
+		{at: 90 * time.Minute, n: 1, exp: []DocID{ids[0], ids[2]}},
+		{at: 3 * time.Hour, n: 1, exp: ids[:1]},
+		{at: 4 * time.Hour, n: 0, exp: ids[:1]},
+	} {
+		n, err := ix.Expire(now.Add(c.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != c.n {
+			t.Fatalf("at %s: expected %d expired documents, got %d", c.at, c.n, n)
+		}
+		res, err := ix.Search("job", NewEqualMatcher("api"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, c.exp) {
+			t.Fatalf("at %s: expected %v, got %v", c.at, c.exp, res)
+		}
+	}
+
+	// Indexes written without history cannot be expired when opened
+	// read-only with it.
+	plain, err := Open(filepath.Join(dir, "plain"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Add(Terms{{"pod", "p1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := Open(filepath.Join(dir, "plain"), &Options{Schema: schema, History: true, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if _, err := ro.Expire(now); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
+
+func TestDeterministicIDs(t *testing.T) {
+	// dump returns the term IDs and skiplist entries of all terms.
+	dump := func(ix *Index) []string {
+		q, err := ix.Querier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		var res []string
+		err = q.termBkt.ForEach(func(k, v []byte) error {
+			tid := newTermID(v)
+			s := fmt.Sprintf("%q %d:", k, tid)
+
+			err := q.skiplists.cursor(tid).forEach(func(d DocID, v []byte) error {
+				s += fmt.Sprintf(" %d/%d", d, decodeUint64(v))
+				return nil
+			})
+			res = append(res, s)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	// build adds the same documents to a new index with their terms
+	// shuffled by the given seed.
+	build := func(seed int64) []string {
+		ix, cleanup := openTestIndex(t, &Options{DeterministicIDs: true})
+		defer cleanup()
+
+		rnd := rand.New(rand.NewSource(seed))
+
+		for c := 0; c < 3; c++ {
+			b, err := ix.Batch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3000; i++ {
+				terms := Terms{
+					{"a", fmt.Sprint(i % 7)},
+					{"b", fmt.Sprint(i % 13)},
+					{"c", fmt.Sprint(c)},
+					{"d", fmt.Sprint(i)},
+				}
+				rnd.Shuffle(len(terms), terms.Swap)
+				b.Add(terms)
+			}
+			if err := b.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dump(ix)
+	}
+	want := build(1)
+	for seed := int64(2); seed < 5; seed++ {
+		if got := build(seed); !reflect.DeepEqual(got, want) {
+			t.Fatalf("IDs differ for seed %d", seed)
+		}
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	ix, cleanup := openTestIndex(t, nil)
+	defer cleanup()
+
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []DocID
+	for i := 0; i < 3000; i++ {
+		ids = append(ids, b.Add(Terms{{"a", fmt.Sprint(i % 2)}, {"b", fmt.Sprint(i)}}))
+	}
+	b.SecondaryIndex(ids[11], Term{"c", "x"})
+	// Delete all but every tenth document.
+	for i, id := range ids {
+		if i%10 != 1 {
+			b.SoftDelete(id)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tindex_renumber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rdir := filepath.Join(dir, "ix")
+
+	var buf bytes.Buffer
+	if err := ix.Renumber(rdir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	mapping := map[DocID]DocID{}
+
+	dec := json.NewDecoder(&buf)
+	for {
+		var m idMapping
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		mapping[m.Old] = m.New
+	}
+	if len(mapping) != 300 {
+		t.Fatalf("expected 300 mapped documents but got %d", len(mapping))
+	}
+	for i := 1; i < len(ids); i += 10 {
+		if exp := DocID(i/10 + 1); mapping[ids[i]] != exp {
+			t.Fatalf("expected document %d to be mapped to %d but got %d", ids[i], exp, mapping[ids[i]])
+		}
+	}
+
+	rix, err := Open(rdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rix.Close()
+
+	d, err := rix.Doc(mapping[ids[21]])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (Terms{{"a", "1"}, {"b", "21"}}); !reflect.DeepEqual(d, exp) {
+		t.Fatalf("expected document %v but got %v", exp, d)
+	}
+	res, err := rix.Search("a", NewEqualMatcher("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 300 || res[0] != 1 || res[299] != 300 {
+		t.Fatalf("unexpected results %d, %v", len(res), res[:1])
+	}
+	res, err = rix.Search("c", NewEqualMatcher("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []DocID{mapping[ids[11]]}) {
+		t.Fatalf("expected secondary posting for %d but got %v", mapping[ids[11]], res)
+	}
+}
+
+func TestOpenScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		b.Add(Terms{{"a", "1"}, {"b", fmt.Sprint(i % 3)}})
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ix.OpenScan() != nil {
+		t.Fatal("unexpected scan summary without workers")
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err = Open(dir, &Options{OpenScanWorkers: 3, DocCacheSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ix.OpenScan()
+	if s == nil {
+		t.Fatal("expected scan summary")
+	}
+	if s.Terms != 4 || s.Pages < 5 || s.Docs != 10 || len(s.Corrupt) != 0 {
+		t.Fatalf("unexpected scan summary %+v", s)
+	}
+	if _, ok := ix.docs.get(5000); !ok {
+		t.Fatal("expected last document to be cached")
+	}
+
+	// Store a document beyond the last allocated ID.
+	err = ix.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktDocs).Put(DocID(6000).bytes(), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, &Options{OpenScanWorkers: 1}); err == nil {
+		t.Fatal("expected open to fail for inconsistent meta state")
+	}
+}
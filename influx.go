@@ -0,0 +1,66 @@
+package tindex
+
+import "sort"
+
+// MeasurementField is the field holding the measurement of documents that
+// represent InfluxDB series.
+const MeasurementField = "__measurement__"
+
+// MeasurementTerms returns the terms of the series with the measurement
+// and tag set.
+func MeasurementTerms(measurement string, tags map[string]string) Terms {
+	terms := make(Terms, 0, len(tags)+1)
+	terms = append(terms, Term{Field: MeasurementField, Val: measurement})
+
+	for k, v := range tags {
+		terms = append(terms, Term{Field: k, Val: v})
+	}
+	sort.Sort(terms)
+	return terms
+}
+
+// ShowTagKeys returns the sorted tag keys of all series of the measurement.
+func (q *Querier) ShowTagKeys(measurement string) ([]string, error) {
+	keys := map[string]struct{}{}
+
+	err := q.forEachMeasurementDoc(measurement, func(_ DocID, terms Terms) {
+		for _, t := range terms {
+			keys[t.Field] = struct{}{}
+		}
+	})
+	delete(keys, MeasurementField)
+
+	return sortedKeys(keys), err
+}
+
+// ShowTagValues returns the sorted values of the tag key across all series
+// of the measurement.
+func (q *Querier) ShowTagValues(measurement, key string) ([]string, error) {
+	vals := map[string]struct{}{}
+
+	err := q.forEachMeasurementDoc(measurement, func(_ DocID, terms Terms) {
+		for _, t := range terms {
+			if t.Field == key {
+				vals[t.Val] = struct{}{}
+			}
+		}
+	})
+	return sortedKeys(vals), err
+}
+
+func (q *Querier) forEachMeasurementDoc(measurement string, fn func(DocID, Terms)) error {
+	it, err := q.Search(MeasurementField, NewEqualMatcher(measurement))
+	if err != nil || it == nil {
+		return err
+	}
+	return forEachDoc(q.kvtx, q.ix.docs, it, fn)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,90 @@
+package tindex
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ingestBatchSize is the number of records committed in a single batch
+// by IngestJSON and IngestCSV.
+const ingestBatchSize = 1000
+
+// IngestJSON reads a stream of JSON objects mapping fields to values and
+// ensures a document for each of them. Records are committed in batches, so
+// records before a failing batch remain in the index. It returns the number
+// of records read.
+func (ix *Index) IngestJSON(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+
+	return ix.ingest(func(b *Batch) error {
+		var rec map[string]string
+		if err := dec.Decode(&rec); err != nil {
+			return err
+		}
+		terms := make(Terms, 0, len(rec))
+		for f, v := range rec {
+			terms = append(terms, Term{Field: f, Val: v})
+		}
+		sort.Sort(terms)
+		b.Ensure(terms)
+		return nil
+	})
+}
+
+// IngestCSV reads CSV records and ensures a document for each of them. The
+// first record holds the field names. Empty values are omitted from the
+// documents. Records are committed as for IngestJSON.
+func (ix *Index) IngestCSV(r io.Reader) (int, error) {
+	cr := csv.NewReader(r)
+
+	fields, err := cr.Read()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	return ix.ingest(func(b *Batch) error {
+		rec, err := cr.Read()
+		if err != nil {
+			return err
+		}
+		terms := make(Terms, 0, len(rec))
+		for i, v := range rec {
+			if v != "" {
+				terms = append(terms, Term{Field: fields[i], Val: v})
+			}
+		}
+		sort.Sort(terms)
+		b.Ensure(terms)
+		return nil
+	})
+}
+
+// ingest calls add with batches that are committed after every
+// ingestBatchSize calls until it returns io.EOF. It returns the number of
+// successful calls.
+func (ix *Index) ingest(add func(*Batch) error) (int, error) {
+	n := 0
+	for {
+		b, err := ix.Batch()
+		if err != nil {
+			return n, err
+		}
+		for i := 0; i < ingestBatchSize; i++ {
+			if err := add(b); err == io.EOF {
+				return n, b.Commit()
+			} else if err != nil {
+				b.Rollback()
+				return n, fmt.Errorf("record %d: %w", n+1, err)
+			}
+			n++
+		}
+		if err := b.Commit(); err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package tindex
+
+import "fmt"
+
+// Building with the tindexdebug tag enables checks of internal invariants
+// that panic if they are violated. They are meant for tests and debugging
+// and are compiled out otherwise.
+
+// checkedIterator panics if the wrapped iterator returns IDs that are not
+// strictly increasing or a seek returns an ID before the seeked one.
+type checkedIterator struct {
+	name string
+	it   Iterator
+	last DocID
+	ok   bool // whether last holds a returned ID
+}
+
+func newCheckedIterator(it Iterator, format string, args ...interface{}) *checkedIterator {
+	return &checkedIterator{name: fmt.Sprintf(format, args...), it: it}
+}
+
+func (it *checkedIterator) Next() (DocID, error) {
+	id, err := it.it.Next()
+	if err != nil {
+		return id, err
+	}
+	if it.ok && id <= it.last {
+		panic(fmt.Sprintf("invariant violated: %s returned %d after %d", it.name, id, it.last))
+	}
+	it.last, it.ok = id, true
+	return id, nil
+}
+
+func (it *checkedIterator) Seek(min DocID) (DocID, error) {
+	id, err := it.it.Seek(min)
+	if err != nil {
+		return id, err
+	}
+	if id < min {
+		panic(fmt.Sprintf("invariant violated: %s returned %d seeking %d", it.name, id, min))
+	}
+	it.last, it.ok = id, true
+	return id, nil
+}
+
+func (it *checkedIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.it, id)
+}
+
+func (it *checkedIterator) Score() uint64 {
+	return scoreOf(it.it)
+}
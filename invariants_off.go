@@ -0,0 +1,5 @@
+//go:build !tindexdebug
+
+package tindex
+
+const invariants = false
@@ -1,7 +1,11 @@
 package tindex
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"sort"
 )
 
@@ -14,54 +18,140 @@ type Iterator interface {
 	Seek(id DocID) (DocID, error)
 }
 
+// ValueIterator is implemented by iterators over postings lists that store
+// a value with each document ID.
+type ValueIterator interface {
+	Iterator
+	// ValueAt returns the value stored with id, which must be the ID last
+	// returned by Next or Seek.
+	ValueAt(id DocID) (uint64, error)
+}
+
+var errNoValues = errors.New("iterator has no values")
+
+// valueAt returns the value of id if the iterator stores values.
+func valueAt(it Iterator, id DocID) (uint64, error) {
+	vit, ok := it.(ValueIterator)
+	if !ok {
+		return 0, errNoValues
+	}
+	return vit.ValueAt(id)
+}
+
+// ScoredIterator is implemented by iterators over postings lists that store
+// a score with each document ID.
+type ScoredIterator interface {
+	Iterator
+	// Score returns the score of the ID last returned by Next or Seek.
+	// Scores of an ID in merged or intersected iterators are summed up.
+	Score() uint64
+}
+
+// scoreOf returns the score of the last returned ID or zero if the iterator
+// has no scores.
+func scoreOf(it Iterator) uint64 {
+	if sit, ok := it.(ScoredIterator); ok {
+		return sit.Score()
+	}
+	return 0
+}
+
+// contextIterator fails with the context's error once it is canceled.
+type contextIterator struct {
+	ctx context.Context
+	it  Iterator
+}
+
+func (it *contextIterator) Next() (DocID, error) {
+	if err := it.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return it.it.Next()
+}
+
+func (it *contextIterator) Seek(id DocID) (DocID, error) {
+	if err := it.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return it.it.Seek(id)
+}
+
+func (it *contextIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.it, id)
+}
+
+func (it *contextIterator) Score() uint64 {
+	return scoreOf(it.it)
+}
+
 type mergeIterator struct {
 	i1, i2 Iterator
 	v1, v2 DocID
 	e1, e2 error
+
+	// Whether the iterators are positioned at the last returned ID. They
+	// are only advanced by the next call so that the value and score of the
+	// ID can be looked up in them.
+	at1, at2 bool
 }
 
 func (it *mergeIterator) Next() (DocID, error) {
-	if it.e1 == io.EOF && it.e2 == io.EOF {
-		return 0, io.EOF
-	}
-	if it.e1 != nil {
-		if it.e1 != io.EOF {
-			return 0, it.e1
-		}
-		x := it.v2
-		it.v2, it.e2 = it.i2.Next()
-		return x, nil
-	}
-	if it.e2 != nil {
-		if it.e2 != io.EOF {
-			return 0, it.e2
-		}
-		x := it.v1
+	if it.at1 {
 		it.v1, it.e1 = it.i1.Next()
-		return x, nil
 	}
-	if it.v1 < it.v2 {
-		x := it.v1
-		it.v1, it.e1 = it.i1.Next()
-		return x, nil
-	} else if it.v2 < it.v1 {
-		x := it.v2
+	if it.at2 {
 		it.v2, it.e2 = it.i2.Next()
-		return x, nil
-	} else {
-		x := it.v1
-		it.v1, it.e1 = it.i1.Next()
-		it.v2, it.e2 = it.i2.Next()
-		return x, nil
 	}
+	return it.next()
 }
 
 func (it *mergeIterator) Seek(id DocID) (DocID, error) {
-	// We just have to advance the first iterator. The next common match is also
-	// the next seeked ID of the intersection.
 	it.v1, it.e1 = it.i1.Seek(id)
 	it.v2, it.e2 = it.i2.Seek(id)
-	return it.Next()
+	return it.next()
+}
+
+// next returns the lower of the current IDs of both iterators.
+func (it *mergeIterator) next() (DocID, error) {
+	it.at1, it.at2 = false, false
+
+	if it.e1 == io.EOF && it.e2 == io.EOF {
+		return 0, io.EOF
+	}
+	if it.e1 != nil && it.e1 != io.EOF {
+		return 0, it.e1
+	}
+	if it.e2 != nil && it.e2 != io.EOF {
+		return 0, it.e2
+	}
+	it.at1 = it.e1 == nil && (it.e2 != nil || it.v1 <= it.v2)
+	it.at2 = it.e2 == nil && (it.e1 != nil || it.v2 <= it.v1)
+
+	if it.at1 {
+		return it.v1, nil
+	}
+	return it.v2, nil
+}
+
+// ValueAt implements the ValueIterator interface. If both iterators contain
+// the ID, the value of the first one is returned.
+func (it *mergeIterator) ValueAt(id DocID) (uint64, error) {
+	if it.at1 {
+		return valueAt(it.i1, id)
+	}
+	return valueAt(it.i2, id)
+}
+
+// Score implements the ScoredIterator interface.
+func (it *mergeIterator) Score() uint64 {
+	var s uint64
+	if it.at1 {
+		s += scoreOf(it.i1)
+	}
+	if it.at2 {
+		s += scoreOf(it.i2)
+	}
+	return s
 }
 
 // Merge returns a new Iterator over the union of the input iterators.
@@ -74,6 +164,9 @@ func Merge(its ...Iterator) Iterator {
 	for _, i2 := range its[1:] {
 		i1 = &mergeIterator{i1: i1, i2: i2}
 	}
+	if invariants {
+		return newCheckedIterator(i1, "merge of %d iterators", len(its))
+	}
 	return i1
 }
 
@@ -94,10 +187,63 @@ func ExpandIterator(it Iterator) ([]DocID, error) {
 	return res, err
 }
 
+// Sample returns n document IDs of the iterator chosen uniformly at random
+// using the seed. The iterator is consumed without keeping all its IDs in
+// memory. The IDs are returned in increasing order.
+func Sample(it Iterator, n int, seed int64) ([]DocID, error) {
+	var (
+		r   = rand.New(rand.NewSource(seed))
+		res = []DocID{}
+		i   int64
+	)
+	v, err := it.Seek(0)
+	for ; err == nil; v, err = it.Next() {
+		if len(res) < n {
+			res = append(res, v)
+		} else if j := r.Int63n(i + 1); j < int64(n) {
+			res[j] = v
+		}
+		i++
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	sort.Sort(list(res))
+	return res, nil
+}
+
+// ExpandValues returns the values stored with the IDs of the iterator in the
+// range [min, max). If max is zero, the range is unbounded. For example, with
+// chunk references stored as values, it returns the chunks of all matched
+// streams within an ID range.
+func ExpandValues(it Iterator, min, max DocID) ([]uint64, error) {
+	var (
+		res = []uint64{}
+		v   DocID
+		err error
+	)
+	for v, err = it.Seek(min); err == nil && (max == 0 || v < max); v, err = it.Next() {
+		x, err := valueAt(it, v)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, x)
+	}
+	if err == nil || err == io.EOF {
+		return res, nil
+	}
+	return nil, err
+}
+
 type intersectIterator struct {
 	i1, i2 Iterator
 	v1, v2 DocID
 	e1, e2 error
+
+	// Whether both iterators are positioned at the last returned ID. They
+	// are only advanced by the next call so that the value and score of the
+	// ID can be looked up in them.
+	at bool
 }
 
 // Intersect returns a new Iterator over the intersection of the input iterators.
@@ -110,10 +256,32 @@ func Intersect(its ...Iterator) Iterator {
 	for _, i2 := range its[1:] {
 		i1 = &intersectIterator{i1: i1, i2: i2}
 	}
+	if invariants {
+		return newCheckedIterator(i1, "intersection of %d iterators", len(its))
+	}
 	return i1
 }
 
 func (it *intersectIterator) Next() (DocID, error) {
+	if it.at {
+		it.v1, it.e1 = it.i1.Next()
+		it.v2, it.e2 = it.i2.Next()
+	}
+	return it.next()
+}
+
+func (it *intersectIterator) Seek(id DocID) (DocID, error) {
+	// We have to advance both iterators. Otherwise, we get a false-positive
+	// match on 0 if only on of the iterators has it.
+	it.v1, it.e1 = it.i1.Seek(id)
+	it.v2, it.e2 = it.i2.Seek(id)
+	return it.next()
+}
+
+// next advances the iterators until both are positioned at the same ID.
+func (it *intersectIterator) next() (DocID, error) {
+	it.at = false
+
 	for {
 		if it.e1 != nil {
 			return 0, it.e1
@@ -126,20 +294,67 @@ func (it *intersectIterator) Next() (DocID, error) {
 		} else if it.v2 < it.v1 {
 			it.v2, it.e2 = it.i2.Seek(it.v1)
 		} else {
-			v := it.v1
-			it.v1, it.e1 = it.i1.Next()
-			it.v2, it.e2 = it.i2.Next()
+			it.at = true
+			return it.v1, nil
+		}
+	}
+}
+
+// ValueAt implements the ValueIterator interface. The value of the first
+// iterator is returned.
+func (it *intersectIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.i1, id)
+}
+
+// Score implements the ScoredIterator interface.
+func (it *intersectIterator) Score() uint64 {
+	return scoreOf(it.i1) + scoreOf(it.i2)
+}
+
+// differenceIterator iterates over the IDs of i1 that are not in i2.
+type differenceIterator struct {
+	i1, i2 Iterator
+	v2     DocID
+	e2     error
+	ok     bool // whether v2 and e2 are set for the current position of i1
+}
+
+func (it *differenceIterator) Next() (DocID, error) {
+	v, err := it.i1.Next()
+	return it.skip(v, err)
+}
+
+func (it *differenceIterator) Seek(id DocID) (DocID, error) {
+	it.ok = false
+	v, err := it.i1.Seek(id)
+	return it.skip(v, err)
+}
+
+// skip advances i1 from v until it holds an ID that is not in i2.
+func (it *differenceIterator) skip(v DocID, err error) (DocID, error) {
+	for ; err == nil; v, err = it.i1.Next() {
+		if !it.ok || (it.e2 == nil && it.v2 < v) {
+			it.v2, it.e2 = it.i2.Seek(v)
+			it.ok = true
+		}
+		if it.e2 != nil && it.e2 != io.EOF {
+			return 0, it.e2
+		}
+		if it.e2 == io.EOF || it.v2 != v {
 			return v, nil
 		}
 	}
+	return 0, err
 }
 
-func (it *intersectIterator) Seek(id DocID) (DocID, error) {
-	// We have to advance both iterators. Otherwise, we get a false-positive
-	// match on 0 if only on of the iterators has it.
-	it.v1, it.e1 = it.i1.Seek(id)
-	it.v2, it.e2 = it.i2.Seek(id)
-	return it.Next()
+// ValueAt implements the ValueIterator interface.
+func (it *differenceIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.i1, id)
+}
+
+// Score implements the ScoredIterator interface.
+func (it *differenceIterator) Score() uint64 {
+	return scoreOf(it.i1)
 }
 
 // A skiplist iterator iterates through a list of value/pointer pairs.
@@ -152,7 +367,8 @@ type skiplistIterator interface {
 
 // iteratorStore allows to retrieve an iterator based on a key.
 type iteratorStore interface {
-	get(uint64) (Iterator, error)
+	// get returns the iterator for key k of the skiplist entry with value v.
+	get(v DocID, k uint64) (Iterator, error)
 }
 
 // skippingIterator implements the iterator interface based on skiplist, which
@@ -164,6 +380,9 @@ type iteratorStore interface {
 type skippingIterator struct {
 	skiplist  skiplistIterator
 	iterators iteratorStore
+	// If set, last returns the last value of the iterator with pointer k
+	// if it is known. Seeks skip iterators ending before the seeked value.
+	last func(k uint64) (DocID, bool)
 
 	// The iterator holding the next value.
 	cur Iterator
@@ -171,17 +390,28 @@ type skippingIterator struct {
 
 // Seek implements the Iterator interface.
 func (it *skippingIterator) Seek(id DocID) (DocID, error) {
-	_, ptr, err := it.skiplist.seek(id)
+	val, ptr, err := it.skiplist.seek(id)
 	if err != nil {
 		return 0, err
 	}
-	cur, err := it.iterators.get(ptr)
+	if it.last != nil {
+		if last, ok := it.last(ptr); ok && last < id {
+			it.cur = newPlainListIterator(nil)
+			return it.advance()
+		}
+	}
+	cur, err := it.iterators.get(val, ptr)
 	if err != nil {
 		return 0, err
 	}
 	it.cur = cur
 
-	return it.cur.Seek(id)
+	if id, err := it.cur.Seek(id); err != io.EOF {
+		return id, err
+	}
+	// The seeked ID is behind the last value of the iterator. The closest
+	// following value is the first one of the next iterator.
+	return it.advance()
 }
 
 // Next implements the Iterator interface.
@@ -199,21 +429,45 @@ func (it *skippingIterator) Next() (DocID, error) {
 	}
 	// We reached the end of the current iterator. Get the next iterator through
 	// our skiplist.
-	_, ptr, err := it.skiplist.next()
-	if err != nil {
-		// Here we return the actual io.EOF if we reached the end of the iterator
-		// retrieved from the last skiplist entry.
-		return 0, err
+	return it.advance()
+}
+
+// ValueAt implements the ValueIterator interface.
+func (it *skippingIterator) ValueAt(id DocID) (uint64, error) {
+	if it.cur == nil {
+		return 0, fmt.Errorf("value of document %d: %w", id, ErrNotFound)
 	}
-	// Iterate over the next iterator.
-	cur, err := it.iterators.get(ptr)
-	if err != nil {
-		return 0, err
+	return valueAt(it.cur, id)
+}
+
+// Score implements the ScoredIterator interface.
+func (it *skippingIterator) Score() uint64 {
+	if it.cur == nil {
+		return 0
 	}
-	it.cur = cur
+	return scoreOf(it.cur)
+}
+
+// advance moves to the next iterator in the skiplist and returns its first value.
+func (it *skippingIterator) advance() (DocID, error) {
+	for {
+		val, ptr, err := it.skiplist.next()
+		if err != nil {
+			// Here we return the actual io.EOF if we reached the end of the iterator
+			// retrieved from the last skiplist entry.
+			return 0, err
+		}
+		cur, err := it.iterators.get(val, ptr)
+		if err != nil {
+			return 0, err
+		}
+		it.cur = cur
 
-	// Return the first value in the new iterator.
-	return it.cur.Seek(0)
+		// Return the first value in the new iterator unless it is empty.
+		if id, err := it.cur.Seek(0); err != io.EOF {
+			return id, err
+		}
+	}
 }
 
 // plainListIterator implements the iterator interface on a sorted list of integers.
@@ -274,7 +528,7 @@ func newPlainSkiplistIterator(m map[DocID]uint64) *plainSkiplistIterator {
 func (it *plainSkiplistIterator) seek(id DocID) (DocID, uint64, error) {
 	pos := sort.Search(len(it.keys), func(i int) bool { return it.keys[i] >= id })
 	// The skiplist iterator points to the element at or before the last value.
-	if pos > 0 && it.keys[pos] > id {
+	if pos > 0 && (pos == len(it.keys) || it.keys[pos] > id) {
 		it.pos = pos - 1
 	} else {
 		it.pos = pos
@@ -0,0 +1,39 @@
+//go:build go1.23
+
+package tindex
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns a sequence over the document IDs of the iterator. If the
+// iterator fails, the error is yielded with a zero ID and the sequence ends.
+func All(it Iterator) iter.Seq2[DocID, error] {
+	return func(yield func(DocID, error) bool) {
+		for id, err := it.Seek(0); ; id, err = it.Next() {
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(0, err)
+				return
+			}
+			if !yield(id, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Collect returns all document IDs of the sequence or its first error.
+func Collect(seq iter.Seq2[DocID, error]) ([]DocID, error) {
+	var res []DocID
+	for id, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
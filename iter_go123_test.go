@@ -0,0 +1,42 @@
+//go:build go1.23
+
+package tindex
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	exp := []DocID{1, 3, 5}
+
+	var res []DocID
+	for id, err := range All(newPlainListIterator(exp)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, id)
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	res, err := Collect(All(newPlainListIterator(exp)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected %v but got %v", exp, res)
+	}
+
+	errTest := errors.New("test")
+	if _, err := Collect(All(errIterator{errTest})); err != errTest {
+		t.Fatalf("expected %v but got %v", errTest, err)
+	}
+}
+
+type errIterator struct{ err error }
+
+func (it errIterator) Next() (DocID, error)      { return 0, it.err }
+func (it errIterator) Seek(DocID) (DocID, error) { return 0, it.err }
@@ -1,7 +1,10 @@
 package tindex
 
 import (
+	"fmt"
+	"io"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -101,6 +104,39 @@ func TestMergeIntersect(t *testing.T) {
 	}
 }
 
+func TestSample(t *testing.T) {
+	var l []DocID
+	for i := 1; i <= 1000; i++ {
+		l = append(l, DocID(i))
+	}
+	res, err := Sample(newPlainListIterator(l), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 10 {
+		t.Fatalf("expected 10 IDs but got %d", len(res))
+	}
+	if !sort.IsSorted(list(res)) {
+		t.Fatalf("expected sorted IDs but got %v", res)
+	}
+	// The same seed returns the same sample.
+	again, err := Sample(newPlainListIterator(l), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, again) {
+		t.Fatalf("expected %v but got %v", res, again)
+	}
+	// Small iterators are returned entirely.
+	res, err = Sample(newPlainListIterator(l[:5]), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, l[:5]) {
+		t.Fatalf("expected %v but got %v", l[:5], res)
+	}
+}
+
 func BenchmarkIntersect(t *testing.B) {
 	var a, b, c, d []DocID
 
@@ -170,6 +206,41 @@ func TestMergeIterator(t *testing.T) {
 	}
 }
 
+func TestDifferenceIterator(t *testing.T) {
+	var cases = []struct {
+		a, b []DocID
+		res  []DocID
+	}{
+		{
+			a:   []DocID{1, 2, 3, 4, 5},
+			b:   []DocID{6, 7, 8},
+			res: []DocID{1, 2, 3, 4, 5},
+		},
+		{
+			a:   []DocID{1, 2, 3, 4, 5},
+			b:   []DocID{0, 2, 3, 5, 6},
+			res: []DocID{1, 4},
+		},
+		{
+			a:   []DocID{1, 2},
+			b:   []DocID{1, 2},
+			res: []DocID{},
+		},
+	}
+
+	for _, c := range cases {
+		it := &differenceIterator{i1: newPlainListIterator(c.a), i2: newPlainListIterator(c.b)}
+
+		res, err := ExpandIterator(it)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(res, c.res) {
+			t.Fatalf("Expected %v but got %v", c.res, res)
+		}
+	}
+}
+
 func TestSkippingIterator(t *testing.T) {
 	var cases = []struct {
 		skiplist skiplistIterator
@@ -219,10 +290,206 @@ func TestSkippingIterator(t *testing.T) {
 
 type testIteratorStore map[uint64]Iterator
 
-func (s testIteratorStore) get(id uint64) (Iterator, error) {
+func (s testIteratorStore) get(_ DocID, id uint64) (Iterator, error) {
 	it, ok := s[id]
 	if !ok {
-		return nil, errNotFound
+		return nil, ErrNotFound
 	}
 	return it, nil
 }
+
+func FuzzIterators(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 0, 3}, []byte{0, 2, 0, 2}, []byte{0, 1, 0, 1, 0, 1, 0, 1, 0, 1})
+	f.Add([]byte{}, []byte{0, 5}, []byte{0xff, 0xff, 0, 0})
+
+	f.Fuzz(func(t *testing.T, a, b, c []byte) {
+		lists := [][]DocID{fuzzDocIDs(a), fuzzDocIDs(b), fuzzDocIDs(c)}
+
+		var (
+			counts = map[DocID]int{}
+			union  = []DocID{}
+			inter  = []DocID{}
+		)
+		for _, l := range lists {
+			for _, v := range l {
+				counts[v]++
+			}
+		}
+		for v, n := range counts {
+			union = append(union, v)
+			if n == len(lists) {
+				inter = append(inter, v)
+			}
+		}
+		sort.Sort(list(union))
+		sort.Sort(list(inter))
+
+		its := func() []Iterator {
+			return []Iterator{
+				newPlainListIterator(lists[0]),
+				newPlainListIterator(lists[1]),
+				newFuzzSkippingIterator(lists[2]),
+			}
+		}
+		res, err := ExpandIterator(Merge(its()...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, union) {
+			t.Fatalf("merge: expected %v but got %v", union, res)
+		}
+		res, err = ExpandIterator(Intersect(its()...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, inter) {
+			t.Fatalf("intersect: expected %v but got %v", inter, res)
+		}
+		res, err = ExpandIterator(newFuzzSkippingIterator(lists[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, append([]DocID{}, lists[2]...)) {
+			t.Fatalf("skipping: expected %v but got %v", lists[2], res)
+		}
+		// Seeking any value must return the closest following one in the list.
+		it := newFuzzSkippingIterator(lists[2])
+		for _, x := range union {
+			for _, v := range []DocID{x, x + 1} {
+				exp := sort.Search(len(lists[2]), func(i int) bool { return lists[2][i] >= v })
+
+				got, err := it.Seek(v)
+				if exp == len(lists[2]) {
+					if err != io.EOF {
+						t.Fatalf("seek %d: expected EOF but got %d, %v", v, got, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("seek %d: %s", v, err)
+				}
+				if got != lists[2][exp] {
+					t.Fatalf("seek %d: expected %d but got %d", v, lists[2][exp], got)
+				}
+			}
+		}
+	})
+}
+
+// newFuzzSkippingIterator returns a skippingIterator over l that splits
+// the list into chunks of varying length.
+func newFuzzSkippingIterator(l []DocID) Iterator {
+	var (
+		skiplist = map[DocID]uint64{}
+		store    = testIteratorStore{}
+	)
+	for i, k := 0, uint64(1); i < len(l); k++ {
+		j := i + int(l[i]%5) + 1
+		if j > len(l) {
+			j = len(l)
+		}
+		skiplist[l[i]] = k
+		store[k] = newPlainListIterator(l[i:j])
+		i = j
+	}
+	if len(skiplist) == 0 {
+		return newPlainListIterator(nil)
+	}
+	return &skippingIterator{
+		skiplist:  newPlainSkiplistIterator(skiplist),
+		iterators: store,
+	}
+}
+
+func TestCheckedIterator(t *testing.T) {
+	expectPanic := func(f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		f()
+	}
+	it := newCheckedIterator(newPlainListIterator([]DocID{1, 2, 3}), "test")
+	if _, err := ExpandIterator(it); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plain list iterator does not sort its input when constructed directly.
+	it = newCheckedIterator(&plainListIterator{list: list{1, 3, 2}}, "test")
+	expectPanic(func() { ExpandIterator(it) })
+}
+
+// valueListIterator stores each ID times ten as its value and score and
+// counts lookups of them.
+type valueListIterator struct {
+	*plainListIterator
+	lookups *int
+}
+
+func (it valueListIterator) ValueAt(id DocID) (uint64, error) {
+	*it.lookups++
+	if it.pos == 0 || it.list[it.pos-1] != id {
+		return 0, fmt.Errorf("value of %d requested at %d", id, it.pos)
+	}
+	return uint64(id) * 10, nil
+}
+
+func (it valueListIterator) Score() uint64 {
+	*it.lookups++
+	return uint64(it.list[it.pos-1]) * 10
+}
+
+func TestLazyValues(t *testing.T) {
+	var lookups int
+	newIt := func(l ...DocID) Iterator {
+		return valueListIterator{newPlainListIterator(l), &lookups}
+	}
+	for _, c := range []struct {
+		it     Iterator
+		ids    []DocID
+		scores []uint64
+	}{
+		{
+			it:     &mergeIterator{i1: newIt(1, 3, 4), i2: newIt(2, 3, 5)},
+			ids:    []DocID{1, 2, 3, 4, 5},
+			scores: []uint64{10, 20, 60, 40, 50},
+		},
+		{
+			it:     &intersectIterator{i1: newIt(1, 3, 4), i2: newIt(2, 3, 4)},
+			ids:    []DocID{3, 4},
+			scores: []uint64{60, 80},
+		},
+	} {
+		// Iterating must not look up values or scores.
+		lookups = 0
+		if _, err := ExpandIterator(c.it); err != nil {
+			t.Fatal(err)
+		}
+		if lookups != 0 {
+			t.Fatalf("expected no lookups but got %d", lookups)
+		}
+		var (
+			ids    []DocID
+			scores []uint64
+		)
+		v, err := c.it.Seek(0)
+		for ; err == nil; v, err = c.it.Next() {
+			x, err := valueAt(c.it, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x != uint64(v)*10 {
+				t.Fatalf("expected value %d for %d but got %d", v*10, v, x)
+			}
+			ids = append(ids, v)
+			scores = append(scores, scoreOf(c.it))
+		}
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, c.ids) || !reflect.DeepEqual(scores, c.scores) {
+			t.Fatalf("expected %v with scores %v but got %v with %v", c.ids, c.scores, ids, scores)
+		}
+	}
+}
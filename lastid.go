@@ -0,0 +1,99 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktLastIDs holds the last document ID of each term's postings list by term
+// ID. Appends are validated and filtered against it without reading the
+// tail page of the list.
+var bktLastIDs = []byte("postings_last")
+
+// initLastIDs creates the last IDs bucket. For indexes created before last
+// IDs were maintained, they are read from the tail of all postings lists.
+func (ix *Index) initLastIDs(tx *bolt.Tx) error {
+	if tx.Bucket(bktLastIDs) != nil {
+		return nil
+	}
+	lasts, err := tx.CreateBucket(bktLastIDs)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktLastIDs), err)
+	}
+	pbtx, err := ix.beginPB(false)
+	if err != nil {
+		return err
+	}
+	defer pbtx.Rollback()
+
+	q := &Querier{
+		ix:        ix,
+		kvtx:      tx,
+		pbtx:      pbtx,
+		termBkt:   tx.Bucket(bktTerms),
+		skiplists: ix.skiplists(tx),
+	}
+	return q.forEachPostingsList(func(t termid) error {
+		last, err := q.lastID(t)
+		if err != nil {
+			return err
+		}
+		return lasts.Put(t.bytes(), last.bytes())
+	})
+}
+
+// getLastID returns the recorded last ID of term t or zero if it has none.
+func getLastID(bkt *bolt.Bucket, t termid) DocID {
+	v := bkt.Get(t.bytes())
+	if v == nil {
+		return 0
+	}
+	return newDocID(v)
+}
+
+// lastID reads the last ID of the postings list of term t from its tail
+// buffer or tail page. It returns zero if the list is empty.
+func (q *Querier) lastID(t termid) (DocID, error) {
+	buffered, err := q.bufferedPostings(t)
+	if err != nil {
+		return 0, err
+	}
+	if len(buffered) > 0 {
+		return buffered[len(buffered)-1], nil
+	}
+	sl := q.skiplists.cursor(t)
+	if sl == nil {
+		return 0, nil
+	}
+	_, pid, err := sl.seek(math.MaxUint64)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := q.pbtx.Get(pid)
+	if err != nil || data == nil {
+		return 0, fmt.Errorf("page %d of term %d: %w", pid, t, ErrNotFound)
+	}
+	return lastDocID(q.ix.newPage(data).cursor())
+}
+
+// LastID returns the most recent document ID added to the postings list of
+// term t. It returns zero if the term does not exist.
+func (q *Querier) LastID(t Term) (DocID, error) {
+	v := q.termBkt.Get(t.bytes())
+	if v == nil {
+		return 0, nil
+	}
+	tid := newTermID(v)
+
+	// Read-only indexes may have been created before last IDs were recorded.
+	if lasts := q.kvtx.Bucket(bktLastIDs); lasts != nil {
+		return getLastID(lasts, tid), nil
+	}
+	return q.lastID(tid)
+}
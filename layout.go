@@ -0,0 +1,64 @@
+package tindex
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Default permissions of directories and files created for an index before
+// the umask is applied.
+const (
+	defaultDirMode  os.FileMode = 0777
+	defaultFileMode os.FileMode = 0666
+)
+
+func (o *Options) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return defaultDirMode
+	}
+	return o.DirMode
+}
+
+func (o *Options) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return defaultFileMode
+	}
+	return o.FileMode
+}
+
+// storeDir resolves the directory of a store against the index directory.
+func storeDir(path, dir string) string {
+	if dir == "" {
+		return path
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(path, dir)
+}
+
+// kvPath returns the path of the key/value store of the index at path.
+func (o *Options) kvPath(path string) string {
+	return filepath.Join(storeDir(path, o.KVDir), "kv")
+}
+
+// pbPath returns the path of the page store of the index at path.
+func (o *Options) pbPath(path string) string {
+	return filepath.Join(storeDir(path, o.PostingsDir), "pb")
+}
+
+// storeDirs returns the directories of both stores of the index at path.
+func (o *Options) storeDirs(path string) []string {
+	return []string{storeDir(path, o.KVDir), storeDir(path, o.PostingsDir)}
+}
+
+// localLayout clears store directories outside of the index directory.
+// Copies of an index cannot share them with the original.
+func (o *Options) localLayout() {
+	if !filepath.IsLocal(o.KVDir) {
+		o.KVDir = ""
+	}
+	if !filepath.IsLocal(o.PostingsDir) {
+		o.PostingsDir = ""
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+package tindex
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir creates the lock file in dir. Locking is not supported on the
+// platform.
+func lockDir(dir string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, mode)
+}
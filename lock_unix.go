@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+
+package tindex
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir acquires an exclusive lock on the lock file in dir. The lock is
+// released when the returned file is closed.
+func lockDir(dir string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
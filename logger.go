@@ -0,0 +1,11 @@
+package tindex
+
+// Logger logs key/value pairs. Its signature matches the Logger of
+// github.com/go-kit/kit/log so it can be used directly.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(...interface{}) error { return nil }
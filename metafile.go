@@ -0,0 +1,128 @@
+package tindex
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FormatVersion is the version of the on-disk format written by this
+// package. It is recorded in the meta file of new indexes.
+const FormatVersion = 1
+
+// metaFile is the name of the file in the index directory that identifies
+// the index. Unlike the state in the key/value store, it is written once and
+// can be read without opening the index.
+const metaFile = "meta.json"
+
+// Meta identifies an index and records how it was created.
+type Meta struct {
+	// UUID is generated randomly when the index is created. Copies of the
+	// index, such as backups and bundles, share it.
+	UUID    string    `json:"uuid"`
+	Created time.Time `json:"created"`
+	Version int       `json:"version"`
+	// Options the index was created with.
+	Options Options `json:"options"`
+}
+
+// Meta returns the meta information of the index. Indexes created before
+// meta files were written are assigned one when they are first opened
+// writable. Until then, ErrNotFound is returned.
+func (ix *Index) Meta() (Meta, error) {
+	if ix.info == nil {
+		return Meta{}, fmt.Errorf("%s: %w", metaFile, ErrNotFound)
+	}
+	return *ix.info, nil
+}
+
+// initMeta reads the meta file of the index and writes it if it does not
+// exist yet.
+func (ix *Index) initMeta() error {
+	m, err := readMeta(ix.path)
+	switch {
+	case err == nil:
+		ix.info = m
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	case ix.opts.ReadOnly:
+		return nil
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return err
+	}
+	m = &Meta{
+		UUID:    uuid,
+		Created: time.Now().UTC(),
+		Version: FormatVersion,
+		Options: *ix.opts,
+	}
+	// Only options that describe the index are recorded.
+	m.Options.Logger, m.Options.TracerProvider = nil, nil
+
+	if err := writeMeta(ix.path, m, ix.opts.fileMode()); err != nil {
+		return err
+	}
+	ix.info = m
+	return nil
+}
+
+// readMeta reads the meta file in dir.
+func readMeta(dir string) (*Meta, error) {
+	b, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %w", metaFile, err)
+	}
+	return &m, nil
+}
+
+// writeMeta atomically writes the meta file in dir with the given
+// permission. Only the writer of the index or a new copy write it, so the
+// temporary file is not shared.
+func writeMeta(dir string, m *Meta, mode os.FileMode) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding %s failed: %w", metaFile, err)
+	}
+	tmp := filepath.Join(dir, metaFile+".tmp")
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, metaFile))
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,164 @@
+package tindex
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MultiIndex serves queries across several indexes, such as time partitions
+// or tenant shards. Document IDs are only meaningful within the index that
+// assigned them, so results are returned as documents. A document that was
+// added to several of the indexes is returned once.
+type MultiIndex struct {
+	ixs []*Index
+}
+
+// OpenMulti opens the indexes in the given directories with the same options.
+func OpenMulti(paths []string, opts *Options) (*MultiIndex, error) {
+	mi := &MultiIndex{}
+
+	for _, p := range paths {
+		ix, err := Open(p, opts)
+		if err != nil {
+			mi.Close()
+			return nil, fmt.Errorf("open index %s: %w", p, err)
+		}
+		mi.ixs = append(mi.ixs, ix)
+	}
+	return mi, nil
+}
+
+// Close closes all indexes.
+func (mi *MultiIndex) Close() error {
+	var err error
+	for _, ix := range mi.ixs {
+		if cerr := ix.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// each calls fn for every index concurrently and returns the first error.
+func (mi *MultiIndex) each(fn func(i int, ix *Index) error) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(mi.ixs))
+	)
+	for i, ix := range mi.ixs {
+		wg.Add(1)
+		go func(i int, ix *Index) {
+			defer wg.Done()
+			errs[i] = fn(i, ix)
+		}(i, ix)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the documents of all indexes with a term for the key whose
+// value matches the matcher. The terms of each document are sorted and
+// documents are ordered by their terms.
+func (mi *MultiIndex) Search(key string, m Matcher) ([]Terms, error) {
+	res := make([][]DocResult, len(mi.ixs))
+
+	err := mi.each(func(i int, ix *Index) error {
+		ids, err := ix.Search(key, m)
+		if err != nil {
+			return err
+		}
+		res[i], err = ix.Docs(ids...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		docs = []Terms{}
+		keys []string
+		seen = map[string]bool{}
+	)
+	for _, drs := range res {
+		for _, dr := range drs {
+			if dr.Err != nil {
+				return nil, dr.Err
+			}
+			sort.Sort(dr.Terms)
+
+			k := docKeyString(dr.Terms)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			docs = append(docs, dr.Terms)
+			keys = append(keys, k)
+		}
+	}
+	sort.Sort(docsByKey{docs: docs, keys: keys})
+	return docs, nil
+}
+
+// Values returns all values of the field across all indexes in sorted order.
+func (mi *MultiIndex) Values(key string) ([]string, error) {
+	res := make([][]string, len(mi.ixs))
+
+	err := mi.each(func(i int, ix *Index) error {
+		q, err := ix.Querier()
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		res[i] = q.Values(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		vals []string
+		seen = map[string]bool{}
+	)
+	for _, vs := range res {
+		for _, v := range vs {
+			if !seen[v] {
+				seen[v] = true
+				vals = append(vals, v)
+			}
+		}
+	}
+	sort.Strings(vals)
+	return vals, nil
+}
+
+// docKeyString returns a key identifying the sorted terms of a document.
+// Valid terms are UTF-8 and never contain the separator byte.
+func docKeyString(terms Terms) string {
+	var b []byte
+	for i := range terms {
+		b = terms[i].appendBytes(b)
+		b = append(b, 0xff)
+	}
+	return string(b)
+}
+
+// docsByKey sorts documents by their keys.
+type docsByKey struct {
+	docs []Terms
+	keys []string
+}
+
+func (d docsByKey) Len() int           { return len(d.docs) }
+func (d docsByKey) Less(i, j int) bool { return d.keys[i] < d.keys[j] }
+
+func (d docsByKey) Swap(i, j int) {
+	d.docs[i], d.docs[j] = d.docs[j], d.docs[i]
+	d.keys[i], d.keys[j] = d.keys[j], d.keys[i]
+}
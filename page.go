@@ -3,22 +3,33 @@ package tindex
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
 const pageSize = 2048
 
-var errPageFull = errors.New("page full")
+var (
+	errPageFull    = errors.New("page full")
+	errPageCorrupt = errors.New("page corrupt")
+)
 
 type pageCursor interface {
 	Iterator
 	append(v DocID) error
+	// offset returns the position of the next value in the page data.
+	offset() int
+	// resume positions the cursor after the value v ending at offset pos
+	// without decoding the values before it.
+	resume(pos int, v DocID)
 }
 
 type page interface {
 	cursor() pageCursor
 	init(v DocID) error
 	data() []byte
+	truncate(v DocID) error
+	verify(min, max DocID) error
 }
 
 type pageDelta struct {
@@ -29,6 +40,8 @@ type pageType uint8
 
 const (
 	pageTypeDelta pageType = iota
+	pageTypeValue
+	pageTypeScore
 )
 
 func newPageDelta(data []byte) *pageDelta {
@@ -41,6 +54,18 @@ func (p *pageDelta) init(v DocID) error {
 	return nil
 }
 
+// truncate removes all values greater than v from the page. The first
+// value of the page cannot be removed.
+func (p *pageDelta) truncate(v DocID) error {
+	return truncatePage(p.b, &pageDeltaCursor{data: p.b}, v)
+}
+
+// verify checks that the page decodes into values starting at min. If max is
+// not zero, all values must be less than max.
+func (p *pageDelta) verify(min, max DocID) error {
+	return verifyPage(&pageDeltaCursor{data: p.b}, min, max)
+}
+
 func (p *pageDelta) cursor() pageCursor {
 	return &pageDeltaCursor{data: p.b}
 }
@@ -68,19 +93,27 @@ func (p *pageDeltaCursor) append(id DocID) error {
 		return errPageFull
 	}
 	if p.cur >= id {
-		return errOutOfOrder
+		return ErrOutOfOrder
 	}
 	p.pos += binary.PutUvarint(p.data[p.pos:], uint64(id-p.cur))
 	p.cur = id
 	return nil
 }
 
+func (p *pageDeltaCursor) offset() int {
+	return p.pos
+}
+
+func (p *pageDeltaCursor) resume(pos int, v DocID) {
+	p.pos, p.cur = pos, v
+}
+
 func (p *pageDeltaCursor) Close() error {
 	return nil
 }
 
 func (p *pageDeltaCursor) Seek(min DocID) (v DocID, err error) {
-	if min < p.cur {
+	if min <= p.cur {
 		p.pos = 0
 	}
 	for v, err = p.Next(); err == nil && v < min; v, err = p.Next() {
@@ -94,15 +127,309 @@ func (p *pageDeltaCursor) Next() (DocID, error) {
 	var dv uint64
 	if p.pos == 0 {
 		dv, n = binary.Uvarint(p.data)
+		if n == 0 {
+			return 0, io.EOF
+		}
+		if n < 0 {
+			return 0, errPageCorrupt
+		}
 		p.cur = DocID(dv)
 	} else {
 		dv, n = binary.Uvarint(p.data[p.pos:])
-		if n <= 0 || dv == 0 {
+		if n == 0 || dv == 0 {
 			return 0, io.EOF
 		}
+		if n < 0 || p.cur+DocID(dv) < p.cur {
+			return 0, errPageCorrupt
+		}
 		p.cur += DocID(dv)
 	}
 	p.pos += n
 
 	return p.cur, nil
 }
+
+// truncatePage zeroes all data of the page following the last value
+// less or equal to v.
+func truncatePage(b []byte, c pageCursor, v DocID) error {
+	var pos int
+	for {
+		pos = c.offset()
+		x, err := c.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if x > v {
+			break
+		}
+	}
+	if pos == 0 {
+		return fmt.Errorf("first value of page is greater than %d: %w", v, errPageCorrupt)
+	}
+	for i := pos; i < len(b); i++ {
+		b[i] = 0
+	}
+	return nil
+}
+
+// verifyPage checks that the cursor's values start at min and are less
+// than max if it is not zero.
+func verifyPage(c pageCursor, min, max DocID) error {
+	v, err := c.Next()
+	if err != nil {
+		return err
+	}
+	if v != min {
+		return fmt.Errorf("first value %d does not match %d: %w", v, min, errPageCorrupt)
+	}
+	for ; err == nil; v, err = c.Next() {
+		if max > 0 && v >= max {
+			return fmt.Errorf("value %d exceeds %d: %w", v, max-1, errPageCorrupt)
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// pageValue is a delta encoded page that stores a value after each ID.
+// Document IDs are never zero, so a zero first ID marks an empty page.
+type pageValue struct {
+	b []byte
+}
+
+func newPageValue(data []byte) *pageValue {
+	return &pageValue{b: data}
+}
+
+func (p *pageValue) init(v DocID) error {
+	return p.initValue(v, 0)
+}
+
+// initValue writes the first ID and its value.
+func (p *pageValue) initValue(v DocID, val uint64) error {
+	n := binary.PutUvarint(p.b, uint64(v))
+	binary.PutUvarint(p.b[n:], val)
+	return nil
+}
+
+func (p *pageValue) truncate(v DocID) error {
+	return truncatePage(p.b, &pageValueCursor{data: p.b}, v)
+}
+
+func (p *pageValue) verify(min, max DocID) error {
+	return verifyPage(&pageValueCursor{data: p.b}, min, max)
+}
+
+func (p *pageValue) cursor() pageCursor {
+	return &pageValueCursor{data: p.b}
+}
+
+func (p *pageValue) data() []byte {
+	return p.b
+}
+
+type pageValueCursor struct {
+	data []byte
+	pos  int
+	cur  DocID
+	val  uint64
+}
+
+func (p *pageValueCursor) append(id DocID) error {
+	return p.appendValue(id, 0)
+}
+
+// appendValue appends the ID with the given value to the page.
+func (p *pageValueCursor) appendValue(id DocID, val uint64) error {
+	// Run to the end.
+	_, err := p.Next()
+	for ; err == nil; _, err = p.Next() {
+		// Consume.
+	}
+	if err != io.EOF {
+		return err
+	}
+	if len(p.data)-p.pos < 2*binary.MaxVarintLen64 {
+		return errPageFull
+	}
+	if p.cur >= id {
+		return ErrOutOfOrder
+	}
+	p.pos += binary.PutUvarint(p.data[p.pos:], uint64(id-p.cur))
+	p.pos += binary.PutUvarint(p.data[p.pos:], val)
+	p.cur, p.val = id, val
+	return nil
+}
+
+func (p *pageValueCursor) offset() int {
+	return p.pos
+}
+
+func (p *pageValueCursor) resume(pos int, v DocID) {
+	p.pos, p.cur = pos, v
+}
+
+// ValueAt implements the ValueIterator interface.
+func (p *pageValueCursor) ValueAt(id DocID) (uint64, error) {
+	if p.pos == 0 || id != p.cur {
+		return 0, fmt.Errorf("value of document %d: %w", id, ErrNotFound)
+	}
+	return p.val, nil
+}
+
+func (p *pageValueCursor) Seek(min DocID) (v DocID, err error) {
+	if min <= p.cur {
+		p.pos, p.cur = 0, 0
+	}
+	for v, err = p.Next(); err == nil && v < min; v, err = p.Next() {
+		// Consume.
+	}
+	return p.cur, err
+}
+
+func (p *pageValueCursor) Next() (DocID, error) {
+	dv, n := binary.Uvarint(p.data[p.pos:])
+	if n == 0 || dv == 0 {
+		return 0, io.EOF
+	}
+	if n < 0 || p.cur+DocID(dv) < p.cur {
+		return 0, errPageCorrupt
+	}
+	val, m := binary.Uvarint(p.data[p.pos+n:])
+	if m <= 0 {
+		return 0, errPageCorrupt
+	}
+	p.cur += DocID(dv)
+	p.val = val
+	p.pos += n + m
+
+	return p.cur, nil
+}
+
+// pageScore is a delta encoded page that stores a score byte after each ID.
+// Document IDs are never zero, so a zero first ID marks an empty page.
+type pageScore struct {
+	b []byte
+}
+
+func newPageScore(data []byte) *pageScore {
+	return &pageScore{b: data}
+}
+
+func (p *pageScore) init(v DocID) error {
+	return p.initScore(v, 0)
+}
+
+// initScore writes the first ID and its score.
+func (p *pageScore) initScore(v DocID, s uint8) error {
+	n := binary.PutUvarint(p.b, uint64(v))
+	p.b[n] = s
+	return nil
+}
+
+func (p *pageScore) truncate(v DocID) error {
+	return truncatePage(p.b, &pageScoreCursor{data: p.b}, v)
+}
+
+func (p *pageScore) verify(min, max DocID) error {
+	return verifyPage(&pageScoreCursor{data: p.b}, min, max)
+}
+
+// maxScore returns the highest score stored in the page.
+func (p *pageScore) maxScore() uint8 {
+	var (
+		c   = &pageScoreCursor{data: p.b}
+		max uint8
+	)
+	for _, err := c.Next(); err == nil; _, err = c.Next() {
+		if c.score > max {
+			max = c.score
+		}
+	}
+	return max
+}
+
+func (p *pageScore) cursor() pageCursor {
+	return &pageScoreCursor{data: p.b}
+}
+
+func (p *pageScore) data() []byte {
+	return p.b
+}
+
+type pageScoreCursor struct {
+	data  []byte
+	pos   int
+	cur   DocID
+	score uint8
+}
+
+func (p *pageScoreCursor) append(id DocID) error {
+	return p.appendScore(id, 0)
+}
+
+// appendScore appends the ID with the given score to the page.
+func (p *pageScoreCursor) appendScore(id DocID, s uint8) error {
+	// Run to the end.
+	_, err := p.Next()
+	for ; err == nil; _, err = p.Next() {
+		// Consume.
+	}
+	if err != io.EOF {
+		return err
+	}
+	if len(p.data)-p.pos < binary.MaxVarintLen64+1 {
+		return errPageFull
+	}
+	if p.cur >= id {
+		return ErrOutOfOrder
+	}
+	p.pos += binary.PutUvarint(p.data[p.pos:], uint64(id-p.cur))
+	p.data[p.pos] = s
+	p.pos++
+	p.cur, p.score = id, s
+	return nil
+}
+
+func (p *pageScoreCursor) offset() int {
+	return p.pos
+}
+
+func (p *pageScoreCursor) resume(pos int, v DocID) {
+	p.pos, p.cur = pos, v
+}
+
+// Score implements the ScoredIterator interface.
+func (p *pageScoreCursor) Score() uint64 {
+	return uint64(p.score)
+}
+
+func (p *pageScoreCursor) Seek(min DocID) (v DocID, err error) {
+	if min <= p.cur {
+		p.pos, p.cur = 0, 0
+	}
+	for v, err = p.Next(); err == nil && v < min; v, err = p.Next() {
+		// Consume.
+	}
+	return p.cur, err
+}
+
+func (p *pageScoreCursor) Next() (DocID, error) {
+	dv, n := binary.Uvarint(p.data[p.pos:])
+	if n == 0 || dv == 0 {
+		return 0, io.EOF
+	}
+	if n < 0 || p.cur+DocID(dv) < p.cur || p.pos+n >= len(p.data) {
+		return 0, errPageCorrupt
+	}
+	p.cur += DocID(dv)
+	p.score = p.data[p.pos+n]
+	p.pos += n + 1
+
+	return p.cur, nil
+}
@@ -1,6 +1,9 @@
 package tindex
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -46,6 +49,58 @@ func TestPageDelta(t *testing.T) {
 	}
 }
 
+func TestPageValue(t *testing.T) {
+	page := newPageValue(make([]byte, pageSize))
+
+	if err := page.initValue(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pc   = page.cursor().(*pageValueCursor)
+		vals = []DocID{1}
+	)
+	for v := DocID(2); ; v += DocID(rand.Int63n(1<<9) + 1) {
+		if err := pc.appendValue(v, uint64(v)*100); err != nil {
+			if err == errPageFull {
+				break
+			}
+			t.Fatal(err)
+		}
+		vals = append(vals, v)
+	}
+	v, err := pc.Seek(0)
+	for i := 0; err == nil; v, err = pc.Next() {
+		if v != vals[i] {
+			t.Fatalf("expected %d but got %d", vals[i], v)
+		}
+		x, err := pc.ValueAt(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x != uint64(v)*100 {
+			t.Fatalf("expected value %d for %d but got %d", v*100, v, x)
+		}
+		i++
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	// Truncating must keep the values of the remaining IDs intact.
+	if err := page.truncate(vals[len(vals)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.verify(1, vals[len(vals)/2]+1); err != nil {
+		t.Fatal(err)
+	}
+	last, err := lastDocID(page.cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != vals[len(vals)/2] {
+		t.Fatalf("expected last ID %d after truncation but got %d", vals[len(vals)/2], last)
+	}
+}
+
 func BenchmarkPageDeltaAppend(b *testing.B) {
 	var (
 		vals []DocID
@@ -114,3 +169,95 @@ func BenchmarkPageDeltaRead(b *testing.B) {
 		}
 	}
 }
+
+// fuzzDocIDs derives a strictly increasing list of document IDs from b.
+// Every two bytes encode the delta to the previous ID.
+func fuzzDocIDs(b []byte) []DocID {
+	var (
+		res  []DocID
+		last DocID
+	)
+	for ; len(b) >= 2; b = b[2:] {
+		d := binary.BigEndian.Uint16(b)
+		// Use the upper bits to occasionally produce large gaps.
+		last += DocID(d&0x3ff)<<(2*(d>>12)) + 1
+		res = append(res, last)
+	}
+	return res
+}
+
+func FuzzPageDelta(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 0, 2, 0xff, 0xff})
+	f.Add(bytes.Repeat([]byte{0x10, 0x01}, 2048))
+	f.Add(bytes.Repeat([]byte{0xf3, 0xff}, 512))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		vals := fuzzDocIDs(b)
+		if len(vals) == 0 {
+			return
+		}
+		page := newPageDelta(make([]byte, pageSize))
+		if err := page.init(vals[0]); err != nil {
+			t.Fatal(err)
+		}
+		pc := page.cursor()
+		num := 1
+
+		for _, v := range vals[1:] {
+			if err := pc.append(v); err == errPageFull {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			num++
+		}
+		vals = vals[:num]
+
+		res, err := ExpandIterator(newPageDelta(page.data()).cursor())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, vals) {
+			t.Fatalf("expected %v but got %v", vals, res)
+		}
+		// Seeking a stored value or any value after its predecessor must
+		// return it, regardless of the cursor's position.
+		c := newPageDelta(page.data()).cursor()
+		step := len(vals)/64 + 1
+
+		for i := len(vals) - 1; i >= 0; i -= step {
+			min := vals[i]
+			if i > 0 {
+				min = vals[i-1] + 1
+			}
+			for _, x := range []DocID{vals[i], min} {
+				v, err := c.Seek(x)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v != vals[i] {
+					t.Fatalf("seek %d: expected %d but got %d", x, vals[i], v)
+				}
+			}
+		}
+	})
+}
+
+func FuzzPageDeltaDecode(f *testing.F) {
+	f.Add([]byte{1, 2, 3})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Decoding arbitrary pages must not panic and never yield
+		// decreasing values.
+		res, err := ExpandIterator(newPageDelta(b).cursor())
+		if err != nil {
+			return
+		}
+		for i := 1; i < len(res); i++ {
+			if res[i] <= res[i-1] {
+				t.Fatalf("decoded values not increasing: %v", res)
+			}
+		}
+	})
+}
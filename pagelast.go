@@ -0,0 +1,73 @@
+package tindex
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktPageLasts holds the last document ID of each full postings page by page
+// ID. The first ID of a page is the key of its skiplist entry, so seeks
+// skip pages whose range ends before the seeked ID without decoding them.
+// Tail pages still receive appends and have no entry.
+var bktPageLasts = []byte("page_last")
+
+// initPageLasts creates the page last IDs bucket. For indexes created before
+// they were maintained, they are read from all pages but the tail page of
+// each postings list.
+func (ix *Index) initPageLasts(tx *bolt.Tx) error {
+	if tx.Bucket(bktPageLasts) != nil {
+		return nil
+	}
+	bkt, err := tx.CreateBucket(bktPageLasts)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktPageLasts), err)
+	}
+	pbtx, err := ix.beginPB(false)
+	if err != nil {
+		return err
+	}
+	defer pbtx.Rollback()
+
+	sls := ix.skiplists(tx)
+
+	return sls.forEach(func(t termid) error {
+		var pids []uint64
+
+		err := sls.cursor(t).forEach(func(_ DocID, v []byte) error {
+			pids = append(pids, decodeUint64(v))
+			return nil
+		})
+		if err != nil || len(pids) == 0 {
+			return err
+		}
+		for _, pid := range pids[:len(pids)-1] {
+			data, err := pbtx.Get(pid)
+			if err != nil || data == nil {
+				return fmt.Errorf("page %d of term %d: %w", pid, t, ErrNotFound)
+			}
+			last, err := lastDocID(ix.newPage(data).cursor())
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(encodeUint64(pid), last.bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pageLast returns the last ID of the full page k. It returns false if the
+// page is a tail page or the index has no last IDs of pages.
+func (q *Querier) pageLast(k uint64) (DocID, bool) {
+	bkt := q.kvtx.Bucket(bktPageLasts)
+	if bkt == nil {
+		return 0, false
+	}
+	v := bkt.Get(encodeUint64(k))
+	if v == nil {
+		return 0, false
+	}
+	return newDocID(v), true
+}
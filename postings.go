@@ -1,72 +1,294 @@
 package tindex
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"math"
 
 	"github.com/boltdb/bolt"
 )
 
-type iteratorStoreFunc func(k uint64) (Iterator, error)
+type iteratorStoreFunc func(v DocID, k uint64) (Iterator, error)
 
-func (s iteratorStoreFunc) get(k uint64) (Iterator, error) {
-	return s(k)
+func (s iteratorStoreFunc) get(v DocID, k uint64) (Iterator, error) {
+	return s(v, k)
+}
+
+// skiplists provides the skiplists of all terms stored in the skiplist bucket.
+// By default, each term has a nested bucket keyed by the first document IDs
+// of its pages. With composite skiplists, all entries are stored in the
+// skiplist bucket itself and keyed by the term ID followed by the document ID.
+// This avoids the overhead of a bucket per term for indexes with many terms.
+type skiplists struct {
+	bkt       *bolt.Bucket
+	composite bool
+}
+
+// skiplists returns the skiplists of the transaction.
+func (ix *Index) skiplists(tx *bolt.Tx) skiplists {
+	return skiplists{bkt: tx.Bucket(bktSkiplist), composite: ix.compositeSkiplists}
+}
+
+// cursor returns a cursor over the skiplist of term t. It returns nil if
+// the term has no skiplist.
+func (s skiplists) cursor(t termid) *boltSkiplistCursor {
+	if s.composite {
+		sc := &boltSkiplistCursor{k: uint64(t), prefix: t.bytes(), bkt: s.bkt}
+		sc.c = s.bkt.Cursor()
+
+		if k, _ := sc.c.Seek(sc.prefix); !sc.owns(k) {
+			return nil
+		}
+		return sc
+	}
+	b := s.bkt.Bucket(t.bytes())
+	if b == nil {
+		return nil
+	}
+	return &boltSkiplistCursor{k: uint64(t), c: b.Cursor(), bkt: b}
+}
+
+// create returns a cursor over the skiplist of term t and creates the
+// skiplist if it does not exist.
+func (s skiplists) create(t termid) (*boltSkiplistCursor, error) {
+	if s.composite {
+		return &boltSkiplistCursor{k: uint64(t), prefix: t.bytes(), c: s.bkt.Cursor(), bkt: s.bkt}, nil
+	}
+	b, err := s.bkt.CreateBucketIfNotExists(t.bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &boltSkiplistCursor{k: uint64(t), c: b.Cursor(), bkt: b}, nil
+}
+
+// forEach calls fn for each term with a skiplist in order of the term IDs.
+func (s skiplists) forEach(fn func(t termid) error) error {
+	if !s.composite {
+		return s.bkt.ForEach(func(k, v []byte) error {
+			// Only nested buckets hold skiplists.
+			if v != nil {
+				return nil
+			}
+			return fn(newTermID(k))
+		})
+	}
+	c := s.bkt.Cursor()
+
+	for k, _ := c.First(); k != nil; {
+		t := newTermID(k)
+		if err := fn(t); err != nil {
+			return err
+		}
+		if t == math.MaxUint64 {
+			break
+		}
+		k, _ = c.Seek((t + 1).bytes())
+	}
+	return nil
 }
 
 // boltSkiplistCursor implements the skiplistCurosr interface.
-//
-// TODO(fabxc): benchmark the overhead of a bucket per key.
-// It might be more performant to have all skiplists in the same bucket.
-//
-// 	20k keys, ~10 skiplist entries avg -> 200k keys, 1 bucket vs 20k buckets, 10 keys
-//
 type boltSkiplistCursor struct {
-	// k is currently unused. If the bucket holds entries for more than
-	// just a single key, it will be necessary.
-	k   uint64
-	c   *bolt.Cursor
-	bkt *bolt.Bucket
+	// k is the term ID of the skiplist. For composite skiplists, prefix
+	// is its encoding that precedes the document ID in all keys.
+	k      uint64
+	prefix []byte
+	c      *bolt.Cursor
+	bkt    *bolt.Bucket
+}
+
+// key returns the key of the entry for d.
+func (s *boltSkiplistCursor) key(d DocID) []byte {
+	if s.prefix == nil {
+		return d.bytes()
+	}
+	return append(s.prefix[:len(s.prefix):len(s.prefix)], d.bytes()...)
+}
+
+// owns returns whether the key is an entry of the skiplist.
+func (s *boltSkiplistCursor) owns(k []byte) bool {
+	return k != nil && bytes.HasPrefix(k, s.prefix)
+}
+
+// doc returns the document ID of an entry's key.
+func (s *boltSkiplistCursor) doc(k []byte) DocID {
+	return newDocID(k[len(s.prefix):])
+}
+
+// forEach calls fn for each entry of the skiplist with its first document
+// ID and the raw entry value.
+func (s *boltSkiplistCursor) forEach(fn func(d DocID, v []byte) error) error {
+	for k, v := s.c.Seek(s.key(0)); s.owns(k); k, v = s.c.Next() {
+		if err := fn(s.doc(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *boltSkiplistCursor) next() (DocID, uint64, error) {
 	db, pb := s.c.Next()
-	if db == nil {
+	if !s.owns(db) {
 		return 0, 0, io.EOF
 	}
-	return newDocID(db), decodeUint64(pb), nil
+	return s.doc(db), decodeUint64(pb), nil
 }
 
 func (s *boltSkiplistCursor) seek(k DocID) (DocID, uint64, error) {
-	db, pb := s.c.Seek(k.bytes())
-	if db == nil {
-		db, pb = s.c.Last()
+	db, pb := s.c.Seek(s.key(k))
+	if !s.owns(db) {
+		// Step back to the last entry of the skiplist.
 		if db == nil {
+			db, pb = s.c.Last()
+		} else {
+			db, pb = s.c.Prev()
+		}
+		if !s.owns(db) {
 			return 0, 0, io.EOF
 		}
 	}
-	did, pid := newDocID(db), decodeUint64(pb)
+	did, pid := s.doc(db), decodeUint64(pb)
 
 	if did > k {
 		// If the found entry is behind the seeked ID, try the previous
 		// entry if it exists. The page it points to contains the range of k.
 		dbp, pbp := s.c.Prev()
-		if dbp != nil {
-			did, pid = newDocID(dbp), decodeUint64(pbp)
+		if s.owns(dbp) {
+			did, pid = s.doc(dbp), decodeUint64(pbp)
 		} else {
 			// We skipped before the first entry. The cursor is now out of
 			// state and subsequent calls to Next() will return nothing.
 			// Reset it to the first position.
-			s.c.First()
+			s.c.Seek(s.key(0))
 		}
 	}
 	return did, pid, nil
 }
 
 func (s *boltSkiplistCursor) append(d DocID, p uint64) error {
-	k, _ := s.c.Last()
+	if last, _, err := s.seek(math.MaxUint64); err == nil && last >= d {
+		return ErrOutOfOrder
+	}
 
-	if k != nil && decodeUint64(k) >= uint64(d) {
-		return errOutOfOrder
+	return s.bkt.Put(s.key(d), encodeUint64(p))
+}
+
+// setMaxScore records the maximum score of the page p starting at d in the
+// skiplist entry.
+func (s *boltSkiplistCursor) setMaxScore(d DocID, p uint64, max uint8) error {
+	return s.bkt.Put(s.key(d), append(encodeUint64(p), max))
+}
+
+// initSkiplists converts the skiplists of an existing index to the layout
+// selected by the options.
+func (ix *Index) initSkiplists(tx *bolt.Tx) error {
+	if ix.meta.CompositeSkiplists != ix.opts.CompositeSkiplists {
+		bkt := tx.Bucket(bktSkiplist)
+
+		var err error
+		if ix.opts.CompositeSkiplists {
+			err = mergeSkiplists(bkt)
+		} else {
+			err = splitSkiplists(bkt)
+		}
+		if err != nil {
+			return fmt.Errorf("migrating skiplists failed: %w", err)
+		}
+		ix.meta.CompositeSkiplists = ix.opts.CompositeSkiplists
+
+		v, err := ix.meta.bytes()
+		if err != nil {
+			return fmt.Errorf("encoding meta failed: %w", err)
+		}
+		if err := tx.Bucket(bktMeta).Put(keyMeta, v); err != nil {
+			return err
+		}
 	}
+	ix.compositeSkiplists = ix.meta.CompositeSkiplists
+	return nil
+}
+
+// skiplistEntry is a raw skiplist entry.
+type skiplistEntry struct {
+	k, v []byte
+}
+
+// mergeSkiplists moves the entries of all per-term buckets into bkt.
+func mergeSkiplists(bkt *bolt.Bucket) error {
+	var terms []termid
 
-	return s.bkt.Put(encodeUint64(uint64(d)), encodeUint64(p))
+	err := bkt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			terms = append(terms, newTermID(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		var entries []skiplistEntry
+
+		err := bkt.Bucket(t.bytes()).ForEach(func(k, v []byte) error {
+			entries = append(entries, skiplistEntry{
+				k: append(t.bytes(), k...),
+				v: append([]byte(nil), v...),
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := bkt.DeleteBucket(t.bytes()); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := bkt.Put(e.k, e.v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitSkiplists moves the composite entries in bkt into per-term buckets.
+func splitSkiplists(bkt *bolt.Bucket) error {
+	var terms []termid
+
+	err := (skiplists{bkt: bkt, composite: true}).forEach(func(t termid) error {
+		terms = append(terms, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		var (
+			entries []skiplistEntry
+			prefix  = t.bytes()
+			c       = bkt.Cursor()
+		)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			entries = append(entries, skiplistEntry{
+				k: append([]byte(nil), k...),
+				v: append([]byte(nil), v...),
+			})
+		}
+		for _, e := range entries {
+			if err := bkt.Delete(e.k); err != nil {
+				return err
+			}
+		}
+		tb, err := bkt.CreateBucket(prefix)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := tb.Put(e.k[len(prefix):], e.v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,146 @@
+package tindex
+
+import "sync"
+
+// queryCache is a bounded LRU cache of the postings matched by searches. Its
+// entries are keyed by the searched field and the string of the matcher and
+// are valid until a commit adds postings for a term of the field.
+//
+// A nil cache caches nothing.
+type queryCache struct {
+	mtx     sync.Mutex
+	size    int
+	n       int
+	entries map[string]map[string]*queryCacheEntry // by field and query
+	// Generation of the last commit that added postings to a field.
+	fieldGens map[string]uint64
+	// Sentinel of the circular list of entries. Its next entry is the most
+	// recently used one.
+	root queryCacheEntry
+}
+
+type queryCacheEntry struct {
+	field, query string
+	gen          uint64 // generation the IDs were read at
+	ids          []DocID
+	prev, next   *queryCacheEntry
+}
+
+func newQueryCache(size int) *queryCache {
+	if size <= 0 {
+		return nil
+	}
+	c := &queryCache{
+		size:      size,
+		entries:   map[string]map[string]*queryCacheEntry{},
+		fieldGens: map[string]uint64{},
+	}
+	c.root.prev, c.root.next = &c.root, &c.root
+	return c
+}
+
+// get returns the IDs cached for the query if they are valid for a querier
+// at the given generation. The returned IDs must not be modified.
+func (c *queryCache) get(field, query string, gen uint64) ([]DocID, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[field][query]
+	// Entries read at a later generation may contain documents the querier
+	// must not see.
+	if !ok || e.gen > gen {
+		return nil, false
+	}
+	c.unlink(e)
+	c.pushFront(e)
+	return e.ids, true
+}
+
+// add caches the IDs matched by the query at the given generation.
+func (c *queryCache) add(field, query string, gen uint64, ids []DocID) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// The field changed after the querier's snapshot was taken.
+	if c.fieldGens[field] > gen {
+		return
+	}
+	es := c.entries[field]
+	if es == nil {
+		es = map[string]*queryCacheEntry{}
+		c.entries[field] = es
+	}
+	if e, ok := es[query]; ok {
+		if e.gen < gen {
+			e.gen, e.ids = gen, ids
+		}
+		c.unlink(e)
+		c.pushFront(e)
+		return
+	}
+	e := &queryCacheEntry{field: field, query: query, gen: gen, ids: ids}
+	es[query] = e
+	c.n++
+	c.pushFront(e)
+
+	if c.n > c.size {
+		c.remove(c.root.prev)
+	}
+}
+
+// invalidate drops all entries of the fields, which received postings in the
+// commit of the given generation.
+func (c *queryCache) invalidate(fields map[string]struct{}, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for f := range fields {
+		c.fieldGens[f] = gen
+
+		for _, e := range c.entries[f] {
+			c.remove(e)
+		}
+	}
+}
+
+func (c *queryCache) remove(e *queryCacheEntry) {
+	c.unlink(e)
+	c.n--
+
+	es := c.entries[e.field]
+	delete(es, e.query)
+	if len(es) == 0 {
+		delete(c.entries, e.field)
+	}
+}
+
+func (c *queryCache) pushFront(e *queryCacheEntry) {
+	e.prev, e.next = &c.root, c.root.next
+	e.next.prev = e
+	c.root.next = e
+}
+
+func (c *queryCache) unlink(e *queryCacheEntry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+}
+
+// fields returns the fields of all terms that received postings in the batch.
+func (b *Batch) fields() map[string]struct{} {
+	fs := map[string]struct{}{}
+	for t, tb := range b.terms {
+		if len(tb.docs) > 0 {
+			fs[t.Field] = struct{}{}
+		}
+	}
+	return fs
+}
@@ -0,0 +1,47 @@
+package tindex
+
+import "fmt"
+
+// checkQuota fails the batch if adding the document with the given terms
+// exceeds the quotas of its tenant. It must be called before the document's
+// terms are added to the batch.
+func (b *Batch) checkQuota(id DocID, terms Terms) {
+	opts := b.ix.opts
+	if opts.TenantField == "" {
+		return
+	}
+	var tenant *Term
+	for i := range terms {
+		if terms[i].Field == opts.TenantField {
+			tenant = &terms[i]
+			break
+		}
+	}
+	if tenant == nil {
+		return
+	}
+	if max := opts.MaxTenantDocTerms; max > 0 && len(terms) > max {
+		b.fail(fmt.Errorf("document %d of tenant %q has %d terms, limit is %d: %w", id, tenant.Val, len(terms), max, ErrQuotaExceeded))
+		return
+	}
+	if max := opts.MaxTenantDocs; max > 0 && b.tenantDocs(*tenant) >= max {
+		b.fail(fmt.Errorf("tenant %q has %d documents: %w", tenant.Val, max, ErrQuotaExceeded))
+	}
+}
+
+// tenantDocs returns the number of documents of the tenant identified by
+// term t in the index and the batch.
+func (b *Batch) tenantDocs(t Term) int {
+	n := 0
+	if tb, ok := b.terms[t]; ok {
+		n = len(tb.docs)
+	}
+	tid, ok := b.termID(t)
+	if !ok {
+		return n
+	}
+	if v := b.tx.Bucket(bktCounts).Get(tid.bytes()); v != nil {
+		n += int(decodeUint64(v))
+	}
+	return n
+}
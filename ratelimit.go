@@ -0,0 +1,111 @@
+package tindex
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the number of documents committed
+// per second. A nil limiter does not limit.
+type rateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // capacity of the bucket
+	tokens float64
+	last   time.Time
+
+	now func() time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// refill adds the tokens accumulated since the last call.
+func (l *rateLimiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// allow takes n tokens if they are available. A full bucket allows n beyond
+// the burst so that large batches are not rejected forever.
+func (l *rateLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.refill()
+	if l.tokens < float64(n) && l.tokens < l.burst {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// wait takes n tokens and blocks until they would have been available or
+// the context is done. Waiting callers are admitted in order.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	l.refill()
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mtx.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Return the tokens that were not used.
+		l.mtx.Lock()
+		l.tokens += float64(n)
+		l.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// throttle applies the rate limit to committing n documents.
+func (ix *Index) throttle(ctx context.Context, n int) error {
+	if ix.limiter == nil || n == 0 {
+		return nil
+	}
+	if ix.opts.FailOnRateLimit {
+		if !ix.limiter.allow(n) {
+			ix.counters.rateLimited.Add(1)
+			return ErrRateLimited
+		}
+		return nil
+	}
+	return ix.limiter.wait(ctx, n)
+}
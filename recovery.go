@@ -0,0 +1,233 @@
+package tindex
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/boltdb/bolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Postings and index state are persisted in two separate stores. New pages are
+// only referenced once the bolt transaction commits, but the most recent page of
+// a postings list is modified in place. If the process crashes, or the bolt
+// transaction fails, after the page store was committed, those pages contain
+// document IDs the index does not know about and subsequent appends to them fail.
+//
+// The key/value store always holds the last page and document ID of every
+// postings list as of the last applied batch. If a commit fails, the tail pages
+// of the postings lists the batch appended to are truncated to that state.
+// While the index is open for writing, a marker is kept in the meta bucket and
+// it is deleted on Close. If it is still present when opening the index, the
+// process did not shut down cleanly and the tail pages of all postings lists are
+// truncated.
+//
+// Pages that were newly allocated by the failed commit remain unreferenced.
+
+// tailPage describes the most recent page of a postings list.
+type tailPage struct {
+	term termid
+	page uint64 // ID of the page.
+	last DocID  // Last document ID stored in the page.
+}
+
+type tailPages []tailPage
+
+// newTailPages decodes a sequence of tail pages encoded as uvarint triples.
+func newTailPages(b []byte) (tailPages, error) {
+	var tps tailPages
+	for len(b) > 0 {
+		var x [3]uint64
+		for i := range x {
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid tail page encoding")
+			}
+			x[i] = v
+			b = b[n:]
+		}
+		tps = append(tps, tailPage{term: termid(x[0]), page: x[1], last: DocID(x[2])})
+	}
+	return tps, nil
+}
+
+// bytes encodes the tail pages as a sequence of uvarint triples.
+func (tps tailPages) bytes() []byte {
+	b := make([]byte, len(tps)*3*binary.MaxVarintLen64)
+	n := 0
+	for _, tp := range tps {
+		n += binary.PutUvarint(b[n:], uint64(tp.term))
+		n += binary.PutUvarint(b[n:], tp.page)
+		n += binary.PutUvarint(b[n:], uint64(tp.last))
+	}
+	return b[:n]
+}
+
+// tails returns the current tail pages of all existing postings lists
+// the batch appends to.
+func (b *Batch) tails(tx *bolt.Tx) (tailPages, error) {
+	var (
+		skiplists = b.ix.skiplists(tx)
+		lasts     = tx.Bucket(bktLastIDs)
+		buffers   = tx.Bucket(bktTailBuffers)
+		tps       tailPages
+	)
+	for _, tb := range b.terms {
+		if tc, ok := b.ix.tailCursors[tb.id]; ok {
+			tps = append(tps, tailPage{term: tb.id, page: tc.page, last: tc.last})
+			continue
+		}
+		tp, ok, err := tailOf(skiplists, lasts, buffers, tb.id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tps = append(tps, tp)
+		}
+	}
+	return tps, nil
+}
+
+// allTails returns the tail pages of all postings lists.
+func (ix *Index) allTails(tx *bolt.Tx) (tailPages, error) {
+	var (
+		skiplists = ix.skiplists(tx)
+		lasts     = tx.Bucket(bktLastIDs)
+		buffers   = tx.Bucket(bktTailBuffers)
+		tps       tailPages
+	)
+	err := skiplists.forEach(func(t termid) error {
+		tp, ok, err := tailOf(skiplists, lasts, buffers, t)
+		if ok {
+			tps = append(tps, tp)
+		}
+		return err
+	})
+	return tps, err
+}
+
+// tailOf returns the tail page of the postings list of term t as recorded in
+// the key/value store. It returns false if the list has no pages.
+func tailOf(skiplists skiplists, lasts, buffers *bolt.Bucket, t termid) (tailPage, bool, error) {
+	// Postings lists of new terms have no pages yet.
+	sl := skiplists.cursor(t)
+	if sl == nil {
+		return tailPage{}, false, nil
+	}
+	_, pid, err := sl.seek(math.MaxUint64)
+	if err == io.EOF {
+		return tailPage{}, false, nil
+	}
+	if err != nil {
+		return tailPage{}, false, err
+	}
+	tp := tailPage{term: t, page: pid, last: getLastID(lasts, t)}
+
+	// The pages of a list with a tail buffer end at its floor.
+	if buffers != nil {
+		if v := buffers.Get(t.bytes()); v != nil {
+			if tp.last, _, err = decodeTailBuffer(v); err != nil {
+				return tailPage{}, false, fmt.Errorf("tail buffer of term %d: %w", t, err)
+			}
+		}
+	}
+	return tp, true, nil
+}
+
+// lastDocID returns the last document ID of the iterator.
+func lastDocID(it Iterator) (DocID, error) {
+	var last DocID
+	v, err := it.Seek(0)
+	for ; err == nil; v, err = it.Next() {
+		last = v
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	return last, nil
+}
+
+// recover truncates the tail pages to their recorded state if the index was
+// not closed cleanly or a recovery record of an earlier version is present.
+// It marks the index as open afterwards.
+func (ix *Index) recover(tx *bolt.Tx) (err error) {
+	mbkt := tx.Bucket(bktMeta)
+
+	var tps tailPages
+
+	if v := mbkt.Get(keyRecovery); v != nil {
+		if tps, err = newTailPages(v); err != nil {
+			return err
+		}
+	} else if mbkt.Get(keyOpen) != nil && tx.Bucket(bktLastIDs) != nil {
+		if tps, err = ix.allTails(tx); err != nil {
+			return err
+		}
+	}
+	if len(tps) > 0 {
+		_, span := ix.tracer.Start(context.Background(), "tindex.recover",
+			trace.WithAttributes(attribute.Int("pages", len(tps))),
+		)
+		n, err := ix.truncateTails(tps)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			ix.logger.Log("msg", "restored postings after unfinished commit", "pages", n)
+			ix.counters.recoveries.Add(1)
+		}
+	}
+	if err := mbkt.Delete(keyRecovery); err != nil {
+		return err
+	}
+	return mbkt.Put(keyOpen, []byte{1})
+}
+
+// truncateTails truncates the given pages to their last document ID if they
+// hold any beyond it. It returns the number of truncated pages.
+func (ix *Index) truncateTails(tps tailPages) (int, error) {
+	pbtx, err := ix.beginPB(true)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, tp := range tps {
+		data, err := pbtx.Get(tp.page)
+		if err != nil {
+			pbtx.Rollback()
+			return 0, fmt.Errorf("page %d of term %d: %w", tp.page, tp.term, ErrNotFound)
+		}
+		// The byte slice is mmaped. We have to copy it to make modifications.
+		pdata := make([]byte, len(data))
+		copy(pdata, data)
+
+		pg := ix.newPage(pdata)
+
+		last, err := lastDocID(pg.cursor())
+		if err != nil {
+			pbtx.Rollback()
+			return 0, fmt.Errorf("reading page %d of term %d: %w", tp.page, tp.term, err)
+		}
+		if last <= tp.last {
+			continue
+		}
+		if err := pg.truncate(tp.last); err != nil {
+			pbtx.Rollback()
+			return 0, fmt.Errorf("truncating page %d of term %d: %w", tp.page, tp.term, err)
+		}
+		if err := pbtx.Set(tp.page, pg.data()); err != nil {
+			pbtx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, pbtx.Rollback()
+	}
+	return n, pbtx.Commit()
+}
@@ -0,0 +1,67 @@
+package tindex
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/fabxc/pagebuf"
+)
+
+// defaultRetryBackoff is the wait before the first retry if no RetryBackoff
+// is set.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// retry calls f until it succeeds, returns a permanent error, or the configured
+// number of retries is exhausted. The wait between attempts doubles every time.
+func (o *Options) retry(f func() error) error {
+	backoff := o.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= o.Retries || !transient(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// transient returns whether err may go away by trying again. Only locks
+// held by other processes when opening the index are waited for.
+func transient(err error) bool {
+	return err == ErrLocked || err == bolt.ErrTimeout
+}
+
+// beginKV starts a new transaction on the key/value store.
+func (ix *Index) beginKV(writable bool) (*bolt.Tx, error) {
+	return ix.bolt.Begin(writable)
+}
+
+// beginPB starts a new transaction on the page store.
+func (ix *Index) beginPB(writable bool) (*pagebuf.Tx, error) {
+	return ix.pbuf.Begin(writable)
+}
+
+// update executes fn within a writable transaction on the key/value store.
+// The transaction is committed if fn returns no error and rolled back otherwise,
+// including if fn panics.
+func (ix *Index) update(fn func(*bolt.Tx) error) error {
+	tx, err := ix.beginKV(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,168 @@
+package tindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// RewriteTerms writes a copy of the index to dir, which must not exist yet,
+// in which the terms of all documents are rewritten. Fields are first
+// renamed according to rename and the resulting terms are then passed to
+// transform if it is not nil. Terms that documents were added to through
+// SecondaryIndex are renamed as well. Documents keep their IDs and soft
+// deletions.
+//
+// Postings lists cannot be modified in place, so the rewritten index is
+// built from an export of the index and replaces it once the caller
+// switches over to it. Indexes storing values or scores cannot be
+// rewritten. Stores the index keeps outside of its directory are placed in
+// dir.
+func (ix *Index) RewriteTerms(dir string, rename map[string]string, transform func(Terms) Terms) error {
+	return ix.rewrite(dir, false, func(q *Querier, nix *Index, dec *json.Decoder) error {
+		_, err := nix.ingest(func(b *Batch) error {
+			var d exportDoc
+			if err := dec.Decode(&d); err != nil {
+				return err
+			}
+			terms := renameFields(d.Terms, rename)
+			if transform != nil {
+				terms = transform(terms)
+			}
+			if id := b.Add(terms); id != d.ID {
+				return fmt.Errorf("document %d rewritten with ID %d", d.ID, id)
+			}
+			if len(d.Secondary) > 0 {
+				b.SecondaryIndex(d.ID, renameFields(d.Secondary, rename)...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		deleted := q.kvtx.Bucket(bktDeleted)
+		if deleted == nil {
+			return nil
+		}
+		if err := nix.checkSpace(); err != nil {
+			return err
+		}
+		return nix.update(func(tx *bolt.Tx) error {
+			bkt, err := tx.CreateBucket(bktDeleted)
+			if err != nil {
+				return err
+			}
+			return deleted.ForEach(bkt.Put)
+		})
+	})
+}
+
+// idMapping maps the ID of a document to its ID in a renumbered index.
+type idMapping struct {
+	Old DocID `json:"old"`
+	New DocID `json:"new"`
+}
+
+// Renumber writes a copy of the index to dir, which must not exist yet, in
+// which soft-deleted documents are dropped and the remaining ones are
+// numbered contiguously in their original order. This restores the density
+// of postings pages after many documents were deleted.
+//
+// The mapping from old to new IDs of all remaining documents is written to w
+// as a stream of JSON objects with the fields "old" and "new", ordered by
+// ID. The mapping is incomplete if renumbering fails. Like RewriteTerms, it
+// does not support indexes with values or scores and the history of
+// generations is not carried over.
+func (ix *Index) Renumber(dir string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := ix.rewrite(dir, true, func(_ *Querier, nix *Index, dec *json.Decoder) error {
+		_, err := nix.ingest(func(b *Batch) error {
+			var d exportDoc
+			if err := dec.Decode(&d); err != nil {
+				return err
+			}
+			id := b.Add(d.Terms)
+			if len(d.Secondary) > 0 {
+				b.SecondaryIndex(id, d.Secondary...)
+			}
+			return enc.Encode(idMapping{Old: d.ID, New: id})
+		})
+		return err
+	})
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// rewrite creates a new index in dir, which must not exist yet, with the
+// options of the index and calls fn to fill it from an export of the index's
+// current snapshot. Soft-deleted documents are not exported if live is set.
+// The querier must not be used by fn before the export was read entirely.
+// The new index is removed if fn fails.
+func (ix *Index) rewrite(dir string, live bool, fn func(q *Querier, nix *Index, dec *json.Decoder) error) (err error) {
+	if ix.pageType != pageTypeDelta {
+		return errors.New("indexes with values or scores cannot be rewritten")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("rewrite directory %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	opts := *ix.opts
+	opts.ReadOnly = false
+	opts.localLayout()
+
+	nix, err := Open(dir, &opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := nix.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		pw.CloseWithError(q.export(pw, live))
+	}()
+	// Stop the export before the querier is closed.
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+
+	return fn(q, nix, json.NewDecoder(pr))
+}
+
+// renameFields returns a copy of the terms with renamed fields.
+func renameFields(terms Terms, rename map[string]string) Terms {
+	res := make(Terms, len(terms))
+	for i, t := range terms {
+		if f, ok := rename[t.Field]; ok {
+			t.Field = f
+		}
+		res[i] = t
+	}
+	return res
+}
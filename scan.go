@@ -0,0 +1,171 @@
+package tindex
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ScanSummary reports the results of the scan of an index when it was opened
+// with OpenScanWorkers.
+type ScanSummary struct {
+	Terms int // postings lists verified
+	Pages int // pages read and verified
+	Docs  int // documents read into the document cache
+	// Missing or corrupted pages found. They are quarantined like those
+	// found by Verify.
+	Corrupt  []CorruptPage
+	Duration time.Duration
+}
+
+// OpenScan returns the summary of the scan run when the index was opened or
+// nil if it was opened without one.
+func (ix *Index) OpenScan() *ScanSummary {
+	return ix.scan
+}
+
+// openScan scans the index if enabled by the options. An error is returned
+// if the meta state is inconsistent with the stored documents and terms.
+func (ix *Index) openScan() error {
+	n := ix.opts.OpenScanWorkers
+	if n <= 0 {
+		return nil
+	}
+	s, err := ix.scanIndex(n)
+	if err != nil {
+		return fmt.Errorf("open scan: %w", err)
+	}
+	ix.scan = s
+
+	ix.logger.Log(
+		"msg", "scanned index",
+		"terms", s.Terms,
+		"pages", s.Pages,
+		"docs", s.Docs,
+		"corrupt", len(s.Corrupt),
+		"duration", s.Duration,
+	)
+	return nil
+}
+
+// scanIndex checks the meta state, verifies all postings lists with the given
+// number of concurrent workers, and fills the document cache.
+func (ix *Index) scanIndex(workers int) (*ScanSummary, error) {
+	start := time.Now()
+
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	if err := q.checkMeta(); err != nil {
+		return nil, err
+	}
+	var tids []termid
+
+	err = q.skiplists.forEach(func(t termid) error {
+		tids = append(tids, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &ScanSummary{Terms: len(tids)}
+
+	if s.Docs, err = q.fillDocCache(); err != nil {
+		return nil, err
+	}
+	if workers > len(tids) {
+		workers = len(tids)
+	}
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		errs    = make([]error, workers)
+		corrupt []CorruptPage
+	)
+	// Each worker verifies every workers-th term with its own querier as
+	// transactions must not be shared between goroutines.
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			wq, err := ix.Querier()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer wq.Close()
+
+			for j := i; j < len(tids); j += workers {
+				c, n, err := wq.verifyPostings(tids[j])
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				mtx.Lock()
+				corrupt = append(corrupt, c...)
+				s.Pages += n
+				mtx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	ix.quarantineAll(corrupt)
+
+	s.Corrupt = corrupt
+	s.Duration = time.Since(start)
+
+	return s, nil
+}
+
+// checkMeta checks that no stored document or term has an ID beyond the last
+// one allocated according to the meta state.
+func (q *Querier) checkMeta() error {
+	q.ix.snaplock.RLock()
+	m := *q.ix.meta
+	q.ix.snaplock.RUnlock()
+
+	if k, _ := q.kvtx.Bucket(bktDocs).Cursor().Last(); k != nil {
+		if id := newDocID(k); id > m.LastDocID {
+			return fmt.Errorf("document %d beyond last document ID %d", id, m.LastDocID)
+		}
+	}
+	if k, _ := q.kvtx.Bucket(bktTermIDs).Cursor().Last(); k != nil {
+		if id := newTermID(k); id > m.LastTermID {
+			return fmt.Errorf("term %d beyond last term ID %d", id, m.LastTermID)
+		}
+	}
+	return nil
+}
+
+// fillDocCache reads the most recently added documents into the document
+// cache until it is full. It returns the number of documents read.
+func (q *Querier) fillDocCache() (int, error) {
+	dc := q.ix.docs
+	if dc == nil {
+		return 0, nil
+	}
+	var (
+		docsBkt   = q.kvtx.Bucket(bktDocs)
+		termidBkt = q.kvtx.Bucket(bktTermIDs)
+		cache     = map[termid]Term{}
+		n         int
+		c         = docsBkt.Cursor()
+	)
+	for k, _ := c.Last(); k != nil && n < dc.size; k, _ = c.Prev() {
+		if _, err := dc.doc(docsBkt, termidBkt, cache, newDocID(k)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
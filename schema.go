@@ -0,0 +1,81 @@
+package tindex
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Schema constrains the terms of documents added to an index. Documents that
+// do not conform fail their batch on commit with ErrSchemaViolation.
+type Schema struct {
+	// Required lists fields every document must have.
+	Required []string
+	// Values maps fields to regular expressions that must match their
+	// values entirely.
+	Values map[string]string
+	// MaxTerms is the maximum number of terms of a document. Zero means no
+	// limit.
+	MaxTerms int
+	// TTLs maps ephemeral fields to the duration after which documents
+	// carrying them are removed by Expire. Documents with several of the
+	// fields expire once the largest of their TTLs passed. TTLs require
+	// History to be enabled.
+	TTLs map[string]time.Duration
+}
+
+// schema is a compiled Schema.
+type schema struct {
+	required []string
+	values   map[string]*regexp.Regexp
+	maxTerms int
+	ttls     map[string]time.Duration
+}
+
+// compile returns the compiled schema or nil if s is nil.
+func (s *Schema) compile() (*schema, error) {
+	if s == nil {
+		return nil, nil
+	}
+	cs := &schema{
+		required: s.Required,
+		values:   make(map[string]*regexp.Regexp, len(s.Values)),
+		maxTerms: s.MaxTerms,
+		ttls:     s.TTLs,
+	}
+	for f, expr := range s.Values {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("schema for field %q: %w", f, err)
+		}
+		cs.values[f] = re
+	}
+	return cs, nil
+}
+
+// validate checks that the terms of a document conform to the schema.
+func (s *schema) validate(terms Terms) error {
+	if s.maxTerms > 0 && len(terms) > s.maxTerms {
+		return fmt.Errorf("%d terms exceed limit of %d: %w", len(terms), s.maxTerms, ErrSchemaViolation)
+	}
+	for _, t := range terms {
+		if re, ok := s.values[t.Field]; ok && !re.MatchString(t.Val) {
+			return fmt.Errorf("value %q for field %q does not match %s: %w", t.Val, t.Field, re, ErrSchemaViolation)
+		}
+	}
+	for _, f := range s.required {
+		if !hasField(terms, f) {
+			return fmt.Errorf("missing required field %q: %w", f, ErrSchemaViolation)
+		}
+	}
+	return nil
+}
+
+func hasField(terms Terms, f string) bool {
+	for _, t := range terms {
+		if t.Field == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package tindex
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// shardBits is the number of high bits of the document IDs returned by a
+// Sharder that hold the shard of the document.
+const (
+	shardBits  = 8
+	shardShift = 64 - shardBits
+	maxShards  = 1 << shardBits
+)
+
+// Sharder distributes documents across several indexes by the hash of their
+// terms. Each index has its own writer, so batches for different shards are
+// committed in parallel.
+//
+// Document IDs returned by a Sharder hold the shard in their high bits and
+// are only valid for the same sharder. Documents are routed by the number of
+// shards, which must not change once documents were added.
+type Sharder struct {
+	mi *MultiIndex
+}
+
+var _ Store = (*Sharder)(nil)
+
+// OpenSharder opens the indexes in the given directories as the shards of a
+// sharder. Their order determines the routing of documents.
+func OpenSharder(paths []string, opts *Options) (*Sharder, error) {
+	if len(paths) == 0 || len(paths) > maxShards {
+		return nil, fmt.Errorf("invalid number of shards %d", len(paths))
+	}
+	mi, err := OpenMulti(paths, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Sharder{mi: mi}, nil
+}
+
+// shard returns the shard the document is routed to.
+func (s *Sharder) shard(terms Terms) int {
+	sorted := append(Terms(nil), terms...)
+	sort.Sort(sorted)
+
+	h := fnv.New64a()
+	h.Write([]byte(docKeyString(sorted)))
+	return int(h.Sum64() % uint64(len(s.mi.ixs)))
+}
+
+func shardDocID(shard int, id DocID) DocID {
+	return DocID(shard)<<shardShift | id
+}
+
+func splitDocID(id DocID) (int, DocID) {
+	return int(id >> shardShift), id & (1<<shardShift - 1)
+}
+
+// Add adds each document to its shard and returns their IDs. The documents
+// of each shard are added in a single batch. If adding to a shard fails,
+// documents of other shards may have been added.
+func (s *Sharder) Add(docs ...Terms) ([]DocID, error) {
+	var (
+		shards = make([][]Terms, len(s.mi.ixs))
+		pos    = make([][]int, len(s.mi.ixs))
+		res    = make([]DocID, len(docs))
+	)
+	for i, d := range docs {
+		k := s.shard(d)
+		shards[k] = append(shards[k], d)
+		pos[k] = append(pos[k], i)
+	}
+	err := s.mi.each(func(k int, ix *Index) error {
+		if len(shards[k]) == 0 {
+			return nil
+		}
+		ids, err := ix.Add(shards[k]...)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", k, err)
+		}
+		for j, id := range ids {
+			if id>>shardShift != 0 {
+				return fmt.Errorf("shard %d: document ID %d exceeds the ID space", k, id)
+			}
+			res[pos[k][j]] = shardDocID(k, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Search returns the IDs of all documents matching the key and matcher in
+// any shard.
+func (s *Sharder) Search(key string, m Matcher) ([]DocID, error) {
+	res := make([][]DocID, len(s.mi.ixs))
+
+	err := s.mi.each(func(k int, ix *Index) error {
+		ids, err := ix.Search(key, m)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			ids[i] = shardDocID(k, id)
+		}
+		res[k] = ids
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Shards are ordered by the high bits of their IDs.
+	ids := []DocID{}
+	for _, r := range res {
+		ids = append(ids, r...)
+	}
+	return ids, nil
+}
+
+// Docs returns the documents with the given IDs in the same order.
+func (s *Sharder) Docs(ids ...DocID) ([]DocResult, error) {
+	var (
+		local = make([][]DocID, len(s.mi.ixs))
+		pos   = make([][]int, len(s.mi.ixs))
+		res   = make([]DocResult, len(ids))
+	)
+	for i, id := range ids {
+		k, lid := splitDocID(id)
+		if k >= len(s.mi.ixs) {
+			res[i].Err = fmt.Errorf("document %d: %w", id, ErrNotFound)
+			continue
+		}
+		local[k] = append(local[k], lid)
+		pos[k] = append(pos[k], i)
+	}
+	err := s.mi.each(func(k int, ix *Index) error {
+		if len(local[k]) == 0 {
+			return nil
+		}
+		drs, err := ix.Docs(local[k]...)
+		if err != nil {
+			return err
+		}
+		for j, dr := range drs {
+			res[pos[k][j]] = dr
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Values returns all values of the field across all shards in sorted order.
+func (s *Sharder) Values(key string) ([]string, error) {
+	return s.mi.Values(key)
+}
+
+// Close closes all shards.
+func (s *Sharder) Close() error {
+	return s.mi.Close()
+}
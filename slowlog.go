@@ -0,0 +1,69 @@
+package tindex
+
+import (
+	"fmt"
+	"time"
+)
+
+// queryStats collects information about a single search.
+type queryStats struct {
+	start   time.Time
+	key     string
+	matcher Matcher
+	terms   int // number of matched terms
+	pages   int // number of pages read
+}
+
+// slowQueryIterator logs the search it iterates over if it took longer than
+// the slow query threshold once it is exhausted or failed.
+type slowQueryIterator struct {
+	Iterator
+	ix    *Index
+	stats *queryStats
+	done  bool
+}
+
+func (it *slowQueryIterator) Next() (DocID, error) {
+	id, err := it.Iterator.Next()
+	if err != nil {
+		it.finish(err)
+	}
+	return id, err
+}
+
+func (it *slowQueryIterator) Seek(min DocID) (DocID, error) {
+	id, err := it.Iterator.Seek(min)
+	if err != nil {
+		it.finish(err)
+	}
+	return id, err
+}
+
+func (it *slowQueryIterator) ValueAt(id DocID) (uint64, error) {
+	return valueAt(it.Iterator, id)
+}
+
+func (it *slowQueryIterator) Score() uint64 {
+	return scoreOf(it.Iterator)
+}
+
+func (it *slowQueryIterator) finish(err error) {
+	if it.done {
+		return
+	}
+	it.done = true
+
+	d := time.Since(it.stats.start)
+	if d < it.ix.opts.SlowQueryThreshold {
+		return
+	}
+	it.ix.logger.Log(
+		"msg", "slow query",
+		"key", it.stats.key,
+		"matcher", fmt.Sprint(it.stats.matcher),
+		"terms", it.stats.terms,
+		"pages", it.stats.pages,
+		"duration", d,
+		"err", err,
+	)
+}
@@ -0,0 +1,38 @@
+package tindex
+
+// Snapshot is a consistent view of the index that can serve queries for an
+// extended period of time. Batches committed after it was taken are not
+// visible to it.
+//
+// The key/value store must wait for all open transactions before it can grow
+// its memory mapping. A commit that grows the store beyond its mapping,
+// see Options.InitialMmapSize, therefore waits until the snapshot is
+// released, and so do queriers and snapshots started meanwhile. Opening one
+// while holding a snapshot may thus deadlock. Other reads, including those
+// from the snapshot, proceed. Compactions do not wait for the snapshot. It
+// keeps reading from the replaced key/value store, which is closed once all
+// snapshots and queriers using it are released.
+type Snapshot struct {
+	*Querier
+}
+
+// Snapshot returns a new snapshot of the index. It must be released
+// once it is no longer needed.
+func (ix *Index) Snapshot() (*Snapshot, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Querier: q}, nil
+}
+
+// Generation returns the number of batches committed since the index was
+// opened that are visible to the snapshot.
+func (s *Snapshot) Generation() uint64 {
+	return s.gen
+}
+
+// Release closes the snapshot.
+func (s *Snapshot) Release() error {
+	return s.Close()
+}
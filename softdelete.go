@@ -0,0 +1,235 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktDeleted holds the IDs of soft-deleted documents along with the Unix
+// time and the generation of the commit they were deleted in. Soft-deleted
+// documents are excluded from searches but their postings and terms remain
+// in the index.
+var bktDeleted = []byte("deleted_docs")
+
+// bktUndeleted holds the IDs of restored documents that are not deleted
+// again along with the generation of the commit they were restored in.
+var bktUndeleted = []byte("undeleted_docs")
+
+// SoftDelete marks the documents as deleted when the batch is committed.
+// They are excluded from search results until they are restored with
+// Undelete.
+func (b *Batch) SoftDelete(ids ...DocID) {
+	b.setDeleted(ids, true)
+}
+
+// Undelete restores soft-deleted documents when the batch is committed.
+func (b *Batch) Undelete(ids ...DocID) {
+	b.setDeleted(ids, false)
+}
+
+func (b *Batch) setDeleted(ids []DocID, deleted bool) {
+	if b.deletions == nil {
+		b.deletions = map[DocID]bool{}
+	}
+	for _, id := range ids {
+		if b.ix.opts.Strict && (id == 0 || id > b.meta.LastDocID) {
+			b.fail(fmt.Errorf("deletion of unknown document %d", id))
+		}
+		b.deletions[id] = deleted
+	}
+}
+
+// applyDeletions writes the deletions of the batch. Documents that are
+// deleted again keep their original deletion time.
+func (b *Batch) applyDeletions(tx *bolt.Tx) error {
+	if len(b.deletions) == 0 {
+		return nil
+	}
+	bkt, err := tx.CreateBucketIfNotExists(bktDeleted)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktDeleted), err)
+	}
+	undeleted, err := tx.CreateBucketIfNotExists(bktUndeleted)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktUndeleted), err)
+	}
+	now := encodeDeletion(time.Now(), b.meta.Generation)
+
+	for id, deleted := range b.deletions {
+		k := id.bytes()
+		if !deleted {
+			if bkt.Get(k) == nil {
+				continue
+			}
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+			if err := undeleted.Put(k, encodeUint64(b.meta.Generation)); err != nil {
+				return err
+			}
+			continue
+		}
+		if bkt.Get(k) != nil {
+			continue
+		}
+		if err := undeleted.Delete(k); err != nil {
+			return err
+		}
+		if err := bkt.Put(k, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SoftDelete marks all documents in the iterator as deleted. It returns the
+// number of documents that were not deleted before.
+func (ix *Index) SoftDelete(it Iterator) (int, error) {
+	return ix.setDeleted(it, true)
+}
+
+// Undelete restores all soft-deleted documents in the iterator. It returns
+// the number of restored documents.
+func (ix *Index) Undelete(it Iterator) (int, error) {
+	return ix.setDeleted(it, false)
+}
+
+func (ix *Index) setDeleted(it Iterator, deleted bool) (int, error) {
+	ids, err := ExpandIterator(it)
+	if err != nil {
+		return 0, err
+	}
+	b, err := ix.Batch()
+	if err != nil {
+		return 0, err
+	}
+	bkt := b.tx.Bucket(bktDeleted)
+
+	n := 0
+	for _, id := range ids {
+		if (bkt != nil && bkt.Get(id.bytes()) != nil) != deleted {
+			n++
+		}
+	}
+	b.setDeleted(ids, deleted)
+
+	if err := b.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Deleted returns an iterator over all soft-deleted documents.
+func (q *Querier) Deleted() Iterator {
+	bkt := q.kvtx.Bucket(bktDeleted)
+	if bkt == nil {
+		return newPlainListIterator(nil)
+	}
+	return &keyIterator{c: bkt.Cursor(), skip: q.deletedLater}
+}
+
+// deletedLater returns whether the deletion record is from a generation
+// after the querier's view.
+func (q *Querier) deletedLater(v []byte) bool {
+	if q.asOf == nil {
+		return false
+	}
+	_, gen := decodeDeletion(v)
+	return gen > q.asOf.Gen
+}
+
+// encodeDeletion returns the deletion record of a document deleted at time t
+// in the given generation.
+func encodeDeletion(t time.Time, gen uint64) []byte {
+	return append(encodeUint64(uint64(t.Unix())), encodeUint64(gen)...)
+}
+
+// decodeDeletion returns the time and generation of a deletion record.
+// Records written before generations were recorded have generation zero.
+func decodeDeletion(v []byte) (time.Time, uint64) {
+	t := time.Unix(int64(decodeUint64(v)), 0)
+	if len(v) < 16 {
+		return t, 0
+	}
+	return t, decodeUint64(v[8:])
+}
+
+// DeletedAt returns the time the document was soft-deleted at. It returns
+// false if the document is not deleted.
+func (q *Querier) DeletedAt(id DocID) (time.Time, bool) {
+	bkt := q.kvtx.Bucket(bktDeleted)
+	if bkt == nil {
+		return time.Time{}, false
+	}
+	v := bkt.Get(id.bytes())
+	if v == nil || q.deletedLater(v) {
+		return time.Time{}, false
+	}
+	t, _ := decodeDeletion(v)
+	return t, true
+}
+
+// filter returns an iterator over the IDs of it that are visible to the
+// querier.
+func (q *Querier) filter(it Iterator) Iterator {
+	if q.asOf != nil {
+		it = &boundIterator{it: it, max: q.asOf.LastDocID}
+	}
+	bkt := q.kvtx.Bucket(bktDeleted)
+	if bkt == nil {
+		return it
+	}
+	if k, _ := bkt.Cursor().First(); k == nil {
+		return it
+	}
+	return &differenceIterator{i1: it, i2: q.Deleted()}
+}
+
+// isDeleted returns whether the document is soft-deleted.
+func (q *Querier) isDeleted(id DocID) bool {
+	bkt := q.kvtx.Bucket(bktDeleted)
+	if bkt == nil {
+		return false
+	}
+	v := bkt.Get(id.bytes())
+	return v != nil && !q.deletedLater(v)
+}
+
+// keyIterator iterates over the document IDs that are the keys of a bucket.
+type keyIterator struct {
+	c       *bolt.Cursor
+	started bool
+	// skip returns whether the entry with the value is skipped. May be nil.
+	skip func(v []byte) bool
+}
+
+func (it *keyIterator) Next() (DocID, error) {
+	var k, v []byte
+	if it.started {
+		k, v = it.c.Next()
+	} else {
+		k, v = it.c.First()
+		it.started = true
+	}
+	return it.at(k, v)
+}
+
+func (it *keyIterator) Seek(id DocID) (DocID, error) {
+	k, v := it.c.Seek(id.bytes())
+	it.started = true
+	return it.at(k, v)
+}
+
+// at returns the ID of the entry or the next one that is not skipped.
+func (it *keyIterator) at(k, v []byte) (DocID, error) {
+	for it.skip != nil && k != nil && it.skip(v) {
+		k, v = it.c.Next()
+	}
+	if k == nil {
+		return 0, io.EOF
+	}
+	return newDocID(k), nil
+}
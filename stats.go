@@ -0,0 +1,184 @@
+package tindex
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktCounts holds the length of each term's postings list by term ID.
+var bktCounts = []byte("term_counts")
+
+// initCounts creates the postings counts bucket. For indexes created before
+// counts were maintained, they are computed from all postings lists.
+func (ix *Index) initCounts(tx *bolt.Tx) error {
+	if tx.Bucket(bktCounts) != nil {
+		return nil
+	}
+	counts, err := tx.CreateBucket(bktCounts)
+	if err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktCounts), err)
+	}
+	pbtx, err := ix.beginPB(false)
+	if err != nil {
+		return err
+	}
+	defer pbtx.Rollback()
+
+	q := &Querier{
+		ix:        ix,
+		kvtx:      tx,
+		pbtx:      pbtx,
+		termBkt:   tx.Bucket(bktTerms),
+		skiplists: ix.skiplists(tx),
+	}
+	return q.forEachPostingsList(func(t termid) error {
+		it, err := q.postingsIter(t, nil)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for _, err = it.Next(); err == nil; _, err = it.Next() {
+			n++
+		}
+		if err != io.EOF {
+			return fmt.Errorf("counting postings of term %d: %w", t, err)
+		}
+		return addTermCount(counts, t, n)
+	})
+}
+
+// addTermCount adds n to the postings count of term t.
+func addTermCount(bkt *bolt.Bucket, t termid, n int) error {
+	var c uint64
+	if v := bkt.Get(t.bytes()); v != nil {
+		c = decodeUint64(v)
+	}
+	return bkt.Put(t.bytes(), encodeUint64(c+uint64(n)))
+}
+
+// PostingsStats describes the distribution of postings list lengths
+// across all terms in the index.
+type PostingsStats struct {
+	Terms              int
+	P50, P90, P99, Max int
+}
+
+// PostingsStats returns the distribution of postings list lengths. Terms with
+// exceptionally long postings lists are expensive to query.
+func (ix *Index) PostingsStats() (PostingsStats, error) {
+	var s PostingsStats
+
+	tx, done, err := ix.beginRead()
+	if err != nil {
+		return s, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	counts := tx.Bucket(bktCounts)
+	if counts == nil {
+		return s, fmt.Errorf("postings counts: %w", ErrNotFound)
+	}
+	var lens []int
+
+	err = counts.ForEach(func(_, v []byte) error {
+		lens = append(lens, int(decodeUint64(v)))
+		return nil
+	})
+	if err != nil || len(lens) == 0 {
+		return s, err
+	}
+	sort.Ints(lens)
+
+	quantile := func(q float64) int {
+		return lens[int(q*float64(len(lens)-1))]
+	}
+	s.Terms = len(lens)
+	s.P50 = quantile(0.5)
+	s.P90 = quantile(0.9)
+	s.P99 = quantile(0.99)
+	s.Max = lens[len(lens)-1]
+
+	return s, nil
+}
+
+// FieldCount is the number of documents containing a field.
+type FieldCount struct {
+	Field string
+	Docs  int
+}
+
+// TermCount is the number of documents containing a term.
+type TermCount struct {
+	Term Term
+	Docs int
+}
+
+// TopCardinality returns the k fields and the k terms contained in the most
+// documents, ordered by decreasing count.
+func (ix *Index) TopCardinality(k int) ([]FieldCount, []TermCount, error) {
+	tx, done, err := ix.beginRead()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+	defer tx.Rollback()
+
+	counts := tx.Bucket(bktCounts)
+	if counts == nil {
+		return nil, nil, fmt.Errorf("postings counts: %w", ErrNotFound)
+	}
+	var (
+		termidBkt = tx.Bucket(bktTermIDs)
+		fields    = map[string]int{}
+		terms     []TermCount
+	)
+	err = counts.ForEach(func(k, v []byte) error {
+		tb := termidBkt.Get(k)
+		if tb == nil {
+			return fmt.Errorf("term %d: %w", newTermID(k), ErrNotFound)
+		}
+		t, err := newTerm(tb)
+		if err != nil {
+			return err
+		}
+		n := int(decodeUint64(v))
+
+		fields[t.Field] += n
+		terms = append(terms, TermCount{Term: t, Docs: n})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	fcs := make([]FieldCount, 0, len(fields))
+	for f, n := range fields {
+		fcs = append(fcs, FieldCount{Field: f, Docs: n})
+	}
+	sort.Slice(fcs, func(i, j int) bool {
+		if fcs[i].Docs != fcs[j].Docs {
+			return fcs[i].Docs > fcs[j].Docs
+		}
+		return fcs[i].Field < fcs[j].Field
+	})
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Docs != terms[j].Docs {
+			return terms[i].Docs > terms[j].Docs
+		}
+		ti, tj := terms[i].Term, terms[j].Term
+		if ti.Field != tj.Field {
+			return ti.Field < tj.Field
+		}
+		return ti.Val < tj.Val
+	})
+	if len(fcs) > k {
+		fcs = fcs[:k]
+	}
+	if len(terms) > k {
+		terms = terms[:k]
+	}
+	return fcs, terms, nil
+}
@@ -0,0 +1,105 @@
+package tindex
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Store is the subset of the index's methods most applications use. It can
+// be replaced with NewMemStore in tests.
+type Store interface {
+	// Add adds the documents in a single batch and returns their IDs.
+	Add(docs ...Terms) ([]DocID, error)
+	// Search returns the IDs of all documents with a term for the key whose
+	// value matches the matcher.
+	Search(key string, m Matcher) ([]DocID, error)
+	// Docs returns the documents with the given IDs.
+	Docs(ids ...DocID) ([]DocResult, error)
+	// Close releases all resources of the store.
+	Close() error
+}
+
+var _ Store = (*Index)(nil)
+
+// Add adds the documents to the index in a single batch and returns their IDs.
+func (ix *Index) Add(docs ...Terms) ([]DocID, error) {
+	return ix.add(docs)
+}
+
+// Search returns the IDs of all documents matching the key and matcher.
+func (ix *Index) Search(key string, m Matcher) ([]DocID, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	it, err := q.Search(key, m)
+	if err != nil || it == nil {
+		return []DocID{}, err
+	}
+	return ExpandIterator(it)
+}
+
+// memStore is an in-memory Store.
+type memStore struct {
+	mtx  sync.RWMutex
+	docs []Terms
+}
+
+// NewMemStore returns a Store that keeps all documents in memory.
+func NewMemStore() Store {
+	return &memStore{}
+}
+
+func (s *memStore) Add(docs ...Terms) ([]DocID, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ids := make([]DocID, 0, len(docs))
+	for _, d := range docs {
+		c := make(Terms, len(d))
+		copy(c, d)
+
+		s.docs = append(s.docs, c)
+		ids = append(ids, DocID(len(s.docs)))
+	}
+	return ids, nil
+}
+
+func (s *memStore) Search(key string, m Matcher) ([]DocID, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	res := []DocID{}
+	for i, d := range s.docs {
+		for _, t := range d {
+			if t.Field == key && m.Match(t.Val) {
+				res = append(res, DocID(i+1))
+				break
+			}
+		}
+	}
+	sort.Sort(list(res))
+	return res, nil
+}
+
+func (s *memStore) Docs(ids ...DocID) ([]DocResult, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	res := make([]DocResult, len(ids))
+	for i, id := range ids {
+		if id == 0 || int(id) > len(s.docs) {
+			res[i].Err = fmt.Errorf("document %d: %w", id, ErrNotFound)
+			continue
+		}
+		res[i].Terms = s.docs[id-1]
+	}
+	return res, nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
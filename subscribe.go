@@ -0,0 +1,95 @@
+package tindex
+
+// subscriptionBuffer is the number of document IDs buffered for each
+// subscription. Further IDs are dropped until the subscriber catches up.
+const subscriptionBuffer = 1024
+
+// Selector selects documents with a term for the field whose value matches
+// the matcher.
+type Selector struct {
+	Field   string
+	Matcher Matcher
+}
+
+type subscription struct {
+	sels []Selector
+	ch   chan DocID
+}
+
+// matches returns whether the document matches all selectors.
+func (s *subscription) matches(ix *Index, terms Terms) bool {
+	for _, sel := range s.sels {
+		field, m := ix.resolveField(sel.Field, sel.Matcher)
+
+		ok := false
+		for _, t := range terms {
+			if t.Field == field && m.Match(t.Val) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe returns a channel receiving the IDs of documents matching all
+// selectors once they are committed. IDs are sent in order of their commit.
+// If the subscriber does not keep up, IDs are dropped and counted in the
+// subscription_drops counter. The returned function cancels the subscription
+// and closes the channel.
+func (ix *Index) Subscribe(sels ...Selector) (<-chan DocID, func()) {
+	s := &subscription{
+		sels: sels,
+		ch:   make(chan DocID, subscriptionBuffer),
+	}
+	ix.smtx.Lock()
+	ix.subs[s] = struct{}{}
+	ix.smtx.Unlock()
+
+	cancel := func() {
+		ix.smtx.Lock()
+		defer ix.smtx.Unlock()
+
+		if _, ok := ix.subs[s]; ok {
+			delete(ix.subs, s)
+			close(s.ch)
+		}
+	}
+	return s.ch, cancel
+}
+
+// publish sends the documents of a committed batch to all matching
+// subscriptions.
+func (ix *Index) publish(b *Batch) {
+	ix.smtx.Lock()
+	defer ix.smtx.Unlock()
+
+	if len(ix.subs) == 0 || len(b.docs) == 0 {
+		return
+	}
+	terms := make(map[termid]Term, len(b.terms))
+	for t, tb := range b.terms {
+		terms[tb.id] = t
+	}
+	var doc Terms
+
+	for _, d := range b.docs {
+		doc = doc[:0]
+		for _, t := range d.terms {
+			doc = append(doc, terms[t])
+		}
+		for s := range ix.subs {
+			if !s.matches(ix, doc) {
+				continue
+			}
+			select {
+			case s.ch <- d.id:
+			default:
+				ix.counters.subscriptionDrops.Add(1)
+			}
+		}
+	}
+}
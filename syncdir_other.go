@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package tindex
+
+// syncDir is a no-op as directories cannot be synced on the platform.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package tindex
+
+import "os"
+
+// syncDir flushes the directory entries of dir to disk so that files renamed
+// into it persist after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
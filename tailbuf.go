@@ -0,0 +1,172 @@
+package tindex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// bktTailBuffers holds the tail buffers of postings lists if the index is
+// opened with TailBuffer.
+//
+// Small batches append few IDs to many postings lists. Writing them to the
+// postings pages directly rewrites a whole page for each list on every
+// commit. Instead, the most recent IDs of a list are buffered in the
+// key/value store and only written to its pages once the buffer is full.
+// Buffered IDs are committed along with the rest of the batch and merged
+// into the postings list when reading it.
+//
+// A buffer is encoded as the last ID stored in the list's pages followed
+// by the delta-encoded buffered IDs. The first is zero if the list has no
+// pages yet.
+var bktTailBuffers = []byte("postings_tails")
+
+// initTailBuffers creates the tail buffers if enabled. Existing buffers
+// are kept if it is disabled and flushed by the next batch appending to
+// their postings lists.
+func (ix *Index) initTailBuffers(tx *bolt.Tx) error {
+	if ix.opts.TailBuffer <= 0 {
+		return nil
+	}
+	if ix.pageType != pageTypeDelta {
+		return errors.New("tail buffers cannot be combined with values or scores")
+	}
+	if _, err := tx.CreateBucketIfNotExists(bktTailBuffers); err != nil {
+		return fmt.Errorf("create bucket %q failed: %w", string(bktTailBuffers), err)
+	}
+	return nil
+}
+
+func encodeTailBuffer(floor DocID, ids []DocID) []byte {
+	b := make([]byte, (len(ids)+1)*binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(b, uint64(floor))
+	last := floor
+	for _, id := range ids {
+		n += binary.PutUvarint(b[n:], uint64(id-last))
+		last = id
+	}
+	return b[:n]
+}
+
+func decodeTailBuffer(b []byte) (floor DocID, ids []DocID, err error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errPageCorrupt
+	}
+	floor = DocID(x)
+	last := floor
+
+	for b = b[n:]; len(b) > 0; b = b[n:] {
+		if x, n = binary.Uvarint(b); n <= 0 {
+			return 0, nil, errPageCorrupt
+		}
+		last += DocID(x)
+		ids = append(ids, last)
+	}
+	return floor, ids, nil
+}
+
+// bufferPostings adds the IDs of the term to its tail buffer. If the buffer
+// is full, it is emptied and all its IDs are returned to be written to the
+// postings pages. The postings count, Bloom filters, and last ID of the term
+// are updated for all added IDs.
+func (b *Batch) bufferPostings(
+	bkt, counts, blooms, lasts *bolt.Bucket,
+	tb *batchTerm,
+	ids []DocID,
+) ([]DocID, error) {
+	var (
+		floor    DocID
+		buffered []DocID
+		err      error
+	)
+	if v := bkt.Get(tb.id.bytes()); v != nil {
+		if floor, buffered, err = decodeTailBuffer(v); err != nil {
+			return nil, fmt.Errorf("tail buffer of term %d: %w", tb.id, err)
+		}
+	} else {
+		// Without a buffer, all IDs of the list are stored in its pages.
+		floor = getLastID(lasts, tb.id)
+	}
+	last := floor
+	if len(buffered) > 0 {
+		last = buffered[len(buffered)-1]
+	}
+	if b.ix.opts.IgnoreExisting {
+		if ids = idsAfter(ids, last); len(ids) == 0 {
+			return nil, nil
+		}
+	}
+	for _, id := range ids {
+		if id <= last {
+			return nil, ErrOutOfOrder
+		}
+		last = id
+	}
+	if err := addTermCount(counts, tb.id, len(ids)); err != nil {
+		return nil, err
+	}
+	if blooms != nil {
+		if err := addBloom(blooms, tb.id, ids); err != nil {
+			return nil, err
+		}
+	}
+	if err := lasts.Put(tb.id.bytes(), last.bytes()); err != nil {
+		return nil, err
+	}
+	buffered = append(buffered, ids...)
+
+	if len(buffered) < b.ix.opts.TailBuffer {
+		return nil, bkt.Put(tb.id.bytes(), encodeTailBuffer(floor, buffered))
+	}
+	if b.ix.opts.TailBuffer <= 0 {
+		return buffered, bkt.Delete(tb.id.bytes())
+	}
+	return buffered, bkt.Put(tb.id.bytes(), encodeTailBuffer(last, nil))
+}
+
+// bufferedPostings returns the IDs in the tail buffer of term t.
+func (q *Querier) bufferedPostings(t termid) ([]DocID, error) {
+	bkt := q.kvtx.Bucket(bktTailBuffers)
+	if bkt == nil {
+		return nil, nil
+	}
+	v := bkt.Get(t.bytes())
+	if v == nil {
+		return nil, nil
+	}
+	_, ids, err := decodeTailBuffer(v)
+	if err != nil {
+		return nil, fmt.Errorf("tail buffer of term %d: %w", t, err)
+	}
+	return ids, nil
+}
+
+// forEachPostingsList calls fn for each term with a postings list, including
+// lists whose IDs are all buffered.
+func (q *Querier) forEachPostingsList(fn func(t termid) error) error {
+	if err := q.skiplists.forEach(fn); err != nil {
+		return err
+	}
+	bkt := q.kvtx.Bucket(bktTailBuffers)
+	if bkt == nil {
+		return nil
+	}
+	return bkt.ForEach(func(k, v []byte) error {
+		t := newTermID(k)
+		if q.skiplists.cursor(t) != nil {
+			return nil
+		}
+		_, ids, err := decodeTailBuffer(v)
+		if err != nil {
+			return fmt.Errorf("tail buffer of term %d: %w", t, err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return fn(t)
+	})
+}
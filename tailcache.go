@@ -0,0 +1,36 @@
+package tindex
+
+// Appending to a postings list requires the position after its last ID in
+// its tail page. Finding it seeks the skiplist and decodes the whole page.
+// The positions are cached across batches so that sequential ingestion into
+// the same postings lists skips both.
+//
+// The cache is guarded by the index's rwlock. Pages are only modified while
+// holding it, so entries remain valid as long as commits succeed. After a
+// failed commit, pages may have been restored by recovery and the cache is
+// dropped.
+
+// maxTailCursors bounds the number of cached tail cursors. The cache is
+// dropped once it holds more.
+const maxTailCursors = 1 << 16
+
+// tailCursor is the append position in the tail page of a postings list.
+type tailCursor struct {
+	page   uint64 // ID of the page.
+	last   DocID  // Last document ID stored in the page.
+	offset int    // Position after the last ID in the page data.
+}
+
+// updateTailCursors applies the tail cursors of a committed batch to the
+// cache or drops the cache if the commit failed.
+func (ix *Index) updateTailCursors(tcs map[termid]tailCursor, err error) {
+	if err != nil || len(ix.tailCursors)+len(tcs) > maxTailCursors {
+		ix.tailCursors = map[termid]tailCursor{}
+	}
+	if err != nil {
+		return
+	}
+	for t, tc := range tcs {
+		ix.tailCursors[t] = tc
+	}
+}
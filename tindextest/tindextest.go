@@ -0,0 +1,165 @@
+// Package tindextest provides utilities for testing code that uses tindex.
+package tindextest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/fabxc/tindex"
+)
+
+// OpenIndex opens an index in a new temporary directory. The index is closed
+// and the directory removed when the test finishes.
+func OpenIndex(t testing.TB, opts *tindex.Options) *tindex.Index {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "tindextest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := tindex.Open(dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ix.Close()
+		os.RemoveAll(dir)
+	})
+	return ix
+}
+
+// NewStore returns an in-memory store that behaves like an index for the
+// methods of the Store interface.
+func NewStore() tindex.Store {
+	return tindex.NewMemStore()
+}
+
+// Generator generates documents resembling the label sets of time series.
+// Documents are determined by the seed.
+type Generator struct {
+	// Fields is the number of fields of each document besides __name__.
+	Fields int
+	// Names is the number of distinct values of __name__.
+	Names int
+	// Values is the number of distinct values of each field.
+	Values int
+
+	rnd *rand.Rand
+}
+
+// NewGenerator returns a generator with the given seed and defaults of five
+// fields with ten values each and 100 metric names.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		Fields: 5,
+		Names:  100,
+		Values: 10,
+		rnd:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Doc returns the next document. Its terms are sorted by field.
+func (g *Generator) Doc() tindex.Terms {
+	terms := make(tindex.Terms, 0, g.Fields+1)
+	terms = append(terms, tindex.Term{
+		Field: "__name__",
+		Val:   fmt.Sprintf("metric_%d", g.rnd.Intn(g.Names)),
+	})
+	for i := 0; i < g.Fields; i++ {
+		terms = append(terms, tindex.Term{
+			Field: fmt.Sprintf("label_%d", i),
+			Val:   fmt.Sprintf("value_%d", g.rnd.Intn(g.Values)),
+		})
+	}
+	return terms
+}
+
+// Docs returns the next n documents.
+func (g *Generator) Docs(n int) []tindex.Terms {
+	docs := make([]tindex.Terms, n)
+	for i := range docs {
+		docs[i] = g.Doc()
+	}
+	return docs
+}
+
+// ExpectIDs fails the test if the iterator does not hold exactly the given
+// IDs. A nil iterator, as returned by searches without matching terms, holds
+// no IDs.
+func ExpectIDs(t testing.TB, it tindex.Iterator, exp ...tindex.DocID) {
+	t.Helper()
+
+	res := []tindex.DocID{}
+	if it != nil {
+		var err error
+		if res, err = tindex.ExpandIterator(it); err != nil {
+			t.Fatalf("iterating failed: %s", err)
+		}
+	}
+	if exp == nil {
+		exp = []tindex.DocID{}
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("expected IDs %v but got %v", exp, res)
+	}
+}
+
+// ExpectEqual fails the test if the iterators do not hold the same IDs.
+func ExpectEqual(t testing.TB, it1, it2 tindex.Iterator) {
+	t.Helper()
+
+	exp := []tindex.DocID{}
+	if it2 != nil {
+		var err error
+		if exp, err = tindex.ExpandIterator(it2); err != nil {
+			t.Fatalf("iterating failed: %s", err)
+		}
+	}
+	ExpectIDs(t, it1, exp...)
+}
+
+// ExpectSearch fails the test if searching the store does not return the
+// documents with the given terms. The order of documents and terms does not
+// matter.
+func ExpectSearch(t testing.TB, s tindex.Store, key string, m tindex.Matcher, exp ...tindex.Terms) {
+	t.Helper()
+
+	ids, err := s.Search(key, m)
+	if err != nil {
+		t.Fatalf("search %s%s failed: %s", key, m, err)
+	}
+	res, err := s.Docs(ids...)
+	if err != nil {
+		t.Fatalf("reading documents failed: %s", err)
+	}
+	seen := map[string]int{}
+	for _, d := range exp {
+		seen[docKey(d)]++
+	}
+	for _, r := range res {
+		if r.Err != nil {
+			t.Fatalf("reading document failed: %s", r.Err)
+		}
+		k := docKey(r.Terms)
+		if seen[k] == 0 {
+			t.Fatalf("search %s%s: unexpected document %v", key, m, r.Terms)
+		}
+		seen[k]--
+	}
+	if len(res) != len(exp) {
+		t.Fatalf("search %s%s: expected %d documents but got %d", key, m, len(exp), len(res))
+	}
+}
+
+// docKey returns a string identifying the terms of a document.
+func docKey(d tindex.Terms) string {
+	c := append(tindex.Terms(nil), d...)
+	sort.Sort(c)
+	return fmt.Sprint(c)
+}
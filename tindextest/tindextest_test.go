@@ -0,0 +1,70 @@
+package tindextest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fabxc/tindex"
+)
+
+func TestGenerator(t *testing.T) {
+	docs := NewGenerator(1).Docs(100)
+	if !reflect.DeepEqual(docs, NewGenerator(1).Docs(100)) {
+		t.Fatal("expected same documents for same seed")
+	}
+	if reflect.DeepEqual(docs, NewGenerator(2).Docs(100)) {
+		t.Fatal("expected different documents for different seeds")
+	}
+	for _, d := range docs {
+		if err := d.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStores(t *testing.T) {
+	docs := NewGenerator(1).Docs(1000)
+
+	for _, s := range []tindex.Store{OpenIndex(t, nil), NewStore()} {
+		if _, err := s.Add(docs...); err != nil {
+			t.Fatal(err)
+		}
+		var exp []tindex.Terms
+		for _, d := range docs {
+			if d[1].Val == "value_3" {
+				exp = append(exp, d)
+			}
+		}
+		ExpectSearch(t, s, "label_0", tindex.NewEqualMatcher("value_3"), exp...)
+	}
+}
+
+func TestExpectIDs(t *testing.T) {
+	ix := OpenIndex(t, nil)
+
+	ids, err := ix.Add(NewGenerator(1).Docs(10)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := ix.Querier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Search("label_0", tindex.NewEqualMatcher("none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectIDs(t, it)
+
+	search := func() tindex.Iterator {
+		it, err := q.Search("__name__", tindex.Inverse(tindex.NewEqualMatcher("")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return it
+	}
+	ExpectIDs(t, search(), ids...)
+	ExpectEqual(t, search(), search())
+}
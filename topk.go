@@ -0,0 +1,242 @@
+package tindex
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// TopK evaluates queries over indexes with scores without expanding all
+// matching postings. Each skiplist entry records the maximum score of its
+// page. Documents are only scored if the maximum scores of the pages holding
+// them can exceed the lowest score of the current top k. Otherwise, the
+// postings lists are advanced past those pages without reading them.
+//
+// Maximum scores are not lowered when pages are truncated during recovery.
+// They remain valid upper bounds.
+
+// ScoredDoc is a document with the summed scores of its postings.
+type ScoredDoc struct {
+	ID    DocID
+	Score uint64
+}
+
+// unknownMaxScore is the upper bound of pages whose maximum score was
+// not recorded.
+const unknownMaxScore = math.MaxUint8
+
+// topkPage is a page of a postings list.
+type topkPage struct {
+	first DocID
+	max   uint64
+}
+
+// topkCursor iterates over the postings list of a single term.
+type topkCursor struct {
+	it    Iterator
+	doc   DocID
+	pages []topkPage // all pages of the postings list in order
+	max   uint64     // maximum score across all pages
+}
+
+// pageMax returns the maximum score of the page that may hold d and the first
+// ID of the following page.
+func (c *topkCursor) pageMax(d DocID) (max uint64, next DocID) {
+	i := sort.Search(len(c.pages), func(i int) bool { return c.pages[i].first > d })
+
+	next = math.MaxUint64
+	if i < len(c.pages) {
+		next = c.pages[i].first
+	}
+	if i == 0 {
+		return 0, next
+	}
+	return c.pages[i-1].max, next
+}
+
+// TopK returns the k documents with the highest summed scores across the
+// terms matching m for the key, ordered by decreasing score. Ties are ordered
+// by document ID. It requires the index to be created with Scores.
+func (q *Querier) TopK(k int, key string, m Matcher) ([]ScoredDoc, error) {
+	if q.ix.pageType != pageTypeScore {
+		return nil, errors.New("index does not store scores")
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	var cursors []*topkCursor
+
+	for _, t := range q.termsForMatcher(key, m) {
+		c, err := q.topkCursor(t)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			cursors = append(cursors, c)
+		}
+	}
+	res := &scoredDocHeap{}
+
+	for len(cursors) > 0 {
+		sort.Slice(cursors, func(i, j int) bool { return cursors[i].doc < cursors[j].doc })
+
+		// Until k documents are found, every document qualifies. Afterwards,
+		// only documents scoring higher than the lowest result do.
+		full := res.Len() == k
+		var min uint64
+		if full {
+			min = (*res)[0].Score
+		}
+		// Find the first document whose postings may score higher than the
+		// lowest result. No document before it can.
+		p, bound := -1, uint64(0)
+		for i, c := range cursors {
+			if bound += c.max; !full || bound > min {
+				p = i
+				break
+			}
+		}
+		if p < 0 {
+			break
+		}
+		d := cursors[p].doc
+
+		// All cursors up to the pivot and those already at its document may
+		// hold it. Check whether their current pages can score high enough.
+		var (
+			n        = p + 1
+			pageMax  uint64
+			nextPage = DocID(math.MaxUint64)
+		)
+		for n < len(cursors) && cursors[n].doc == d {
+			n++
+		}
+		for _, c := range cursors[:n] {
+			max, next := c.pageMax(d)
+			pageMax += max
+			if next < nextPage {
+				nextPage = next
+			}
+		}
+		var err error
+
+		if full && pageMax <= min {
+			// No document before the next page boundary or the next document
+			// of the other cursors can qualify.
+			target := nextPage
+			if n < len(cursors) && cursors[n].doc < target {
+				target = cursors[n].doc
+			}
+			if target <= d {
+				target = d + 1
+			}
+			cursors, err = advanceTopK(cursors, n, target)
+		} else if cursors[0].doc == d && !q.visible(d) {
+			cursors, err = advanceTopK(cursors, n, d+1)
+		} else if cursors[0].doc == d {
+			var score uint64
+			for _, c := range cursors[:n] {
+				score += scoreOf(c.it)
+			}
+			if !full {
+				heap.Push(res, ScoredDoc{ID: d, Score: score})
+			} else if score > min {
+				(*res)[0] = ScoredDoc{ID: d, Score: score}
+				heap.Fix(res, 0)
+			}
+			cursors, err = advanceTopK(cursors, n, d+1)
+		} else {
+			cursors, err = advanceTopK(cursors, p, d)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	docs := make([]ScoredDoc, res.Len())
+	for i := len(docs) - 1; i >= 0; i-- {
+		docs[i] = heap.Pop(res).(ScoredDoc)
+	}
+	return docs, nil
+}
+
+// topkCursor returns a cursor over the postings list of term t positioned
+// at its first document. It returns nil if the list is empty.
+func (q *Querier) topkCursor(t termid) (*topkCursor, error) {
+	sl := q.skiplists.cursor(t)
+	if sl == nil {
+		return nil, nil
+	}
+	c := &topkCursor{}
+
+	err := sl.forEach(func(d DocID, v []byte) error {
+		pg := topkPage{first: d, max: unknownMaxScore}
+		if len(v) > 8 {
+			pg.max = uint64(v[8])
+		}
+		if pg.max > c.max {
+			c.max = pg.max
+		}
+		c.pages = append(c.pages, pg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.it, err = q.postingsIter(t, nil); err != nil {
+		return nil, err
+	}
+	if c.doc, err = c.it.Seek(0); err == io.EOF {
+		return nil, nil
+	}
+	return c, err
+}
+
+// advanceTopK seeks the first n cursors to the target document if they are
+// before it and drops exhausted ones.
+func advanceTopK(cursors []*topkCursor, n int, target DocID) ([]*topkCursor, error) {
+	for _, c := range cursors[:n] {
+		if c.doc >= target {
+			continue
+		}
+		var err error
+		if c.doc, err = c.it.Seek(target); err == io.EOF {
+			c.it = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	res := cursors[:0]
+	for _, c := range cursors {
+		if c.it != nil {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// scoredDocHeap is a min-heap of documents with the lowest scoring one first.
+// Of documents with equal scores, the one with the highest ID is first.
+type scoredDocHeap []ScoredDoc
+
+func (h scoredDocHeap) Len() int { return len(h) }
+
+func (h scoredDocHeap) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score < h[j].Score
+	}
+	return h[i].ID > h[j].ID
+}
+
+func (h scoredDocHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *scoredDocHeap) Push(x interface{}) { *h = append(*h, x.(ScoredDoc)) }
+
+func (h *scoredDocHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,91 @@
+package tindex
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// errTTLWithoutHistory is returned if the schema sets TTLs but the times
+// documents were added are not recorded.
+var errTTLWithoutHistory = errors.New("schema TTLs require History")
+
+// anyMatcher matches all values.
+type anyMatcher struct{}
+
+func (anyMatcher) Match(string) bool { return true }
+func (anyMatcher) String() string    { return `=~".*"` }
+
+// Expire soft-deletes all documents that carry fields with a TTL in the
+// schema and that were added longer ago than the largest TTL of their
+// fields. It returns the number of expired documents.
+//
+// The time a document was added is taken from the history of the index.
+// Documents added before History was enabled are considered added at the
+// first recorded commit. Expire fails if the index has TTLs but no history.
+func (ix *Index) Expire(now time.Time) (int, error) {
+	if ix.schema == nil || len(ix.schema.ttls) == 0 {
+		return 0, nil
+	}
+	if !ix.opts.History {
+		return 0, errTTLWithoutHistory
+	}
+	ids, err := ix.expired(now)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ix.SoftDelete(newPlainListIterator(ids))
+}
+
+// expired returns the IDs of all documents whose fields expired at the
+// given time.
+func (ix *Index) expired(now time.Time) ([]DocID, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	// Indexes opened read-only with History may have been written without.
+	if q.kvtx.Bucket(bktHistory) == nil {
+		return nil, fmt.Errorf("history: %w", ErrNotFound)
+	}
+	gens, err := q.History()
+	if err != nil {
+		return nil, err
+	}
+	if len(gens) == 0 {
+		return nil, nil
+	}
+	var its []Iterator
+
+	for f := range ix.schema.ttls {
+		it, err := q.Search(f, anyMatcher{})
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	var ids []DocID
+
+	err = forEachDoc(q.kvtx, ix.docs, Merge(its...), func(id DocID, terms Terms) {
+		var ttl time.Duration
+		for _, t := range terms {
+			if d, ok := ix.schema.ttls[t.Field]; ok && d > ttl {
+				ttl = d
+			}
+		}
+		// Generations are ordered by their last document ID.
+		i := sort.Search(len(gens), func(i int) bool {
+			return gens[i].LastDocID >= id
+		})
+		if i == len(gens) {
+			return
+		}
+		if now.Sub(gens[i].Time) >= ttl {
+			ids = append(ids, id)
+		}
+	})
+	return ids, err
+}
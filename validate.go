@@ -0,0 +1,60 @@
+package tindex
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Validate checks that all terms are non-empty, valid UTF-8, that fields
+// contain no control characters, and that no field occurs more than once.
+func (t Terms) Validate() error {
+	return validateTerms(t)
+}
+
+// validateTerms checks that all terms of a document are valid and that
+// no field occurs more than once.
+func validateTerms(terms Terms) error {
+	fields := make(map[string]struct{}, len(terms))
+
+	for _, t := range terms {
+		if err := validateTerm(t); err != nil {
+			return err
+		}
+		if _, ok := fields[t.Field]; ok {
+			return fmt.Errorf("duplicate field %q", t.Field)
+		}
+		fields[t.Field] = struct{}{}
+	}
+	return nil
+}
+
+// validateTerm checks that the term's field and value are non-empty, valid
+// UTF-8, that the field contains no control characters, and that the term is
+// decoded to the same term it was encoded from.
+func validateTerm(t Term) error {
+	if t.Field == "" {
+		return fmt.Errorf("empty field for value %q", t.Val)
+	}
+	if t.Val == "" {
+		return fmt.Errorf("empty value for field %q", t.Field)
+	}
+	if !utf8.ValidString(t.Field) {
+		return fmt.Errorf("field %q is not valid UTF-8", t.Field)
+	}
+	if strings.IndexFunc(t.Field, unicode.IsControl) >= 0 {
+		return fmt.Errorf("field %q contains control characters", t.Field)
+	}
+	if !utf8.ValidString(t.Val) {
+		return fmt.Errorf("value %q for field %q is not valid UTF-8", t.Val, t.Field)
+	}
+	rt, err := newTerm(t.bytes())
+	if err != nil {
+		return fmt.Errorf("term %s=%q: %w", t.Field, t.Val, err)
+	}
+	if rt != t {
+		return fmt.Errorf("term %s=%q decoded as %s=%q", t.Field, t.Val, rt.Field, rt.Val)
+	}
+	return nil
+}
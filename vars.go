@@ -0,0 +1,62 @@
+package tindex
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// counters track activity of an index.
+type counters struct {
+	commits           expvar.Int
+	commitFailures    expvar.Int
+	docs              expvar.Int
+	postings          expvar.Int
+	pagesWritten      expvar.Int
+	searches          expvar.Int
+	openBatches       expvar.Int
+	openQueriers      expvar.Int
+	recoveries        expvar.Int
+	quarantined       expvar.Int
+	rateLimited       expvar.Int
+	subscriptionDrops expvar.Int
+	queryCacheHits    expvar.Int
+	queryCacheMisses  expvar.Int
+}
+
+// newVars returns a map exposing the counters.
+func newVars(c *counters) *expvar.Map {
+	m := new(expvar.Map).Init()
+
+	m.Set("commits", &c.commits)
+	m.Set("commit_failures", &c.commitFailures)
+	m.Set("docs_added", &c.docs)
+	m.Set("postings_added", &c.postings)
+	m.Set("pages_written", &c.pagesWritten)
+	m.Set("searches", &c.searches)
+	m.Set("open_batches", &c.openBatches)
+	m.Set("open_queriers", &c.openQueriers)
+	m.Set("recoveries", &c.recoveries)
+	m.Set("quarantined_pages", &c.quarantined)
+	m.Set("commits_rate_limited", &c.rateLimited)
+	m.Set("subscription_drops", &c.subscriptionDrops)
+	m.Set("query_cache_hits", &c.queryCacheHits)
+	m.Set("query_cache_misses", &c.queryCacheMisses)
+
+	return m
+}
+
+// Vars returns the internal counters of the index. They can be published
+// with expvar.Publish under a name of the caller's choice.
+func (ix *Index) Vars() expvar.Var {
+	return ix.vars
+}
+
+// DebugHandler returns an HTTP handler serving the internal counters
+// of the index as JSON.
+func (ix *Index) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintln(w, ix.vars.String())
+	})
+}
@@ -0,0 +1,147 @@
+package tindex
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CorruptPage describes a postings page that is missing or cannot be decoded.
+type CorruptPage struct {
+	Term Term
+	Page uint64
+	// Range of document IDs the page covers. Max is zero if the page
+	// is the last one of the postings list or its end is unknown.
+	Min, Max DocID
+	Err      error
+}
+
+func (p CorruptPage) String() string {
+	return fmt.Sprintf("page %d of term %s=%q [%d,%d): %s", p.Page, p.Term.Field, p.Term.Val, p.Min, p.Max, p.Err)
+}
+
+// quarantine records the page as corrupted.
+func (ix *Index) quarantine(cp CorruptPage) {
+	ix.qmtx.Lock()
+	defer ix.qmtx.Unlock()
+
+	if _, ok := ix.quarantines[cp.Page]; ok {
+		return
+	}
+	ix.quarantines[cp.Page] = cp
+	ix.counters.quarantined.Add(1)
+
+	ix.logger.Log(
+		"msg", "quarantined corrupt page",
+		"page", cp.Page,
+		"field", cp.Term.Field,
+		"value", cp.Term.Val,
+		"min", cp.Min,
+		"err", cp.Err,
+	)
+}
+
+// quarantined returns whether the page was quarantined.
+func (ix *Index) quarantined(page uint64) bool {
+	ix.qmtx.Lock()
+	defer ix.qmtx.Unlock()
+
+	_, ok := ix.quarantines[page]
+	return ok
+}
+
+// Verify checks the pages of all postings lists and returns those that are
+// missing or corrupted. Corrupted pages are quarantined and skipped by queries
+// if the index was opened with SkipCorruptPages.
+func (ix *Index) Verify() ([]CorruptPage, error) {
+	return ix.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify but aborts once the context is canceled.
+func (ix *Index) VerifyContext(ctx context.Context) (_ []CorruptPage, err error) {
+	_, span := ix.tracer.Start(ctx, "tindex.Index.Verify")
+	defer func() { endSpan(span, err) }()
+
+	q, err := ix.Querier()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	var (
+		corrupt []CorruptPage
+		pages   int
+	)
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("pages", pages),
+			attribute.Int("corrupt", len(corrupt)),
+		)
+	}()
+
+	err = q.skiplists.forEach(func(tid termid) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c, n, err := q.verifyPostings(tid)
+		corrupt = append(corrupt, c...)
+		pages += n
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ix.quarantineAll(corrupt)
+
+	return corrupt, nil
+}
+
+// verifyPostings checks all pages of the term's postings list. It returns the
+// missing or corrupted pages and the number of pages checked.
+func (q *Querier) verifyPostings(tid termid) (corrupt []CorruptPage, pages int, err error) {
+	t, err := newTerm(q.kvtx.Bucket(bktTermIDs).Get(tid.bytes()))
+	if err != nil {
+		return nil, 0, fmt.Errorf("term %d: %w", tid, err)
+	}
+	// A page is verified once the first ID of the next page is known.
+	var cp *CorruptPage
+
+	check := func() {
+		pages++
+		data, err := q.pbtx.Get(cp.Page)
+		if err != nil {
+			cp.Err = fmt.Errorf("page %d: %w", cp.Page, ErrNotFound)
+		} else {
+			cp.Err = q.ix.newPage(data).verify(cp.Min, cp.Max)
+		}
+		if cp.Err != nil {
+			corrupt = append(corrupt, *cp)
+		}
+	}
+	err = q.skiplists.cursor(tid).forEach(func(d DocID, v []byte) error {
+		if cp != nil {
+			cp.Max = d
+			check()
+		}
+		cp = &CorruptPage{Term: t, Page: decodeUint64(v), Min: d}
+		return nil
+	})
+	if cp != nil {
+		check()
+	}
+	return corrupt, pages, err
+}
+
+// quarantineAll records the pages as corrupted without logging them.
+func (ix *Index) quarantineAll(corrupt []CorruptPage) {
+	ix.qmtx.Lock()
+	defer ix.qmtx.Unlock()
+
+	for _, cp := range corrupt {
+		if _, ok := ix.quarantines[cp.Page]; !ok {
+			ix.counters.quarantined.Add(1)
+		}
+		ix.quarantines[cp.Page] = cp
+	}
+}
@@ -0,0 +1,67 @@
+package tindex
+
+import "sort"
+
+// VirtualField derives the values of a field at query time from the values
+// of another field. Searches for a virtual field match the terms of the
+// source field whose derived value matches.
+type VirtualField struct {
+	// Source is the field the values are derived from.
+	Source string
+	// Value returns the derived value for a value of the source field. An
+	// empty value means the term has no value for the virtual field.
+	Value func(source string) string
+}
+
+// MapField returns a virtual field whose values are looked up in a mapping
+// table from values of the source field.
+func MapField(source string, m map[string]string) VirtualField {
+	return VirtualField{
+		Source: source,
+		Value:  func(v string) string { return m[v] },
+	}
+}
+
+// virtualMatcher matches values of a virtual field's source field by their
+// derived value.
+type virtualMatcher struct {
+	vf VirtualField
+	m  Matcher
+}
+
+func (m virtualMatcher) Match(v string) bool {
+	d := m.vf.Value(v)
+	return d != "" && m.m.Match(d)
+}
+
+func (m virtualMatcher) String() string {
+	return m.m.String()
+}
+
+// resolveField returns the field and matcher that select the terms matching
+// m for key. For virtual fields, they select terms of the source field.
+func (ix *Index) resolveField(key string, m Matcher) (string, Matcher) {
+	vf, ok := ix.opts.VirtualFields[key]
+	if !ok {
+		return key, m
+	}
+	return vf.Source, virtualMatcher{vf: vf, m: m}
+}
+
+// virtualValues returns the derived values of the virtual field in sorted
+// order.
+func (q *Querier) virtualValues(vf VirtualField) []string {
+	var (
+		vals []string
+		seen = map[string]bool{}
+	)
+	for _, v := range q.values(vf.Source) {
+		d := vf.Value(v)
+		if d != "" && !seen[d] {
+			seen[d] = true
+			vals = append(vals, d)
+		}
+	}
+	sort.Strings(vals)
+	return vals
+}
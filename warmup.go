@@ -0,0 +1,57 @@
+package tindex
+
+import "io"
+
+// Warmup reads the postings lists of all terms matched by any of the
+// selectors so that their skiplists and pages are in the page cache before
+// queries need them. Without selectors, all postings lists are read. It
+// returns the number of pages read.
+//
+// It is meant to be called after opening an index to avoid slow queries
+// while the cache is cold.
+func (ix *Index) Warmup(sels ...Selector) (int, error) {
+	q, err := ix.Querier()
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	qs := &queryStats{}
+
+	if len(sels) == 0 {
+		err := q.forEachPostingsList(func(t termid) error {
+			return q.warmup(t, qs)
+		})
+		return qs.pages, err
+	}
+	seen := map[termid]bool{}
+
+	for _, sel := range sels {
+		for _, t := range q.termsForMatcher(sel.Field, sel.Matcher) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+
+			if err := q.warmup(t, qs); err != nil {
+				return qs.pages, err
+			}
+		}
+	}
+	return qs.pages, nil
+}
+
+// warmup reads the entire postings list of the term. Read pages are counted
+// in qs.
+func (q *Querier) warmup(t termid, qs *queryStats) error {
+	it, err := q.postingsIter(t, qs)
+	if err != nil {
+		return err
+	}
+	for _, err = it.Next(); err == nil; _, err = it.Next() {
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
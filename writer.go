@@ -0,0 +1,185 @@
+package tindex
+
+import (
+	"errors"
+	"time"
+)
+
+var errClosed = errors.New("index closed")
+
+// writeQueueSize is the number of asynchronous adds that can be queued
+// before AddAsync blocks.
+const writeQueueSize = 128
+
+// AsyncResult is the outcome of an asynchronous add.
+type AsyncResult struct {
+	IDs []DocID // IDs of the added documents in order
+	Err error
+}
+
+type writeReq struct {
+	docs  []Terms
+	flush bool // commit without waiting for further requests
+	res   chan<- AsyncResult
+}
+
+// AddAsync queues the documents to be added to the index in a single batch
+// by a background writer. The result is sent on the returned channel once
+// the batch was committed. Requests are committed in the order they were
+// queued, possibly together with other requests as configured by the
+// GroupCommit options.
+func (ix *Index) AddAsync(docs ...Terms) <-chan AsyncResult {
+	return ix.enqueue(&writeReq{docs: docs})
+}
+
+// Flush commits all requests queued by AddAsync without waiting for
+// the GroupCommitDelay and returns once they are committed.
+func (ix *Index) Flush() error {
+	ix.wmtx.Lock()
+	running := ix.writeq != nil
+	ix.wmtx.Unlock()
+
+	if !running {
+		return nil
+	}
+	r := <-ix.enqueue(&writeReq{flush: true})
+	if r.Err == errClosed {
+		return nil
+	}
+	return r.Err
+}
+
+// enqueue queues the request to the background writer, which is started
+// if necessary.
+func (ix *Index) enqueue(req *writeReq) <-chan AsyncResult {
+	res := make(chan AsyncResult, 1)
+	req.res = res
+
+	ix.wmtx.Lock()
+	defer ix.wmtx.Unlock()
+
+	if ix.closed {
+		res <- AsyncResult{Err: errClosed}
+		return res
+	}
+	if err := ix.checkReadOnly(); err != nil {
+		res <- AsyncResult{Err: err}
+		return res
+	}
+	if ix.writeq == nil {
+		ix.writeq = make(chan *writeReq, writeQueueSize)
+		ix.writerDone = make(chan struct{})
+
+		go ix.writeLoop(ix.writeq)
+	}
+	ix.writeq <- req
+
+	return res
+}
+
+// writeLoop commits queued requests until the queue is closed.
+func (ix *Index) writeLoop(q <-chan *writeReq) {
+	defer close(ix.writerDone)
+
+	for req := range q {
+		reqs := ix.coalesce(q, req)
+
+		var docs []Terms
+		for _, r := range reqs {
+			docs = append(docs, r.docs...)
+		}
+		var (
+			ids []DocID
+			err error
+		)
+		if len(docs) > 0 {
+			ids, err = ix.add(docs)
+		}
+
+		for _, r := range reqs {
+			if err != nil {
+				r.res <- AsyncResult{Err: err}
+				continue
+			}
+			r.res <- AsyncResult{IDs: ids[:len(r.docs):len(r.docs)]}
+			ids = ids[len(r.docs):]
+		}
+	}
+}
+
+// coalesce returns the request along with further queued requests that
+// should be committed in the same batch.
+func (ix *Index) coalesce(q <-chan *writeReq, req *writeReq) []*writeReq {
+	var (
+		reqs    = []*writeReq{req}
+		n       = len(req.docs)
+		max     = ix.opts.GroupCommitSize
+		timeout <-chan time.Time
+	)
+	if d := ix.opts.GroupCommitDelay; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for !reqs[len(reqs)-1].flush && (max <= 0 || n < max) {
+		// Without a delay, only take requests that are already queued.
+		if timeout == nil {
+			select {
+			case r, ok := <-q:
+				if !ok {
+					return reqs
+				}
+				reqs = append(reqs, r)
+				n += len(r.docs)
+			default:
+				return reqs
+			}
+			continue
+		}
+		select {
+		case r, ok := <-q:
+			if !ok {
+				return reqs
+			}
+			reqs = append(reqs, r)
+			n += len(r.docs)
+		case <-timeout:
+			return reqs
+		}
+	}
+	return reqs
+}
+
+// add adds the documents to the index in a single batch.
+func (ix *Index) add(docs []Terms) ([]DocID, error) {
+	b, err := ix.Batch()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]DocID, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, b.Add(d))
+	}
+	if err := b.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// stopWriter waits for all queued requests to be committed and
+// rejects further ones. It returns false if it was already stopped.
+func (ix *Index) stopWriter() bool {
+	ix.wmtx.Lock()
+	defer ix.wmtx.Unlock()
+
+	if ix.closed {
+		return false
+	}
+	ix.closed = true
+	if ix.writeq != nil {
+		close(ix.writeq)
+		<-ix.writerDone
+		ix.writeq = nil
+	}
+	return true
+}